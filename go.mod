@@ -6,8 +6,10 @@ require (
 	github.com/aws/aws-sdk-go v1.44.185
 	github.com/jackc/pgx/v5 v5.2.0
 	github.com/joho/godotenv v1.4.0
+	github.com/nbutton23/zxcvbn-go v0.0.0-20210217022336-fa2cb2858354
 	github.com/robfig/cron v1.2.0
 	github.com/rs/cors v1.8.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.5.0
 )
 
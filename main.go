@@ -7,6 +7,8 @@ import (
 	"os"
 	qroutes "qaimbe/qaimroutes"
 	qaimservices "qaimbe/qaimservices"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
@@ -29,30 +31,33 @@ func main() {
 	} else {
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
 	err := qaimservices.InitAppState(envType)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer qaimservices.GlobalState.ConnPool.Close()
 	mux := http.NewServeMux() // ! what is a serve mux
-	mux.HandleFunc("/user/", func(w http.ResponseWriter, r *http.Request) {
-		qroutes.UserHandler(w, r, qaimservices.GlobalState.ConnPool)
-	})
-	mux.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
-		qroutes.AdminHandler(w, r, qaimservices.GlobalState.ConnPool)
-	})
+	mux.Handle("/user/", qroutes.NewUserRouter(qaimservices.GlobalState.ConnPool))
+	mux.Handle("/admin/", qroutes.NewAdminRouter(qaimservices.GlobalState.ConnPool))
+	mux.Handle("/files/", qroutes.NewFileRouter(qaimservices.GlobalState.ConnPool))
+	mux.HandleFunc("/.well-known/jwks.json", qroutes.JwksHandler)
 	mux.HandleFunc("/test/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "This is a test message, indicating that the backend server is live")
+		qaimservices.ServeMessage(w, r, "This is a test message, indicating that the backend server is live")
 	})
 
 	cors := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000", "https://localhost:3000", "https://qaim-prod.netlify.app"},
-		AllowedHeaders:   []string{"Content-Type", "Token"},
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodOptions},
+		AllowedHeaders:   []string{"Content-Type", "Token", qaimservices.HeaderRequestId, qaimservices.HeaderIdempotencyKey},
+		ExposedHeaders:   []string{qaimservices.HeaderRequestId, qaimservices.HeaderIdempotentReplayed, "Retry-After"},
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions},
 		Debug:            true,
 		AllowCredentials: true,
 	})
-	handler := cors.Handler(mux)
+	handler := cors.Handler(qaimservices.WithRequestId(mux))
 
 	if envType == qaimservices.EnvProd {
 		tlsAddress := "0.0.0.0:" + os.Getenv("TLSPORT")
@@ -66,3 +71,49 @@ func main() {
 		http.ListenAndServe(address, handler)
 	}
 }
+
+/*
+runMigrateCommand handles `qaim-be migrate <up|down [steps]|status>`
+up: apply all pending migrations
+down: revert the latest migration, or the latest `steps` migrations
+status: list every migration and when it was applied
+*/
+func runMigrateCommand(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate <up|down [steps]|status>")
+	}
+	connPool, err := qaimservices.ConnectToDb()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer connPool.Close()
+
+	switch args[0] {
+	case "up":
+		err = qaimservices.MigrateUp(connPool)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatal("migrate down: steps must be a positive number")
+			}
+		}
+		err = qaimservices.MigrateDown(connPool, steps)
+	case "status":
+		statuses, statusErr := qaimservices.MigrationStatuses(connPool)
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-40s %s\n", s.Version, s.Name, appliedAt)
+		}
+		err = statusErr
+	default:
+		log.Fatal("usage: migrate <up|down [steps]|status>")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
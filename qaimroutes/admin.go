@@ -4,9 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	qservices "qaimbe/qaimservices"
 	qstructs "qaimbe/qaimstructs"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -19,306 +22,434 @@ const q_MaxRecordsFetchSz int = 50
 
 func postAdminSignup(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	var admin qstructs.Admin
-	/*
-		* Writing file steps:
-		- using a specific directory
-		- check if dir exists
-		- create dir
-		-
-	*/
 	err := qservices.DecodeJson(r, &admin)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	var fields []qstructs.FieldError
+	if admin.Username == "" {
+		fields = append(fields, qstructs.FieldError{Field: "userName", Message: "required"})
+	}
+	if admin.PhoneNum == "" {
+		fields = append(fields, qstructs.FieldError{Field: "phoneNumber", Message: "required"})
+	}
+	if err := qservices.CheckPasswordPolicy(admin.Password, admin.Username, admin.PhoneNum); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "password", Message: "Password " + err.Error()})
 	}
-	if admin.Username == "" || admin.PhoneNum == "" || admin.Password == "" {
-		fmt.Fprintln(w, "Error, missing required fields")
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
 		return
 	}
 
-	fmt.Fprintf(w, "signup attempting for user %v\n", admin)
 	hashedPass, err := bcrypt.GenerateFromPassword([]byte(admin.Password), bcrypt.DefaultCost)
 	if err != nil {
 		fmt.Println("error generating password")
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred in signup")
 		return
 	}
 
-	_, err = connPool.Exec(
-		context.Background(),
-		"INSERT INTO public.admin (uuid, user_name, phone_num, password_hash, verified) VALUES ((SELECT gen_random_uuid()), $1, $2, $3, $4)",
-		admin.Username, admin.PhoneNum, hashedPass, false)
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred in signup")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var adminId string
+	err = tx.QueryRow(
+		context.TODO(),
+		"INSERT INTO public.admin (uuid, user_name, phone_num, password_hash, verified) VALUES ((SELECT gen_random_uuid()), $1, $2, $3, $4) RETURNING uuid",
+		admin.Username, admin.PhoneNum, hashedPass, false).Scan(&adminId)
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "admin.create", TargetType: "admin", TargetId: adminId,
+			After: map[string]any{"Username": admin.Username, "PhoneNum": admin.PhoneNum, "Verified": false},
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Error occurred in signup", http.StatusInternalServerError)
-
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred in signup")
+		return
 	}
-	fmt.Fprintln(w, "User added successfully")
+	qservices.ServeMessage(w, r, "User added successfully")
 }
 
 func postAdminVerify(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	var admin qstructs.Admin
-	/*
-		* Writing file steps:
-		- using a specific directory
-		- check if dir exists
-		- create dir
-		-
-	*/
 	err := qservices.DecodeJson(r, &admin)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
 	}
 	if admin.Username == "" {
-		fmt.Fprintln(w, "Error, missing required fields")
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "userName", Message: "required"}})
 		return
 	}
 
-	fmt.Fprintf(w, "verifying admin %v\n", admin)
-	_, err = connPool.Exec(
-		context.Background(),
-		`UPDATE PUBLIC.admin
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred in verification")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var adminId string
+	var wasVerified bool
+	err = tx.QueryRow(
+		context.TODO(),
+		`UPDATE PUBLIC.admin AS a
 		SET verified = true
-		WHERE user_name = $1`,
-		admin.Username)
+		FROM (SELECT uuid, verified FROM PUBLIC.admin WHERE user_name = $1 FOR UPDATE) AS old
+		WHERE a.uuid = old.uuid
+		RETURNING a.uuid, old.verified`,
+		admin.Username).Scan(&adminId, &wasVerified)
+	if err == pgx.ErrNoRows {
+		qservices.ServeError(w, r, http.StatusNotFound, "admin not found")
+		return
+	}
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "admin.verify", TargetType: "admin", TargetId: adminId,
+			Before: map[string]any{"Verified": wasVerified},
+			After:  map[string]any{"Verified": true},
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Error occurred in verification", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred in verification")
+		return
 	}
-	fmt.Fprintln(w, "User verified successfully")
+	qservices.ServeMessage(w, r, "User verified successfully")
 }
 
 func postAdminLogin(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	var admin qstructs.Admin
 	err := qservices.DecodeJson(r, &admin)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
 	}
 
+	account := qservices.LoginAccount("admin", admin.Username)
+	if !qservices.AllowLoginAttempt(w, r, connPool, account) {
+		return
+	}
 	var auth qstructs.AdminAuth
 	verified := true
 	err = connPool.QueryRow(context.Background(), "select uuid, user_name, password_hash, verified from public.admin where user_name=$1", admin.Username).Scan(&auth.Uuid, &auth.Username, &auth.PasswordHash, &verified)
 	if err != nil {
 		if err.Error() != qservices.StatusEmptyRequest {
 			fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
-			// TODO(talha): implement a better way of exiting the program
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 			return
 		}
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeError(w, r, http.StatusUnauthorized, "incorrect username/password")
+		return
 	}
 
 	if !verified {
-		fmt.Fprintln(w, "Admin is not verified")
+		qservices.ServeErrorCode(w, r, http.StatusForbidden, qservices.ErrCodeAccountUnverified, "Admin is not verified")
 		return
 	}
 	err = bcrypt.CompareHashAndPassword(auth.PasswordHash, []byte(admin.Password))
 	if err != nil {
-		fmt.Fprintln(w, "incorrect username/password")
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeError(w, r, http.StatusUnauthorized, "incorrect username/password")
+		return
+	}
+	// admins without a second factor get a session that can only enrol one, see RequireMfa
+	amr, ok := loginAmr(w, r, connPool, account, auth.Uuid, admin.Otp)
+	if !ok {
+		return
+	}
+	qservices.ClearLoginFailures(connPool, account)
+	tokens, err := qservices.CreateSession(connPool, auth.Uuid, qservices.ADMIN, amr)
+	if err != nil {
+		fmt.Println("error creating session", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		return
 	}
-	token, err := qservices.CreateJwtToken(auth.Uuid, qservices.ADMIN)
+	err = qservices.ServeJson(w, r, tokens)
 	if err != nil {
-		fmt.Println("error creating jwt token", err)
+		fmt.Println(err)
 	}
-	fmt.Fprintln(w, "You are logged in\nThis is your jwt auth token", token.Token)
 }
 
-/*
-function fetches all unverified users
-TODO: Paginated query for the future
-*/
-func getUsersUnverified(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	rows, err := connPool.Query(
-		context.Background(),
-		"SELECT uuid, national_id, first_name, last_name, id_front, id_back, phone_number, iban, balance, verified FROM public.user WHERE verified = false")
+func parseBoolParam(query url.Values, name string, fields *[]qstructs.FieldError) *bool {
+	str := query.Get(name)
+	if str == "" {
+		return nil
+	}
+	value, err := strconv.ParseBool(str)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
-		return
+		*fields = append(*fields, qstructs.FieldError{Field: name, Message: "must be true or false"})
+		return nil
 	}
-	defer rows.Close()
+	return &value
+}
 
-	/*
-		We need to define an interface matching the query result testRes
-		This is defined in the struct testRes
-	*/
-	var users []qstructs.UserGet
-	for rows.Next() {
-		var u qstructs.UserGet
-		err := rows.Scan(&u.Uuid, &u.NationalId, &u.FirstName, &u.LastName, &u.IdFront, &u.IdBack, &u.PhoneNum, &u.Iban, &u.Balance, &u.Verified)
-		if err != nil {
-			fmt.Println(err)
-			http.Error(w, "Error Fetching unverified users", http.StatusInternalServerError)
-			return
-		}
-		users = append(users, u)
+func parseInt64Param(query url.Values, name string, fields *[]qstructs.FieldError) *int64 {
+	str := query.Get(name)
+	if str == "" {
+		return nil
 	}
-	err = qservices.ServeJson(w, r, users)
+	value, err := strconv.ParseInt(str, 10, 64)
 	if err != nil {
-		http.Error(w, "Error fetching unverified users", http.StatusInternalServerError)
-		return
+		*fields = append(*fields, qstructs.FieldError{Field: name, Message: "must be a whole number"})
+		return nil
 	}
+	return &value
+}
+
+// parseDateParam accepts a date (2006-01-02) or an RFC 3339 timestamp
+func parseDateParam(query url.Values, name string, fields *[]qstructs.FieldError) *time.Time {
+	str := query.Get(name)
+	if str == "" {
+		return nil
+	}
+	value, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		value, err = time.Parse("2006-01-02", str)
+	}
+	if err != nil {
+		*fields = append(*fields, qstructs.FieldError{Field: name, Message: "must be a date (YYYY-MM-DD) or RFC 3339 timestamp"})
+		return nil
+	}
+	return &value
 }
 
 /*
-Function fetches all users in the system
+Parses the admin user listing query
+ACCEPTS: ?verified=&kyc_status=&min_balance=&max_balance=&signed_up_after=&signed_up_before=&pending_withdrawal=
+&q=<name, phone number or national id>&sort=<created_at|balance|last_name|first_name|national_id>
+&order=<asc|desc>&limit=&cursor=<NextCursor from the previous page>
 */
-func getAllUsers(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	rows, err := connPool.Query(context.Background(), "SELECT uuid, national_id, first_name, last_name, id_front, id_back, phone_number, iban, balance, verified FROM public.user")
-	if err != nil {
-		errorStr := fmt.Sprintf("Query failed: %v\n", err)
-		http.Error(w, errorStr, http.StatusInternalServerError)
-		return
+func parseUserListFilter(query url.Values) (qstructs.UserListFilter, []qstructs.FieldError) {
+	var fields []qstructs.FieldError
+	filter := qstructs.UserListFilter{
+		Verified:          parseBoolParam(query, "verified", &fields),
+		MinBalance:        parseInt64Param(query, "min_balance", &fields),
+		MaxBalance:        parseInt64Param(query, "max_balance", &fields),
+		SignedUpAfter:     parseDateParam(query, "signed_up_after", &fields),
+		SignedUpBefore:    parseDateParam(query, "signed_up_before", &fields),
+		PendingWithdrawal: parseBoolParam(query, "pending_withdrawal", &fields),
+		KycStatus:         query.Get("kyc_status"),
+		Search:            strings.TrimSpace(query.Get("q")),
+		Sort:              query.Get("sort"),
+		Cursor:            query.Get("cursor"),
+	}
+	if filter.KycStatus != "" && !qservices.ValidateKycStatus(filter.KycStatus) {
+		fields = append(fields, qstructs.FieldError{Field: "kyc_status", Message: "must be one of pending, approved, rejected, resubmission_requested"})
+	}
+	if filter.Sort != "" && !qservices.ValidateUserSort(filter.Sort) {
+		fields = append(fields, qstructs.FieldError{Field: "sort", Message: "must be one of created_at, balance, last_name, first_name, national_id"})
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		fields = append(fields, qstructs.FieldError{Field: "order", Message: "must be asc or desc"})
 	}
-	defer rows.Close()
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > qservices.UserListMaxPageSize {
+			fields = append(fields, qstructs.FieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", qservices.UserListMaxPageSize)})
+		}
+		filter.Limit = limit
+	}
+	if len(filter.Search) > 100 {
+		fields = append(fields, qstructs.FieldError{Field: "q", Message: "must be at most 100 characters"})
+	}
+	return filter, fields
+}
 
-	/*
-		We need to define an interface matching the query result testRes
-		This is defined in the struct testRes
-	*/
-	var users []qstructs.UserGet
-	for rows.Next() {
-		var u qstructs.UserGet
-		err := rows.Scan(&u.Uuid, &u.NationalId, &u.FirstName, &u.LastName, &u.IdFront, &u.IdBack, &u.PhoneNum, &u.Iban, &u.Balance, &u.Verified)
-		if err != nil {
-			fmt.Println(err)
-			http.Error(w, "Error Fetching unverified users", http.StatusInternalServerError)
+func serveUserList(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, filter qstructs.UserListFilter) {
+	page, err := qservices.ListUsers(connPool, filter)
+	if err != nil {
+		if err == qservices.ErrInvalidCursor {
+			qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "cursor", Message: "invalid cursor for this sort"}})
 			return
 		}
-		users = append(users, u)
+		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error fetching users")
+		return
 	}
-	err = qservices.ServeJson(w, r, users)
+	err = qservices.ServeJson(w, r, page)
 	if err != nil {
-		http.Error(w, "Error fetching users", http.StatusInternalServerError)
+		fmt.Println(err)
+	}
+}
+
+/*
+Fetches a page of unverified users, oldest signups first unless sorted otherwise
+ACCEPTS: the users/all query, verified is always false
+*/
+func getUsersUnverified(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	filter, fields := parseUserListFilter(r.URL.Query())
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+	verified := false
+	filter.Verified = &verified
+	serveUserList(w, r, connPool, filter)
+}
+
+/*
+Fetches a page of the users in the system
+ACCEPTS: see parseUserListFilter
+*/
+func getAllUsers(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	filter, fields := parseUserListFilter(r.URL.Query())
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
 		return
 	}
+	serveUserList(w, r, connPool, filter)
 }
 
 func getUserInfo(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	nationalId := r.URL.Query().Get("national_id")
 	var uInfo qstructs.UserGet
 	err := connPool.QueryRow(context.Background(), `
-		SELECT uuid, national_id, first_name, last_name, id_front, id_back, phone_number, iban, balance, verified 
+		SELECT uuid, national_id, first_name, last_name, id_front, id_back, phone_number, iban, balance, verified,
+			kyc_status, created_at, withdraw_request_id IS NOT NULL
 		FROM public.user
 		WHERE national_id = $1
 	`, nationalId).Scan(&uInfo.Uuid, &uInfo.NationalId, &uInfo.FirstName, &uInfo.LastName, &uInfo.IdFront, &uInfo.IdBack,
-		&uInfo.PhoneNum, &uInfo.Iban, &uInfo.Balance, &uInfo.Verified)
+		&uInfo.PhoneNum, &uInfo.Iban, &uInfo.Balance, &uInfo.Verified, &uInfo.KycStatus, &uInfo.CreatedAt, &uInfo.PendingWithdrawal)
 	if err != nil {
+		if err.Error() == qservices.StatusEmptyRequest {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
 		fmt.Println("Error fetching user details", err)
-		http.Error(w, "error fetching user info", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "error fetching user info")
 		return
 	}
 	err = qservices.ServeJson(w, r, uInfo)
 	if err != nil {
-		http.Error(w, "error writing user info", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "error writing user info")
 		return
 	}
 }
 
-func getUserImage(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	/*
-		Fetches the image stored in the s3 bucket with the supplied filename
-	*/
-	fname := r.URL.Query().Get("fname")
-	fBuff, err := qservices.GetFromS3(fname)
-	if err != nil {
-		fmt.Fprintln(w, "error fetching file", err)
+/*
+Hands out a short lived url to one of the user's id card images, every url issued is audit logged
+PATH: users/{userId}/id-card/{side}, side: front | back
+*/
+func getUserIdCard(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId := qservices.PathParam(r, "userId")
+	side := qservices.PathParam(r, "side")
+	if !qservices.ValidateUuid(userId) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid user id")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(fBuff)
-}
-
-func getUserWdrawRequests(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	nationalId := r.URL.Query().Get("nationalId")
-	if len(nationalId) == 0 {
-		http.Error(w, "Invalid national id supplied", http.StatusBadRequest)
+	if side != "front" && side != "back" {
+		qservices.ServeError(w, r, http.StatusNotFound, "id card side must be front or back")
 		return
 	}
-	rows, err := connPool.Query(context.Background(), `
-	WITH user_id_from_national AS (
-		SELECT uuid AS user_id, iban
+	var objectKey string
+	var keyId *string
+	err := connPool.QueryRow(context.Background(), `
+		SELECT CASE WHEN $2 = 'front' THEN id_front ELSE id_back END, id_key_id
 		FROM PUBLIC.user
-		WHERE national_id = $1 AND verified = TRUE
-	)
-			
-	SELECT wdraw_req.request_id, wdraw_req.user_id, wdraw_req.amount, wdraw_req.request_date, u.iban
-	FROM PUBLIC.user_withdraw_requests AS wdraw_req
-	RIGHT JOIN user_id_from_national AS u
-	ON wdraw_req.user_id = u.user_id
-	WHERE VALID = TRUE;
-	`, nationalId)
+		WHERE uuid = $1
+	`, userId, side).Scan(&objectKey, &keyId)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Error fetching withdrawal requests", http.StatusInternalServerError)
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
+		fmt.Println("error fetching id card key", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		return
 	}
-	defer rows.Close()
 
-	var requests []qstructs.UserBalanceWdrawRequest
-	for rows.Next() {
-		var request qstructs.UserBalanceWdrawRequest
-		err = rows.Scan(&request.RequestId, &request.UserId, &request.Amount, &request.RequestDate, &request.Iban)
+	adminId := qservices.RequestActor(r)
+	expires := time.Now().Add(qservices.KycUrlTtl)
+	var accessId int64
+	err = connPool.QueryRow(context.Background(), `
+		INSERT INTO PUBLIC.kyc_access_log (admin_id, user_id, side, object_key, request_id, remote_addr, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, adminId, userId, side, objectKey, qservices.RequestId(r), r.RemoteAddr, expires).Scan(&accessId)
+	if err != nil {
+		fmt.Println("error logging id card access", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	signed := qstructs.SignedUrl{ExpiresAt: expires.UTC()}
+	if keyId == nil {
+		// plaintext documents can be downloaded straight from the store when it presigns
+		presigned, ok, err := qservices.PresignObject(objectKey, qservices.KycUrlTtl)
 		if err != nil {
-			fmt.Println(err)
-			http.Error(w, "error fetching user withdrawal requests", http.StatusInternalServerError)
-			return
+			fmt.Println("error presigning id card url", err)
+		} else if ok {
+			signed.Url = presigned
 		}
-		requests = append(requests, request)
 	}
-	qservices.ServeJson(w, r, requests)
+	if signed.Url == "" {
+		signed.Url = qservices.SignFileUrl(qservices.PublicBaseUrl(r), accessId, objectKey, expires)
+	}
+	err = qservices.ServeJson(w, r, signed)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
-func getAllUserWdrawRequests(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	rows, err := connPool.Query(context.Background(), `
-		SELECT request_id, user_id, amount, request_date, u.iban
-		FROM PUBLIC.user_withdraw_requests
-		LEFT JOIN PUBLIC.user AS u
-		ON user_id = u.uuid
-		WHERE valid = TRUE;
-	`)
+// A verified user's open withdraw requests
+func getUserWdrawRequests(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	nationalId := r.URL.Query().Get("nationalId")
+	if len(nationalId) == 0 {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Invalid national id supplied")
+		return
+	}
+	requests, err := qservices.ListWithdrawRequests(connPool, qservices.WithdrawOpenStatuses, nationalId)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "error fetching withdraw requests", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error fetching withdrawal requests")
 		return
 	}
-	defer rows.Close()
+	err = qservices.ServeJson(w, r, requests)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
 
-	var requests []qstructs.UserBalanceWdrawRequest
-	for rows.Next() {
-		var request qstructs.UserBalanceWdrawRequest
-		err = rows.Scan(&request.RequestId, &request.UserId, &request.Amount, &request.RequestDate, &request.Iban)
-		if err != nil {
-			fmt.Println(err)
-			http.Error(w, "error fetching user withdrawal requests", http.StatusInternalServerError)
+/*
+Lists withdraw requests, oldest first
+ACCEPTS: ?status=requested | approved | paid | rejected | cancelled, the open (requested and approved) ones when left out
+*/
+func getAllUserWdrawRequests(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	statuses := qservices.WithdrawOpenStatuses
+	if status := r.URL.Query().Get("status"); status != "" {
+		if !qservices.ValidateWithdrawStatus(status) {
+			qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "status", Message: "must be one of requested, approved, paid, rejected, cancelled"}})
 			return
 		}
-		requests = append(requests, request)
+		statuses = []string{status}
 	}
-	qservices.ServeJson(w, r, requests)
-}
-
-func patchUserWdrawRequest(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	requestId := r.URL.Query().Get("requestId")
-	if len(requestId) == 0 {
-		http.Error(w, "Missing request id", http.StatusBadRequest)
-	}
-
-	_, err := connPool.Exec(context.Background(), `
-		WITH invalidate_wdraw_req AS (
-			UPDATE PUBLIC.user_withdraw_requests
-			SET VALID = FALSE
-			WHERE request_id = $1
-			RETURNING user_id
-		)		
-		UPDATE PUBLIC.user
-		SET withdraw_request_id = NULL
-		FROM invalidate_wdraw_req AS req
-		WHERE uuid = req.user_id;
-	`, requestId)
+	requests, err := qservices.ListWithdrawRequests(connPool, statuses, "")
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Error resolving withdraw request", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "error fetching withdraw requests")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	err = qservices.ServeJson(w, r, requests)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 /*
@@ -328,41 +459,161 @@ func postUsersVerify(w http.ResponseWriter, r *http.Request, connPool *pgxpool.P
 	idList := make([]string, 0, q_MaxRecordsFetchSz) // ! When using automatic kyc change to remove user verification limit
 	err := qservices.DecodeJson(r, &idList)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	if len(idList) > q_MaxRecordsFetchSz {
+		qservices.ServeError(w, r, http.StatusBadRequest, fmt.Sprintf("at most %d users can be verified at once", q_MaxRecordsFetchSz))
+		return
 	}
 
-	_, err = connPool.Exec(
-		context.Background(),
-		"UPDATE public.user SET verified = true where national_id = ANY($1)", idList)
+	rows, err := connPool.Query(context.Background(),
+		"SELECT uuid FROM public.user WHERE national_id = ANY($1) AND kyc_status = $2", idList, qservices.KycPending)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error in user update %v\n", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error verifying users")
 		return
 	}
-	fmt.Fprintf(w, "User(s) verified successfully")
+	userIds, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error in user update %v\n", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error verifying users")
+		return
+	}
+	// approved one by one through the kyc review, applications that moved on in the meantime are skipped
+	verified := 0
+	for _, userId := range userIds {
+		_, err = reviewKyc(connPool, r, userId, qservices.KycApproved, "")
+		if err != nil {
+			fmt.Println("error approving user", userId, err)
+			continue
+		}
+		verified++
+	}
+	qservices.ServeMessage(w, r, fmt.Sprintf("%d of %d user(s) verified successfully", verified, len(idList)))
 }
 
+/*
+Moves a user between the normal, secp sandbox and beta roles
+ACCEPTS: ?nationalId=&role=<user|secp|beta>
+*/
+func postSetUserRole(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	nationalId := r.URL.Query().Get("nationalId")
+	role, ok := qservices.ParseUserRole(r.URL.Query().Get("role"))
+	var fields []qstructs.FieldError
+	if !qservices.ValidateNationalId(nationalId) {
+		fields = append(fields, qstructs.FieldError{Field: "nationalId", Message: "invalid national id"})
+	}
+	if !ok {
+		fields = append(fields, qstructs.FieldError{Field: "role", Message: "supported roles are: user, secp, beta"})
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error updating user role")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var userId string
+	var oldRole int
+	err = tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.user AS u
+		SET role = $1
+		FROM (SELECT uuid, role FROM PUBLIC.user WHERE national_id = $2 FOR UPDATE) AS old
+		WHERE u.uuid = old.uuid
+		RETURNING u.uuid, old.role
+	`, int(role), nationalId).Scan(&userId, &oldRole)
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "user.role.set", TargetType: "user", TargetId: userId,
+			Before: map[string]any{"Role": oldRole},
+			After:  map[string]any{"Role": int(role)},
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		if err.Error() == qservices.StatusEmptyRequest {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
+		fmt.Println("error updating user role", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error updating user role")
+		return
+	}
+	// existing tokens carry the old role
+	err = qservices.RevokeSubjectSessions(connPool, userId)
+	if err != nil {
+		fmt.Println("error revoking user sessions", err)
+	}
+	qservices.ServeMessage(w, r, "User role updated successfully")
+}
+
+/*
+Credits a verified user's wallet. Credits of at least the wallet.credit approval threshold are only
+applied after another admin approves them, answering 202 with the pending operation
+ACCEPTS: { NationalId, Balance: amount to credit }
+*/
 func postAddUserBalance(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	var userStats qstructs.UserUpdate
 	err := qservices.DecodeJson(r, &userStats)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	if userStats.Balance <= 0 {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "Balance", Message: "must be a positive amount"}})
 		return
 	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error updating balance")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+
+	var userId string
+	err = tx.QueryRow(context.TODO(),
+		"SELECT uuid FROM PUBLIC.user WHERE national_id = $1 AND verified = true", userStats.NationalId).Scan(&userId)
+	var needsApproval bool
+	if err == nil {
+		needsApproval, err = qservices.RequiresApproval(tx, qservices.OpWalletCredit, userStats.Balance)
+	}
+	var op qstructs.PendingOperation
 	var updated_balance int64
-	err = connPool.QueryRow(context.Background(), `
-		UPDATE PUBLIC.user
-		SET balance = balance + $1
-		WHERE national_id = $2 AND verified = true
-		RETURNING balance
-	`, userStats.Balance, userStats.NationalId).Scan(&updated_balance)
+	if err == nil && needsApproval {
+		op, err = qservices.CreatePendingOperation(tx, r, qservices.OpWalletCredit, userId, userStats.Balance,
+			map[string]any{"NationalId": userStats.NationalId})
+	} else if err == nil {
+		updated_balance, err = creditUserBalance(tx, r, userId, userStats.Balance, 0)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "verified user not found")
+			return
+		}
 		fmt.Println("error in postAddUserBalance\n", err)
-		http.Error(w, "Error updating balance", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error updating balance")
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "{balance: %d}", updated_balance)
+	if needsApproval {
+		servePendingOperation(w, r, op)
+		return
+	}
+	err = qservices.ServeJson(w, r, qstructs.BalanceResponse{Balance: updated_balance})
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 func postAddTBillInterestRate(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
@@ -375,38 +626,63 @@ func postAddTBillInterestRate(w http.ResponseWriter, r *http.Request, connPool *
 	var ir qstructs.TbillInterestRate
 	err := qservices.DecodeJson(r, &ir)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
 		return
 	}
 
 	t, err := time.Parse(time.RFC3339, ir.Date)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "Date", Message: "must be an RFC3339 date"}})
 		return
 	}
 	// get UTC Date as ISO string
 	fmtDate := t.UTC().Format(time.RFC3339)
-	_, err = connPool.Exec(
-		context.Background(),
-		"INSERT INTO public.tbill_interest_rates (uuid, date, interest_rate) VALUES ((SELECT gen_random_uuid()), $1, $2)",
-		fmtDate, ir.InterestRate)
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error adding interest rate")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var rateId string
+	err = tx.QueryRow(
+		context.TODO(),
+		"INSERT INTO public.tbill_interest_rates (uuid, date, interest_rate) VALUES ((SELECT gen_random_uuid()), $1, $2) RETURNING uuid",
+		fmtDate, ir.InterestRate).Scan(&rateId)
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "tbill.interest_rate.add", TargetType: "tbill_interest_rate", TargetId: rateId,
+			After: map[string]any{"Date": fmtDate, "InterestRate": ir.InterestRate},
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
 	if err != nil {
-		// TODO(talha): handle signup errors
 		fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error adding interest rate")
 		return
 	}
-	fmt.Fprintln(w, "interest rate added successfully")
+	qservices.ServeMessage(w, r, "interest rate added successfully")
 }
 
 func postAddTBillBonds(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	var bonds []qstructs.TbillBond
 	err := qservices.DecodeJson(r, &bonds)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
 	}
-	copyCount, err := connPool.CopyFrom(
-		context.Background(),
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error adding tbills")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	copyCount, err := tx.CopyFrom(
+		context.TODO(),
 		pgx.Identifier{"tbills"},
 		[]string{"tenor_days", "issue_date", "interest_rate", "amount", "available_amount", "maturity_date"},
 		pgx.CopyFromSlice(len(bonds), func(i int) ([]any, error) {
@@ -421,10 +697,24 @@ func postAddTBillBonds(w http.ResponseWriter, r *http.Request, connPool *pgxpool
 				bonds[i].Amount, bonds[i].MaturityDate}, nil
 		}),
 	)
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "tbill.bonds.add", TargetType: "tbills",
+			After: map[string]any{"Count": copyCount, "Bonds": bonds},
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("error copying tbills", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error adding tbills")
+		return
+	}
+	err = qservices.ServeJson(w, r, qstructs.CopyCountResponse{RowsCopied: copyCount})
+	if err != nil {
+		fmt.Println(err)
 	}
-	fmt.Fprintln(w, copyCount, "Rows copied over")
 }
 
 func getCurrentTbills(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
@@ -434,62 +724,79 @@ func getCurrentTbills(w http.ResponseWriter, r *http.Request, connPool *pgxpool.
 		 FROM PUBLIC.tbills where valid = true`,
 	)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("error fetching tbills", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "error fetching tbills")
 		return
 	}
 	defer rows.Close()
 
-	var tbills []qstructs.DbTbillEntry
+	tbills := []qstructs.DbTbillEntry{}
 	for rows.Next() {
 		var tbill qstructs.DbTbillEntry
 		err = rows.Scan(&tbill.Uuid, &tbill.TenorDays, &tbill.Amount, &tbill.AvailableAmount, &tbill.InterestRate,
 			&tbill.IssueDate, &tbill.MaturityDate)
 		if err != nil {
 			fmt.Println(err)
-			http.Error(w, "error fetching user tbill tokens", http.StatusInternalServerError)
+			qservices.ServeError(w, r, http.StatusInternalServerError, "error fetching user tbill tokens")
 			return
 		}
 		tbills = append(tbills, tbill)
 	}
-	qservices.ServeJson(w, r, tbills)
+	err = qservices.ServeJson(w, r, tbills)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
-func AdminHandler(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	const prefix = "/admin/"
-	const prefixLen = len(prefix)
-
-	switch path := r.URL.Path[prefixLen:]; path {
-	case "signup":
-		qservices.MethodGuard(postAdminSignup, w, r, connPool, "POST", qservices.SUPERUSER)
-	case "verify":
-		qservices.MethodGuard(postAdminVerify, w, r, connPool, "POST", qservices.SUPERUSER)
-	case "login":
-		qservices.MethodGuard(postAdminLogin, w, r, connPool, "POST", qservices.NONE)
-	case "users/info":
-		qservices.MethodGuard(getUserInfo, w, r, connPool, "GET", qservices.ADMIN)
-	case "users/unverified":
-		qservices.MethodGuard(getUsersUnverified, w, r, connPool, "GET", qservices.ADMIN)
-	case "users/verify":
-		qservices.MethodGuard(postUsersVerify, w, r, connPool, "POST", qservices.ADMIN)
-	case "users/all":
-		qservices.MethodGuard(getAllUsers, w, r, connPool, "GET", qservices.ADMIN)
-	case "users/img":
-		qservices.MethodGuard(getUserImage, w, r, connPool, "GET", qservices.ADMIN)
-	case "users/wallet/add":
-		qservices.MethodGuard(postAddUserBalance, w, r, connPool, "POST", qservices.ADMIN)
-	case "users/wallet/withdraw":
-		qservices.MethodGuard(getUserWdrawRequests, w, r, connPool, "GET", qservices.ADMIN)
-	case "users/wallet/withdraw/resolve":
-		qservices.MethodGuard(patchUserWdrawRequest, w, r, connPool, "PATCH", qservices.ADMIN)
-	case "users/wallet/withdraw/all":
-		qservices.MethodGuard(getAllUserWdrawRequests, w, r, connPool, "GET", qservices.ADMIN)
-	case "tbill/interest-rate/add":
-		qservices.MethodGuard(postAddTBillInterestRate, w, r, connPool, "POST", qservices.ADMIN)
-	case "tbill/add":
-		qservices.MethodGuard(postAddTBillBonds, w, r, connPool, "POST", qservices.ADMIN)
-	case "tbill/all":
-		qservices.MethodGuard(getCurrentTbills, w, r, connPool, "GET", qservices.ADMIN)
-	default:
-		fmt.Fprintln(w, "404 page not found")
-	}
+// NewAdminRouter declares the routes served under /admin/
+func NewAdminRouter(connPool *pgxpool.Pool) *qservices.Router {
+	router := qservices.NewRouter("/admin/", connPool)
+	router.Use(qservices.RecoverPanics, qservices.LogRequests, qservices.LimitRequestsByIp)
+	router.UseAuthorized(qservices.LimitRequestsBySubject, qservices.RequireMfa, qservices.IdempotentRequests, qservices.AuditMutations)
+
+	router.Handle(http.MethodPost, "signup", postAdminSignup, qservices.SUPERUSER)
+	router.Handle(http.MethodPost, "verify", postAdminVerify, qservices.SUPERUSER)
+	router.Handle(http.MethodPost, "login", postAdminLogin, qservices.NONE).Use(qservices.LimitLoginsByIp)
+	router.Handle(http.MethodPost, "token/refresh", postTokenRefresh, qservices.NONE)
+	router.Handle(http.MethodPost, "logout", postLogout, qservices.ADMIN).MfaOptional()
+	router.Handle(http.MethodPost, "mfa/totp/enrol", postTotpEnrol, qservices.ADMIN).MfaOptional().NotIdempotent()
+	router.Handle(http.MethodPost, "mfa/totp/confirm", postTotpConfirm, qservices.ADMIN).MfaOptional().NotIdempotent()
+	router.Handle(http.MethodPost, "mfa/recovery-codes", postRecoveryCodes, qservices.ADMIN).NotIdempotent()
+	router.Handle(http.MethodPost, "password/change", postAdminPasswordChange, qservices.ADMIN).NotIdempotent()
+	router.Handle(http.MethodDelete, "admins/{adminId}/mfa", deleteAdminTotp, qservices.SUPERUSER)
+	router.Handle(http.MethodGet, "users/info", getUserInfo, qservices.ADMIN)
+	router.Handle(http.MethodGet, "users/unverified", getUsersUnverified, qservices.ADMIN)
+	router.Handle(http.MethodPost, "users/verify", postUsersVerify, qservices.ADMIN)
+	router.Handle(http.MethodGet, "users/all", getAllUsers, qservices.ADMIN)
+	router.Handle(http.MethodPost, "users/role", postSetUserRole, qservices.ADMIN)
+	router.Handle(http.MethodPost, "users/sessions/revoke", postRevokeUserSessions, qservices.ADMIN)
+	router.Handle(http.MethodGet, "users/{userId}/id-card/{side}", getUserIdCard, qservices.ADMIN)
+	router.Handle(http.MethodGet, "users/{userId}/kyc", getUserKyc, qservices.ADMIN)
+	router.Handle(http.MethodPatch, "users/{userId}/kyc", patchUserKyc, qservices.ADMIN)
+	router.Handle(http.MethodPost, "users/wallet/add", postAddUserBalance, qservices.ADMIN)
+	router.Handle(http.MethodGet, "users/wallet/withdraw", getUserWdrawRequests, qservices.ADMIN)
+	router.Handle(http.MethodPatch, "users/wallet/withdraw/{requestId}", patchUserWdrawRequest, qservices.ADMIN)
+	router.Handle(http.MethodGet, "users/wallet/withdraw/all", getAllUserWdrawRequests, qservices.ADMIN)
+	router.Handle(http.MethodGet, "payouts/batches", getPayoutBatches, qservices.ADMIN)
+	router.Handle(http.MethodPost, "payouts/batches", postPayoutBatch, qservices.ADMIN)
+	router.Handle(http.MethodGet, "payouts/batches/{batchId}", getPayoutBatch, qservices.ADMIN)
+	router.Handle(http.MethodDelete, "payouts/batches/{batchId}", deletePayoutBatch, qservices.ADMIN)
+	router.Handle(http.MethodGet, "payouts/batches/{batchId}/file", getPayoutBatchFile, qservices.ADMIN)
+	router.Handle(http.MethodPost, "payouts/batches/{batchId}/submit", postSubmitPayoutBatch, qservices.ADMIN)
+	router.Handle(http.MethodPost, "payouts/batches/{batchId}/reconcile", postReconcilePayoutBatch, qservices.ADMIN)
+	router.Handle(http.MethodPost, "tbill/interest-rate/add", postAddTBillInterestRate, qservices.ADMIN)
+	router.Handle(http.MethodPost, "tbill/add", postAddTBillBonds, qservices.ADMIN)
+	router.Handle(http.MethodGet, "tbill/all", getCurrentTbills, qservices.ADMIN)
+	router.Handle(http.MethodGet, "approvals", getPendingOperations, qservices.ADMIN)
+	router.Handle(http.MethodPost, "approvals/{operationId}/approve", postApproveOperation, qservices.ADMIN)
+	router.Handle(http.MethodPost, "approvals/{operationId}/reject", postRejectOperation, qservices.ADMIN)
+	router.Handle(http.MethodGet, "approvals/thresholds", getApprovalThresholds, qservices.ADMIN)
+	router.Handle(http.MethodPatch, "approvals/thresholds/{kind}", patchApprovalThreshold, qservices.SUPERUSER)
+	router.Handle(http.MethodGet, "audit", getAuditLog, qservices.ADMIN)
+	router.Handle(http.MethodGet, "audit/verify", getAuditLogVerify, qservices.ADMIN)
+	router.Handle(http.MethodGet, "notifications/recipients", getNotificationRecipients, qservices.ADMIN)
+	router.Handle(http.MethodPost, "notifications/recipients", postNotificationRecipient, qservices.ADMIN)
+	router.Handle(http.MethodPatch, "notifications/recipients/{recipientId}", patchNotificationRecipient, qservices.ADMIN)
+	router.Handle(http.MethodDelete, "notifications/recipients/{recipientId}", deleteNotificationRecipient, qservices.ADMIN)
+	return router
 }
@@ -0,0 +1,242 @@
+package qaimroutes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+creditUserBalance moves amount from the bank to a verified user's wallet inside tx, returning the new balance
+@param operationId the approved pending operation being applied, 0 when applied directly
+*/
+func creditUserBalance(tx pgx.Tx, r *http.Request, userId string, amount int64, operationId int64) (int64, error) {
+	var balance int64
+	err := tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.user
+		SET balance = balance + $1
+		WHERE uuid = $2 AND verified = true
+		RETURNING balance
+	`, amount, userId).Scan(&balance)
+	if err != nil {
+		return 0, err
+	}
+	err = qservices.PostLedgerTransfer(tx, qstructs.LedgerTransfer{
+		UserId: userId, DebitAccount: qservices.LedgerBankCash, CreditAccount: qservices.LedgerUserWallet,
+		Amount: amount, Source: qservices.LedgerSrcDeposit,
+	})
+	if err != nil {
+		return 0, err
+	}
+	after := map[string]any{"Balance": balance, "Amount": amount}
+	if operationId != 0 {
+		after["OperationId"] = operationId
+	}
+	err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+		Action: "wallet.deposit", TargetType: "user", TargetId: userId,
+		Before: map[string]any{"Balance": balance - amount},
+		After:  after,
+	})
+	return balance, err
+}
+
+// applyPendingOperation carries out an approved operation as its checker
+func applyPendingOperation(tx pgx.Tx, r *http.Request, op qstructs.PendingOperation) error {
+	switch op.Kind {
+	case qservices.OpWalletCredit:
+		_, err := creditUserBalance(tx, r, op.TargetId, op.Amount, op.Id)
+		return err
+	case qservices.OpWithdrawApprove:
+		req, err := qservices.LockWithdrawRequest(tx, op.TargetId)
+		if err != nil {
+			return err
+		}
+		return qservices.ReviewWithdrawal(tx, r, &req, qservices.WithdrawApproved, "", "", map[string]any{"OperationId": op.Id})
+	}
+	return fmt.Errorf("unknown operation kind %q", op.Kind)
+}
+
+// servePendingOperation answers a maker whose operation is waiting for a checker
+func servePendingOperation(w http.ResponseWriter, r *http.Request, op qstructs.PendingOperation) {
+	err := qservices.ServeJsonStatus(w, r, http.StatusAccepted, op)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
+
+/*
+Lists maker-checker operations, newest first
+ACCEPTS: ?status=pending | approved | rejected, every status when left out
+*/
+func getPendingOperations(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	status := r.URL.Query().Get("status")
+	if status != "" && !qservices.ValidateOperationStatus(status) {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "status", Message: "must be one of pending, approved, rejected"}})
+		return
+	}
+	ops, err := qservices.ListPendingOperations(connPool, status)
+	if err != nil {
+		fmt.Println("error fetching pending operations", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, ops)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Approves a pending operation and applies it, the admin who requested it can't approve it
+func postApproveOperation(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	decidePendingOperation(w, r, connPool, qservices.OpStatusApproved)
+}
+
+/*
+Rejects a pending operation, nothing is applied
+ACCEPTS: { Reason }
+*/
+func postRejectOperation(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	decidePendingOperation(w, r, connPool, qservices.OpStatusRejected)
+}
+
+func decidePendingOperation(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, status string) {
+	operationId, err := strconv.ParseInt(qservices.PathParam(r, "operationId"), 10, 64)
+	if err != nil || operationId <= 0 {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid operation id")
+		return
+	}
+	var args qstructs.ApprovalDecisionArgs
+	if r.ContentLength != 0 {
+		if err = qservices.DecodeJson(r, &args); err != nil {
+			qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+			return
+		}
+	}
+	args.Reason = strings.TrimSpace(args.Reason)
+	if status == qservices.OpStatusRejected && args.Reason == "" {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "Reason", Message: "a reason is required to reject an operation"}})
+		return
+	}
+	if len(args.Reason) > 500 {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "Reason", Message: "must be at most 500 characters"}})
+		return
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	op, err := qservices.LockPendingOperation(tx, operationId)
+	if err == nil {
+		err = qservices.DecidePendingOperation(tx, r, &op, status, args.Reason)
+	}
+	if err == nil && status == qservices.OpStatusApproved {
+		err = applyPendingOperation(tx, r, op)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		switch err {
+		case pgx.ErrNoRows:
+			if op.Id == 0 {
+				qservices.ServeError(w, r, http.StatusNotFound, "operation not found")
+			} else {
+				// the user lost their verification since the credit was requested
+				qservices.ServeError(w, r, http.StatusConflict, "the operation's target no longer qualifies, reject it instead")
+			}
+		case qservices.ErrOperationDecided:
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeOperationDecided, "operation was already "+op.Status)
+		case qservices.ErrSameApprover:
+			qservices.ServeErrorCode(w, r, http.StatusForbidden, qservices.ErrCodeSameApprover, err.Error())
+		case qservices.ErrWithdrawTransition:
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeWithdrawTransition,
+				"withdraw request can no longer be approved, reject the operation instead")
+		default:
+			fmt.Println("error deciding pending operation", err)
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}
+		return
+	}
+	err = qservices.ServeJson(w, r, op)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// The amounts from which each operation kind needs a second admin's approval
+func getApprovalThresholds(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	thresholds, err := qservices.GetApprovalThresholds(connPool)
+	if err != nil {
+		fmt.Println("error fetching approval thresholds", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, thresholds)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Changes the amount from which an operation kind needs approval, 0 sends every operation for approval
+ACCEPTS: { MinAmount }
+*/
+func patchApprovalThreshold(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	kind := qservices.PathParam(r, "kind")
+	if !qservices.ValidateOperationKind(kind) {
+		qservices.ServeError(w, r, http.StatusNotFound, "unknown operation kind")
+		return
+	}
+	var args qstructs.ApprovalThresholdArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	if args.MinAmount < 0 {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "MinAmount", Message: "must not be negative"}})
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	threshold, err := qservices.SetApprovalThreshold(tx, r, kind, args.MinAmount)
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		fmt.Println("error updating approval threshold", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, threshold)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
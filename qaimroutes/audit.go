@@ -0,0 +1,69 @@
+package qaimroutes
+
+import (
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Lists audit log entries, newest first
+ACCEPTS: ?actor=&action=&target_type=&target_id=&from=&to=&limit=&before=<NextBefore from the previous page>
+*/
+func getAuditLog(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	query := r.URL.Query()
+	var fields []qstructs.FieldError
+	filter := qstructs.AuditLogFilter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetId:   query.Get("target_id"),
+		From:       parseDateParam(query, "from", &fields),
+		To:         parseDateParam(query, "to", &fields),
+	}
+	if before := parseInt64Param(query, "before", &fields); before != nil {
+		if *before <= 0 {
+			fields = append(fields, qstructs.FieldError{Field: "before", Message: "must be an audit entry id"})
+		}
+		filter.Before = *before
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 || limit > qservices.AuditMaxPageSize {
+			fields = append(fields, qstructs.FieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", qservices.AuditMaxPageSize)})
+		}
+		filter.Limit = limit
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+	page, err := qservices.ListAuditLog(connPool, filter)
+	if err != nil {
+		fmt.Println("error fetching audit log", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, page)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Walks the audit log hash chain, reporting the first entry that was tampered with
+func getAuditLogVerify(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	status, err := qservices.VerifyAuditChain(connPool)
+	if err != nil {
+		fmt.Println("error verifying audit log", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, status)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,65 @@
+package qaimroutes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Serves an id card image to the holder of a signed url from getUserIdCard,
+the signature is the authorization, so the route takes no token
+ACCEPTS: ?access=&key=&exp=&sig=
+*/
+func getSignedIdCard(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	accessId, key, ok := qservices.VerifyFileUrl(r.URL.Query())
+	if !ok {
+		qservices.ServeError(w, r, http.StatusForbidden, "invalid or expired url")
+		return
+	}
+	cmdTag, err := connPool.Exec(context.Background(), `
+		UPDATE PUBLIC.kyc_access_log
+		SET fetch_count = fetch_count + 1, last_fetched_at = NOW()
+		WHERE id = $1 AND object_key = $2 AND expires_at > NOW()
+	`, accessId, key)
+	if err != nil {
+		fmt.Println("error logging id card fetch", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if cmdTag.RowsAffected() == 0 {
+		qservices.ServeError(w, r, http.StatusForbidden, "invalid or expired url")
+		return
+	}
+
+	data, err := qservices.GetObject(key)
+	if err == nil {
+		data, err = qservices.OpenKycDocument(key, data)
+	}
+	if err != nil {
+		fmt.Println("error fetching id card", err)
+		if err == qservices.ErrObjectNotFound {
+			qservices.ServeError(w, r, http.StatusNotFound, "file not found")
+			return
+		}
+		qservices.ServeError(w, r, http.StatusInternalServerError, "error fetching file")
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// NewFileRouter declares the routes served under /files/
+func NewFileRouter(connPool *pgxpool.Pool) *qservices.Router {
+	router := qservices.NewRouter("/files/", connPool)
+	router.Use(qservices.RecoverPanics, qservices.LogRequests)
+
+	router.Handle(http.MethodGet, "id-card", getSignedIdCard, qservices.NONE)
+	return router
+}
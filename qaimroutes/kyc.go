@@ -0,0 +1,261 @@
+package qaimroutes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The user's own kyc application, reviewer ids are left out
+func getKycApplication(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId, err := extractUserIdFromToken(w, r)
+	if err != nil {
+		return
+	}
+	application, err := qservices.GetKycApplication(connPool, userId)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
+		fmt.Println("error fetching kyc application", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	for i := range application.Reviews {
+		application.Reviews[i].ReviewerId = ""
+	}
+	err = qservices.ServeJson(w, r, application)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Replaces the user's id card images after a reviewer requested a resubmission,
+the application goes back to pending
+ACCEPTS: multipart form with idFront, idBack
+*/
+func postKycDocuments(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentMultipartForm) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	userId, err := extractUserIdFromToken(w, r)
+	if err != nil {
+		return
+	}
+	_ = r.ParseMultipartForm(0)
+	var fields []qstructs.FieldError
+	var frontData, backData []byte
+	imgF, imgFheader, err := r.FormFile("idFront")
+	if err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "idFront", Message: "Missing front id card image"})
+	} else if frontData, err = qservices.NormalizeImage(imgF, imgFheader); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "idFront", Message: idImageError(err)})
+	}
+	imgB, imgBheader, err := r.FormFile("idBack")
+	if err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "idBack", Message: "Missing back id card image"})
+	} else if backData, err = qservices.NormalizeImage(imgB, imgBheader); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "idBack", Message: idImageError(err)})
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+
+	uploadId, err := qservices.NewUuid()
+	fpath := "id_cards/" + uploadId + "/front.jpg"
+	bpath := "id_cards/" + uploadId + "/back.jpg"
+	var keyId string
+	if err == nil {
+		keyId, err = storeIdImage(fpath, frontData)
+	}
+	if err == nil {
+		_, err = storeIdImage(bpath, backData)
+	}
+	if err != nil {
+		fmt.Println("error uploading file", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error uploading documents")
+		return
+	}
+	// the new objects are orphaned unless the application accepts them
+	discardUpload := func() {
+		qservices.DeleteObject(fpath)
+		qservices.DeleteObject(bpath)
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		discardUpload()
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var oldFront, oldBack string
+	err = tx.QueryRow(context.TODO(),
+		"SELECT id_front, id_back FROM PUBLIC.user WHERE uuid = $1 FOR UPDATE", userId).Scan(&oldFront, &oldBack)
+	var from string
+	if err == nil {
+		from, err = qservices.TransitionKyc(tx, userId, qservices.KycPending, "", "")
+	}
+	if err == nil {
+		_, err = tx.Exec(context.TODO(), `
+			UPDATE PUBLIC.user
+			SET id_front = $2, id_back = $3, id_key_id = NULLIF($4, '')
+			WHERE uuid = $1
+		`, userId, fpath, bpath, keyId)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		discardUpload()
+		if err == qservices.ErrKycTransition {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeKycTransition,
+				"documents can only be uploaded when a resubmission was requested")
+			return
+		}
+		fmt.Println("error resubmitting kyc documents", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error uploading documents")
+		return
+	}
+	for _, key := range []string{oldFront, oldBack} {
+		if err = qservices.DeleteObject(key); err != nil {
+			fmt.Println("error deleting replaced id card image", key, err)
+		}
+	}
+	qservices.ServeMessage(w, r, "Documents uploaded, verification may take 1-2 days")
+	go qservices.NotifyKycTransition(connPool, userId, from, qservices.KycPending, "", "")
+}
+
+// A user's kyc application with its full review history
+func getUserKyc(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId := qservices.PathParam(r, "userId")
+	if !qservices.ValidateUuid(userId) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	application, err := qservices.GetKycApplication(connPool, userId)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
+		fmt.Println("error fetching kyc application", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, application)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Reviews a kyc application
+ACCEPTS: { Status: approved | rejected | resubmission_requested, Reason }, Reason is required unless approving
+*/
+func patchUserKyc(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	userId := qservices.PathParam(r, "userId")
+	if !qservices.ValidateUuid(userId) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	var args qstructs.KycReviewArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	args.Reason = strings.TrimSpace(args.Reason)
+	var fields []qstructs.FieldError
+	// pending is only reached by the user resubmitting documents
+	if !qservices.ValidateKycStatus(args.Status) || args.Status == qservices.KycPending {
+		fields = append(fields, qstructs.FieldError{Field: "Status", Message: "must be one of approved, rejected, resubmission_requested"})
+	} else if qservices.KycReasonRequired(args.Status) && args.Reason == "" {
+		fields = append(fields, qstructs.FieldError{Field: "Reason", Message: "a reason is required for " + args.Status})
+	}
+	if len(args.Reason) > 500 {
+		fields = append(fields, qstructs.FieldError{Field: "Reason", Message: "must be at most 500 characters"})
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+
+	from, err := reviewKyc(connPool, r, userId, args.Status, args.Reason)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
+		if err == qservices.ErrKycTransition {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeKycTransition,
+				fmt.Sprintf("a %s application can't be moved to %s", from, args.Status))
+			return
+		}
+		fmt.Println("error reviewing kyc application", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	application, err := qservices.GetKycApplication(connPool, userId)
+	if err != nil {
+		fmt.Println("error fetching kyc application", err)
+		qservices.ServeMessage(w, r, "application reviewed successfully")
+		return
+	}
+	err = qservices.ServeJson(w, r, application)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+reviewKyc moves a user's kyc application as the request's admin, returning the status it left.
+Approved users are logged out, so they log in again with their full role
+*/
+func reviewKyc(connPool *pgxpool.Pool, r *http.Request, userId string, status string, reason string) (string, error) {
+	reviewerId := qservices.RequestActor(r)
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(context.TODO())
+	from, err := qservices.TransitionKyc(tx, userId, status, reviewerId, reason)
+	if err != nil {
+		return from, err
+	}
+	err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+		Action: "kyc.review", TargetType: "user", TargetId: userId,
+		Before: map[string]any{"Status": from},
+		After:  map[string]any{"Status": status, "Reason": reason},
+	})
+	if err != nil {
+		return from, err
+	}
+	err = tx.Commit(context.TODO())
+	if err != nil {
+		return from, err
+	}
+	if status == qservices.KycApproved {
+		err = qservices.RevokeSubjectSessions(connPool, userId)
+		if err != nil {
+			fmt.Println("error revoking applicant sessions", err)
+		}
+	}
+	go qservices.NotifyKycTransition(connPool, userId, from, status, reviewerId, reason)
+	return from, nil
+}
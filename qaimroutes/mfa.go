@@ -0,0 +1,251 @@
+package qaimroutes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+loginAmr asks for the subject's second factor once it enrolled one,
+returning the authentication methods of the session to create
+@return false when the login was answered and must stop
+*/
+func loginAmr(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, account string, subject string, otp string) ([]string, bool) {
+	enrolled, err := qservices.TotpEnrolled(connPool, subject)
+	if err != nil {
+		fmt.Println("error checking totp enrolment", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return nil, false
+	}
+	if !enrolled {
+		return []string{qservices.AmrPassword}, true
+	}
+	if otp == "" {
+		qservices.ServeErrorCode(w, r, http.StatusUnauthorized, qservices.ErrCodeOtpRequired,
+			"enter the code from your authenticator app or a recovery code")
+		return nil, false
+	}
+	ok, err := qservices.VerifySecondFactor(connPool, subject, otp)
+	if err != nil {
+		fmt.Println("error verifying second factor", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return nil, false
+	}
+	if !ok {
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeErrorCode(w, r, http.StatusUnauthorized, qservices.ErrCodeInvalidOtp, qservices.ErrInvalidOtp.Error())
+		return nil, false
+	}
+	return []string{qservices.AmrPassword, qservices.AmrOtp}, true
+}
+
+// mfaSubject is the caller enrolling a second factor, the superuser api key has none
+func mfaSubject(w http.ResponseWriter, r *http.Request) (qservices.JwtPayload, bool) {
+	claims, ok := qservices.RequestClaims(r)
+	if !ok || claims.Sub == "" {
+		qservices.ServeError(w, r, http.StatusBadRequest, "log in to enrol a second factor")
+		return claims, false
+	}
+	return claims, true
+}
+
+// decodeTotpCode reads the { Code } body of the second factor endpoints
+func decodeTotpCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return "", false
+	}
+	var args qstructs.TotpCodeArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil || args.Code == "" {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "Code", Message: "a code from the authenticator app is required"}})
+		return "", false
+	}
+	return args.Code, true
+}
+
+/*
+Starts enrolling a totp authenticator, answering the secret as an otpauth uri and qr code.
+Confirm it with a first code at mfa/totp/confirm
+*/
+func postTotpEnrol(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	claims, ok := mfaSubject(w, r)
+	if !ok {
+		return
+	}
+	var account string
+	var err error
+	if claims.Aud.Implies(qservices.ADMIN) {
+		err = connPool.QueryRow(context.Background(), "SELECT user_name FROM PUBLIC.admin WHERE uuid = $1", claims.Sub).Scan(&account)
+	} else {
+		err = connPool.QueryRow(context.Background(), "SELECT phone_number FROM PUBLIC.user WHERE uuid = $1", claims.Sub).Scan(&account)
+	}
+	var enrolment qstructs.TotpEnrolment
+	if err == nil {
+		enrolment, err = qservices.BeginTotpEnrolment(connPool, claims.Sub, account)
+	}
+	if err != nil {
+		if err == qservices.ErrTotpEnrolled {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeMfaEnrolled, err.Error())
+			return
+		}
+		fmt.Println("error starting totp enrolment", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = qservices.ServeJson(w, r, enrolment)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Confirms the totp enrolment, answering the recovery codes. They are only shown once,
+log in again with a code to get a session authenticated with both factors
+ACCEPTS: { Code }
+*/
+func postTotpConfirm(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	claims, ok := mfaSubject(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeTotpCode(w, r)
+	if !ok {
+		return
+	}
+	codes, err := qservices.ConfirmTotpEnrolment(connPool, claims.Sub, code)
+	if err != nil {
+		switch err {
+		case qservices.ErrInvalidOtp:
+			qservices.ServeErrorCode(w, r, http.StatusUnprocessableEntity, qservices.ErrCodeInvalidOtp, err.Error())
+		case qservices.ErrTotpEnrolled:
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeMfaEnrolled, err.Error())
+		case qservices.ErrTotpNotEnrolled:
+			qservices.ServeError(w, r, http.StatusNotFound, err.Error())
+		default:
+			fmt.Println("error confirming totp enrolment", err)
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = qservices.ServeJson(w, r, qstructs.RecoveryCodes{RecoveryCodes: codes})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// verifyCallerOtp checks a code of the caller's own second factor before it is changed
+func verifyCallerOtp(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, subject string, code string) bool {
+	ok, err := qservices.VerifySecondFactor(connPool, subject, code)
+	if err != nil {
+		fmt.Println("error verifying second factor", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return false
+	}
+	if !ok {
+		qservices.ServeErrorCode(w, r, http.StatusUnprocessableEntity, qservices.ErrCodeInvalidOtp, qservices.ErrInvalidOtp.Error())
+		return false
+	}
+	return true
+}
+
+/*
+Replaces the caller's recovery codes, the old ones stop working
+ACCEPTS: { Code }
+*/
+func postRecoveryCodes(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	claims, ok := mfaSubject(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeTotpCode(w, r)
+	if !ok || !verifyCallerOtp(w, r, connPool, claims.Sub, code) {
+		return
+	}
+	codes, err := qservices.RegenerateRecoveryCodes(connPool, claims.Sub)
+	if err != nil {
+		if err == qservices.ErrTotpNotEnrolled {
+			qservices.ServeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		fmt.Println("error regenerating recovery codes", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = qservices.ServeJson(w, r, qstructs.RecoveryCodes{RecoveryCodes: codes})
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Turns the user's second factor off, admins can't as theirs is mandatory
+ACCEPTS: { Code }
+*/
+func deleteUserTotp(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	claims, ok := mfaSubject(w, r)
+	if !ok {
+		return
+	}
+	code, ok := decodeTotpCode(w, r)
+	if !ok || !verifyCallerOtp(w, r, connPool, claims.Sub, code) {
+		return
+	}
+	err := qservices.RemoveTotp(connPool, claims.Sub)
+	if err != nil {
+		fmt.Println("error removing totp", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	qservices.ServeMessage(w, r, "Two factor authentication turned off")
+}
+
+// Removes an admin's second factor when they lost their authenticator and recovery codes, they enrol again at their next login
+func deleteAdminTotp(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	adminId := qservices.PathParam(r, "adminId")
+	if !qservices.ValidateUuid(adminId) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid admin id")
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	tag, err := tx.Exec(context.TODO(), "DELETE FROM PUBLIC.totp_credentials WHERE subject = $1", adminId)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = pgx.ErrNoRows
+	}
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{Action: "admin.mfa.reset", TargetType: "admin", TargetId: adminId})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "admin has no second factor enrolled")
+			return
+		}
+		fmt.Println("error resetting admin totp", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	// sessions authenticated with the lost factor must not outlive it
+	err = qservices.RevokeSubjectSessions(connPool, adminId)
+	if err != nil {
+		fmt.Println("error revoking admin sessions", err)
+	}
+	qservices.ServeMessage(w, r, "Admin second factor removed")
+}
@@ -0,0 +1,255 @@
+package qaimroutes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const pgUniqueViolation = "23505"
+
+func validateRecipientArgs(args qstructs.NotificationRecipientArgs) []qstructs.FieldError {
+	var fields []qstructs.FieldError
+	if !qservices.ValidateEmail(args.Email) {
+		fields = append(fields, qstructs.FieldError{Field: "Email", Message: "invalid email address"})
+	}
+	if !qservices.ValidateMailList(args.List) {
+		fields = append(fields, qstructs.FieldError{Field: "List", Message: "list must be one of reporting, logging, notifier"})
+	} else if !qservices.ValidateMailReports(args.List, args.Reports) {
+		fields = append(fields, qstructs.FieldError{Field: "Reports", Message: "unknown report for list " + args.List})
+	}
+	return fields
+}
+
+func recipientIdParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	recipientId, err := strconv.ParseInt(qservices.PathParam(r, "recipientId"), 10, 64)
+	if err != nil || recipientId <= 0 {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid recipient id")
+		return 0, false
+	}
+	return recipientId, true
+}
+
+/*
+Lists the recipients of the notification emails
+ACCEPTS: ?list=<reporting|logging|notifier>, optional
+*/
+func getNotificationRecipients(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	list := r.URL.Query().Get("list")
+	if list != "" && !qservices.ValidateMailList(list) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid list")
+		return
+	}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT id, email, list, reports, created_at
+		FROM PUBLIC.notification_recipients
+		WHERE $1 = '' OR list = $1
+		ORDER BY list, id
+	`, list)
+	if err != nil {
+		fmt.Println("error fetching notification recipients", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer rows.Close()
+
+	recipients := []qstructs.NotificationRecipient{}
+	for rows.Next() {
+		var recipient qstructs.NotificationRecipient
+		err = rows.Scan(&recipient.Id, &recipient.Email, &recipient.List, &recipient.Reports, &recipient.CreatedAt)
+		if err != nil {
+			fmt.Println("error scanning notification recipients", err)
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		recipients = append(recipients, recipient)
+	}
+	err = qservices.ServeJson(w, r, recipients)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Adds a recipient to a list
+ACCEPTS: { Email, List, Reports }, an empty Reports subscribes to every report of the list
+*/
+func postNotificationRecipient(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	var args qstructs.NotificationRecipientArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	fields := validateRecipientArgs(args)
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+	if args.Reports == nil {
+		args.Reports = []string{}
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var recipient qstructs.NotificationRecipient
+	err = tx.QueryRow(context.TODO(), `
+		INSERT INTO PUBLIC.notification_recipients (email, list, reports)
+		VALUES ($1, $2, $3)
+		RETURNING id, email, list, reports, created_at
+	`, args.Email, args.List, args.Reports).Scan(&recipient.Id, &recipient.Email, &recipient.List, &recipient.Reports, &recipient.CreatedAt)
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "notification_recipient.add", TargetType: "notification_recipient", TargetId: strconv.FormatInt(recipient.Id, 10),
+			After: recipient,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation {
+			qservices.ServeError(w, r, http.StatusConflict, "recipient is already on this list")
+			return
+		}
+		fmt.Println("error adding notification recipient", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJsonStatus(w, r, http.StatusCreated, recipient)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Changes the reports a recipient is subscribed to
+ACCEPTS: { Reports }
+*/
+func patchNotificationRecipient(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	recipientId, ok := recipientIdParam(w, r)
+	if !ok {
+		return
+	}
+	var args qstructs.NotificationRecipientArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	if args.Reports == nil {
+		args.Reports = []string{}
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var recipient qstructs.NotificationRecipient
+	err = tx.QueryRow(context.TODO(), `
+		SELECT id, email, list, reports, created_at
+		FROM PUBLIC.notification_recipients
+		WHERE id = $1
+		FOR UPDATE
+	`, recipientId).Scan(&recipient.Id, &recipient.Email, &recipient.List, &recipient.Reports, &recipient.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "recipient not found")
+			return
+		}
+		fmt.Println("error fetching notification recipient", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	if !qservices.ValidateMailReports(recipient.List, args.Reports) {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "Reports", Message: "unknown report for list " + recipient.List}})
+		return
+	}
+	_, err = tx.Exec(context.TODO(),
+		"UPDATE PUBLIC.notification_recipients SET reports = $2 WHERE id = $1", recipientId, args.Reports)
+	before := recipient
+	recipient.Reports = args.Reports
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "notification_recipient.update", TargetType: "notification_recipient", TargetId: strconv.FormatInt(recipientId, 10),
+			Before: before, After: recipient,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		fmt.Println("error updating notification recipient", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, recipient)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Removes a recipient from its list
+func deleteNotificationRecipient(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	recipientId, ok := recipientIdParam(w, r)
+	if !ok {
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var recipient qstructs.NotificationRecipient
+	err = tx.QueryRow(context.TODO(), `
+		DELETE FROM PUBLIC.notification_recipients
+		WHERE id = $1
+		RETURNING id, email, list, reports, created_at
+	`, recipientId).Scan(&recipient.Id, &recipient.Email, &recipient.List, &recipient.Reports, &recipient.CreatedAt)
+	if err == pgx.ErrNoRows {
+		qservices.ServeError(w, r, http.StatusNotFound, "recipient not found")
+		return
+	}
+	if err == nil {
+		err = qservices.AuditTx(tx, r, qstructs.AuditEvent{
+			Action: "notification_recipient.remove", TargetType: "notification_recipient", TargetId: strconv.FormatInt(recipientId, 10),
+			Before: recipient,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		fmt.Println("error deleting notification recipient", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	qservices.ServeMessage(w, r, "recipient removed successfully")
+}
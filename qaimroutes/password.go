@@ -0,0 +1,299 @@
+package qaimroutes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// decodeOtpRequest reads the { PhoneNum } body of the endpoints that text a code
+func decodeOtpRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return "", false
+	}
+	var args qstructs.OtpRequestArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return "", false
+	}
+	args.PhoneNum = strings.TrimSpace(args.PhoneNum)
+	if !qservices.ValidatePhoneNum(args.PhoneNum) {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "PhoneNum", Message: "Invalid phonenumber"}})
+		return "", false
+	}
+	return args.PhoneNum, true
+}
+
+// serveOtpError answers the errors VerifyOtp returns for a wrong code
+func serveOtpError(w http.ResponseWriter, r *http.Request, err error, field string) {
+	if err == qservices.ErrOtpInvalid || err == qservices.ErrOtpAttempts {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: field, Message: err.Error()}})
+		return
+	}
+	fmt.Println("error verifying otp", err)
+	qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+}
+
+/*
+Texts the code that proves the phone number at signup, send it back as the otp form field
+ACCEPTS: { PhoneNum }
+*/
+func postSignupOtp(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	phoneNum, ok := decodeOtpRequest(w, r)
+	if !ok || !qservices.AllowOtp(w, r, connPool, phoneNum) {
+		return
+	}
+	err := qservices.IssueOtp(connPool, phoneNum, qservices.OtpPurposeSignup)
+	if err != nil {
+		if err == qservices.ErrOtpCooldown {
+			qservices.ServeRateLimited(w, r, qservices.ErrCodeRateLimited, qservices.OtpResendAfter, err.Error())
+			return
+		}
+		fmt.Println("error sending signup otp", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error sending the verification code")
+		return
+	}
+	qservices.ServeJsonStatus(w, r, http.StatusAccepted, qstructs.MessageResponse{Message: "Verification code sent"})
+}
+
+/*
+Texts a password reset code when the number belongs to a user.
+The answer is the same either way, so it doesn't tell who has an account
+ACCEPTS: { PhoneNum }
+*/
+func postPasswordForgot(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	phoneNum, ok := decodeOtpRequest(w, r)
+	if !ok || !qservices.AllowOtp(w, r, connPool, phoneNum) {
+		return
+	}
+	var exists bool
+	err := connPool.QueryRow(context.Background(),
+		"SELECT EXISTS (SELECT 1 FROM PUBLIC.user WHERE phone_number = $1)", phoneNum).Scan(&exists)
+	if err == nil && exists {
+		err = qservices.IssueOtp(connPool, phoneNum, qservices.OtpPurposePasswordReset)
+	}
+	if err != nil && err != qservices.ErrOtpCooldown {
+		fmt.Println("error sending password reset otp", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error sending the password reset code")
+		return
+	}
+	qservices.ServeJsonStatus(w, r, http.StatusAccepted,
+		qstructs.MessageResponse{Message: "If the number belongs to an account, a password reset code was sent to it"})
+}
+
+/*
+Sets a new password with the code texted by password/forgot, logging the user out everywhere
+ACCEPTS: { PhoneNum, Code, Password }
+*/
+func postPasswordReset(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	var args qstructs.PasswordResetArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	args.PhoneNum = strings.TrimSpace(args.PhoneNum)
+	args.Code = strings.TrimSpace(args.Code)
+	var fields []qstructs.FieldError
+	if !qservices.ValidatePhoneNum(args.PhoneNum) {
+		fields = append(fields, qstructs.FieldError{Field: "PhoneNum", Message: "Invalid phonenumber"})
+	}
+	if args.Code == "" {
+		fields = append(fields, qstructs.FieldError{Field: "Code", Message: "the code texted to the number is required"})
+	}
+	if err := qservices.CheckPasswordPolicy(args.Password, args.PhoneNum); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "Password", Message: "Password " + err.Error()})
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+	err = qservices.VerifyOtp(connPool, args.PhoneNum, qservices.OtpPurposePasswordReset, args.Code)
+	if err != nil {
+		serveOtpError(w, r, err, "Code")
+		return
+	}
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(args.Password), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println("error generating password hash", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error resetting password")
+		return
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error resetting password")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	var userId string
+	err = tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.user SET password_hash = $2, phone_verified_at = COALESCE(phone_verified_at, NOW())
+		WHERE phone_number = $1
+		RETURNING uuid
+	`, args.PhoneNum, hashedPass).Scan(&userId)
+	if err == nil {
+		err = qservices.NotifyUser(tx, userId, "password_reset", "Your password was reset, you were logged out of every device")
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			serveOtpError(w, r, qservices.ErrOtpInvalid, "Code")
+			return
+		}
+		fmt.Println("error resetting password", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error resetting password")
+		return
+	}
+	err = qservices.RevokeSubjectSessions(connPool, userId)
+	if err != nil {
+		fmt.Println("error revoking user sessions", err)
+	}
+	qservices.ClearLoginFailures(connPool, qservices.LoginAccount("user", args.PhoneNum))
+	qservices.ServeMessage(w, r, "Password reset successfully, log in with the new password")
+}
+
+/*
+changePassword sets the caller's new password once they prove the current one, logging out their
+other sessions and answering a fresh token pair. Wrong current passwords count as failed logins
+@param admin whether the caller is an admin rather than a user
+*/
+func changePassword(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, admin bool) {
+	claims, ok := qservices.RequestClaims(r)
+	if !ok || claims.Sub == "" {
+		qservices.ServeError(w, r, http.StatusBadRequest, "log in to change your password")
+		return
+	}
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	var args qstructs.PasswordChangeArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+
+	var account string
+	var hash []byte
+	var inputs []string
+	if admin {
+		var userName, phoneNum string
+		err = connPool.QueryRow(context.Background(),
+			"SELECT user_name, phone_num, password_hash FROM PUBLIC.admin WHERE uuid = $1", claims.Sub).Scan(&userName, &phoneNum, &hash)
+		account = qservices.LoginAccount("admin", userName)
+		inputs = []string{userName, phoneNum}
+	} else {
+		var phoneNum, firstName, lastName, nationalId string
+		err = connPool.QueryRow(context.Background(), `
+			SELECT phone_number, first_name, last_name, national_id, password_hash
+			FROM PUBLIC.user WHERE uuid = $1
+		`, claims.Sub).Scan(&phoneNum, &firstName, &lastName, &nationalId, &hash)
+		account = qservices.LoginAccount("user", phoneNum)
+		inputs = []string{phoneNum, firstName, lastName, nationalId}
+	}
+	if err != nil {
+		fmt.Println("error loading password hash", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error changing password")
+		return
+	}
+	if !qservices.AllowLoginAttempt(w, r, connPool, account) {
+		return
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(args.CurrentPassword)) != nil {
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "CurrentPassword", Message: "incorrect password"}})
+		return
+	}
+	qservices.ClearLoginFailures(connPool, account)
+	if args.NewPassword == args.CurrentPassword {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "NewPassword", Message: "must differ from the current password"}})
+		return
+	}
+	if err := qservices.CheckPasswordPolicy(args.NewPassword, inputs...); err != nil {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "NewPassword", Message: "Password " + err.Error()}})
+		return
+	}
+	hashedPass, err := bcrypt.GenerateFromPassword([]byte(args.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		fmt.Println("error generating password hash", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error changing password")
+		return
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error changing password")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	if admin {
+		_, err = tx.Exec(context.TODO(), "UPDATE PUBLIC.admin SET password_hash = $2 WHERE uuid = $1", claims.Sub, hashedPass)
+		if err == nil {
+			err = qservices.AuditTx(tx, r, qstructs.AuditEvent{Action: "admin.password.change", TargetType: "admin", TargetId: claims.Sub})
+		}
+	} else {
+		_, err = tx.Exec(context.TODO(), "UPDATE PUBLIC.user SET password_hash = $2 WHERE uuid = $1", claims.Sub, hashedPass)
+		if err == nil {
+			err = qservices.NotifyUser(tx, claims.Sub, "password_changed", "Your password was changed, your other devices were logged out")
+		}
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		fmt.Println("error changing password", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error changing password")
+		return
+	}
+	// sessions started with the old password end, the caller continues in a new one
+	err = qservices.RevokeSubjectSessions(connPool, claims.Sub)
+	if err != nil {
+		fmt.Println("error revoking sessions", err)
+	}
+	tokens, err := qservices.CreateSession(connPool, claims.Sub, claims.Aud, claims.Amr)
+	if err != nil {
+		fmt.Println("error creating session", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	err = qservices.ServeJson(w, r, tokens)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Changes the user's password, answering new tokens as every other session is logged out
+ACCEPTS: { CurrentPassword, NewPassword }
+*/
+func postUserPasswordChange(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	changePassword(w, r, connPool, false)
+}
+
+/*
+Changes the admin's password, answering new tokens as every other session is logged out
+ACCEPTS: { CurrentPassword, NewPassword }
+*/
+func postAdminPasswordChange(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	changePassword(w, r, connPool, true)
+}
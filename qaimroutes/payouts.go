@@ -0,0 +1,248 @@
+package qaimroutes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func parseBatchId(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	batchId, err := strconv.ParseInt(qservices.PathParam(r, "batchId"), 10, 64)
+	if err != nil || batchId <= 0 {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid batch id")
+		return 0, false
+	}
+	return batchId, true
+}
+
+// servePayoutBatchError answers the errors shared by the payout batch endpoints
+func servePayoutBatchError(w http.ResponseWriter, r *http.Request, err error, batch qstructs.PayoutBatch) {
+	switch {
+	case err == pgx.ErrNoRows:
+		qservices.ServeError(w, r, http.StatusNotFound, "payout batch not found")
+	case err == qservices.ErrPayoutBatchStatus:
+		qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodePayoutBatchStatus,
+			fmt.Sprintf("payout batch is %s", batch.Status))
+	case errors.Is(err, qservices.ErrPayoutResponse):
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "response", Message: err.Error()}})
+	case isUniqueViolation(err):
+		qservices.ServeError(w, r, http.StatusConflict, "a bank reference in the response already paid out another withdraw request")
+	default:
+		fmt.Println("error updating payout batch", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+// The latest payout batches, without their transfers
+func getPayoutBatches(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	batches, err := qservices.ListPayoutBatches(connPool)
+	if err != nil {
+		fmt.Println("error fetching payout batches", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, batches)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Draws up a draft batch of every approved withdraw request that isn't batched yet, listing those whose user has no iban in SkippedRequests
+func postPayoutBatch(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	batch, err := qservices.CreatePayoutBatch(tx, r)
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		if err == qservices.ErrNoPayouts {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeNoPayouts, err.Error())
+			return
+		}
+		if err == qservices.ErrPayoutsMissingIban {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodePayoutsMissingIban,
+				err.Error()+", requests: "+strings.Join(batch.SkippedRequests, ", "))
+			return
+		}
+		if isUniqueViolation(err) {
+			qservices.ServeError(w, r, http.StatusConflict, "another payout batch is being drawn up, try again")
+			return
+		}
+		fmt.Println("error creating payout batch", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJsonStatus(w, r, http.StatusCreated, batch)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// A payout batch with its transfers
+func getPayoutBatch(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	batchId, ok := parseBatchId(w, r)
+	if !ok {
+		return
+	}
+	batch, err := qservices.GetPayoutBatch(connPool, batchId)
+	if err != nil {
+		servePayoutBatchError(w, r, err, batch)
+		return
+	}
+	err = qservices.ServeJson(w, r, batch)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Discards a draft batch, its withdraw requests can be batched again
+func deletePayoutBatch(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	batchId, ok := parseBatchId(w, r)
+	if !ok {
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	batch, err := qservices.LockPayoutBatch(tx, batchId)
+	if err == nil {
+		err = qservices.DiscardPayoutBatch(tx, r, batch)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		servePayoutBatchError(w, r, err, batch)
+		return
+	}
+	qservices.ServeMessage(w, r, "payout batch discarded")
+}
+
+// Downloads the batch's transfers in the bank's bulk transfer layout
+func getPayoutBatchFile(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	batchId, ok := parseBatchId(w, r)
+	if !ok {
+		return
+	}
+	batch, err := qservices.GetPayoutBatch(connPool, batchId)
+	if err != nil {
+		servePayoutBatchError(w, r, err, batch)
+		return
+	}
+	data, err := qservices.RenderPayoutFile(batch)
+	if err != nil {
+		fmt.Println("error rendering payout file", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "the batch doesn't fit the bank's file layout: "+err.Error())
+		return
+	}
+	fileName := qservices.PayoutFileName(batch)
+	contentType := qservices.ContentPlainText
+	if strings.HasSuffix(fileName, ".csv") {
+		contentType = qservices.ContentCsv
+	}
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// Records a draft batch's file as uploaded to the bank
+func postSubmitPayoutBatch(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	batchId, ok := parseBatchId(w, r)
+	if !ok {
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	batch, err := qservices.LockPayoutBatch(tx, batchId)
+	if err == nil {
+		err = qservices.SubmitPayoutBatch(tx, r, &batch)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		servePayoutBatchError(w, r, err, batch)
+		return
+	}
+	err = qservices.ServeJson(w, r, batch)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Reconciles a submitted batch with the bank's response, paying out the succeeded transfers
+and rejecting and refunding the failed ones
+ACCEPTS: multipart form with response, the bank's response csv
+*/
+func postReconcilePayoutBatch(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentMultipartForm) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	batchId, ok := parseBatchId(w, r)
+	if !ok {
+		return
+	}
+	_ = r.ParseMultipartForm(0)
+	file, _, err := r.FormFile("response")
+	if err != nil {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "response", Message: "Missing the bank's response file"}})
+		return
+	}
+	response, err := io.ReadAll(io.LimitReader(file, qservices.MaxPayoutResponseSize+1))
+	if err != nil || len(response) > qservices.MaxPayoutResponseSize {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "response", Message: "must be smaller than 5mb"}})
+		return
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	batch, err := qservices.LockPayoutBatch(tx, batchId)
+	var result qstructs.PayoutReconcileResult
+	if err == nil {
+		result, err = qservices.ReconcilePayoutBatch(tx, r, &batch, response)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		servePayoutBatchError(w, r, err, batch)
+		return
+	}
+	err = qservices.ServeJson(w, r, result)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
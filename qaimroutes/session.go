@@ -0,0 +1,95 @@
+package qaimroutes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Exchanges a refresh token for a new access/refresh token pair
+ACCEPTS: { RefreshToken }
+*/
+func postTokenRefresh(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	var args qstructs.RefreshTokenArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil || args.RefreshToken == "" {
+		qservices.ServeError(w, r, http.StatusBadRequest, "missing refresh token")
+		return
+	}
+	tokens, err := qservices.RefreshSession(connPool, args.RefreshToken)
+	if err != nil {
+		if err == qservices.ErrInvalidRefreshToken || err == qservices.ErrRefreshTokenReused {
+			qservices.ServeErrorCode(w, r, http.StatusUnauthorized, qservices.ErrCodeInvalidRefreshToken, err.Error())
+			return
+		}
+		fmt.Println("error refreshing session", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.ServeJson(w, r, tokens)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Revokes the session of the calling token, along with its refresh token
+*/
+func postLogout(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	payload, err := qservices.GetJwtPayload(r.Header.Get("Token"))
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+	err = qservices.RevokeSessionOfJti(connPool, payload.Jti)
+	if err != nil {
+		fmt.Println("error revoking session", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	qservices.ServeMessage(w, r, "Logged out successfully")
+}
+
+/*
+Logs a user out of every device, e.g. when their credentials are compromised
+ACCEPTS: ?nationalId=
+*/
+func postRevokeUserSessions(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	nationalId := r.URL.Query().Get("nationalId")
+	if !qservices.ValidateNationalId(nationalId) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Invalid national id supplied")
+		return
+	}
+	var userId string
+	err := connPool.QueryRow(context.Background(),
+		"SELECT uuid FROM PUBLIC.user WHERE national_id = $1", nationalId).Scan(&userId)
+	if err != nil {
+		if err.Error() == qservices.StatusEmptyRequest {
+			qservices.ServeError(w, r, http.StatusNotFound, "user not found")
+			return
+		}
+		fmt.Println("error fetching user", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.RevokeSubjectSessions(connPool, userId)
+	if err != nil {
+		fmt.Println("error revoking user sessions", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	err = qservices.Audit(connPool, r, qstructs.AuditEvent{Action: "user.sessions.revoke", TargetType: "user", TargetId: userId})
+	if err != nil {
+		fmt.Println("error auditing session revocation", err)
+	}
+	qservices.ServeMessage(w, r, "User sessions revoked successfully")
+}
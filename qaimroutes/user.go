@@ -8,6 +8,7 @@ import (
 	"os"
 	qservices "qaimbe/qaimservices"
 	qstructs "qaimbe/qaimstructs"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,15 +22,37 @@ func extractUserIdFromToken(w http.ResponseWriter, r *http.Request) (string, err
 	subjId, err := qservices.GetJwtSubject(token)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return "", nil
+		qservices.ServeError(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return "", err
 	}
 	return subjId, nil
 }
 
+// idImageError is the validation message for an id card image NormalizeImage rejected
+func idImageError(err error) string {
+	switch err {
+	case qservices.ErrImageTooLarge, qservices.ErrImageFormat, qservices.ErrImagePixels:
+		return "Invalid id card image: " + err.Error()
+	}
+	return "Invalid id card image, only jpeg and pngs < 2mb allowed"
+}
+
+// storeIdImage encrypts a normalized id card image and stores it, returning the id of the key it was sealed with
+func storeIdImage(key string, data []byte) (string, error) {
+	sealed, keyId, err := qservices.SealKycDocument(key, data)
+	if err != nil {
+		return "", err
+	}
+	contentType := qservices.ContentOctetStream
+	if keyId == "" {
+		contentType = qservices.ContentJpeg
+	}
+	return keyId, qservices.PutObject(key, sealed, contentType)
+}
+
 func postUserSignup(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	if !qservices.ValidateContentType(r, qservices.ContentMultipartForm) {
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
 		return
 	}
 	var u qstructs.User
@@ -47,97 +70,78 @@ func postUserSignup(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Po
 	u.PhoneNum = r.PostFormValue("phoneNum")
 	u.Password = r.PostFormValue("password")
 	u.Iban = r.PostFormValue("iban")
+	u.Otp = strings.TrimSpace(r.PostFormValue("otp"))
 
 	// input validation
+	var fields []qstructs.FieldError
 	if !qservices.ValidateName(u.FirstName) {
-		http.Error(w, "Incorrect first name", http.StatusBadRequest)
-		return
+		fields = append(fields, qstructs.FieldError{Field: "firstName", Message: "Incorrect first name"})
 	}
 	if !qservices.ValidateName(u.LastName) {
-		http.Error(w, "Incorrect last name", http.StatusBadRequest)
-		return
+		fields = append(fields, qstructs.FieldError{Field: "lastName", Message: "Incorrect last name"})
 	}
 	if !qservices.ValidatePhoneNum(u.PhoneNum) {
-		http.Error(w,
-			"Invalid phonenumber",
-			http.StatusBadRequest)
-		return
+		fields = append(fields, qstructs.FieldError{Field: "phoneNum", Message: "Invalid phonenumber"})
 	}
 	if !qservices.ValidateNationalId(u.NationalId) {
-		http.Error(w,
-			"Invalid national id",
-			http.StatusBadRequest)
-		return
+		fields = append(fields, qstructs.FieldError{Field: "nationalId", Message: "Invalid national id"})
 	}
-	if !qservices.ValidatePassword(u.Password) {
-		http.Error(w,
-			`Password needs to be greater than 8 digits,
-			and cannot contain the following characters: .,*,\,\t,\n,\r,',",>,<,`,
-			http.StatusBadRequest)
-		return
+	if err := qservices.CheckPasswordPolicy(u.Password, u.FirstName, u.LastName, u.PhoneNum, u.NationalId); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "password", Message: "Password " + err.Error()})
 	}
 	if !qservices.ValidateIban(u.Iban) {
-		http.Error(w,
-			"Invalid IBAN format",
-			http.StatusBadRequest)
-		return
+		fields = append(fields, qstructs.FieldError{Field: "iban", Message: "Invalid IBAN format"})
+	}
+	if u.Otp == "" {
+		fields = append(fields, qstructs.FieldError{Field: "otp", Message: "the code texted to the phone number is required"})
 	}
+	var frontData, backData []byte
 	imgF, imgFheader, err := r.FormFile("idFront")
 	if err != nil {
-		fmt.Fprintln(w, "Error reading front id card")
-		return
-	}
-	if !qservices.ValidateImage(imgFheader) {
-		http.Error(w,
-			"Invalid front id card image, only jpeg and pngs < 2mb allowed",
-			http.StatusBadRequest)
-		return
+		fields = append(fields, qstructs.FieldError{Field: "idFront", Message: "Missing front id card image"})
+	} else if frontData, err = qservices.NormalizeImage(imgF, imgFheader); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "idFront", Message: idImageError(err)})
 	}
 	imgB, imgBheader, err := r.FormFile("idBack")
 	if err != nil {
-		fmt.Fprintln(w, "Error reading back id card")
-		return
+		fields = append(fields, qstructs.FieldError{Field: "idBack", Message: "Missing back id card image"})
+	} else if backData, err = qservices.NormalizeImage(imgB, imgBheader); err != nil {
+		fields = append(fields, qstructs.FieldError{Field: "idBack", Message: idImageError(err)})
 	}
-	if !qservices.ValidateImage(imgBheader) {
-		http.Error(w,
-			"Invalid back id card image, only jpeg and pngs < 2mb",
-			http.StatusBadRequest)
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
 		return
 	}
-	if imgF == nil || imgB == nil {
-		http.Error(w,
-			"Missing id card image(s)",
-			http.StatusBadRequest)
-		return
-	}
-
-	// TODO: add channels to UploadToS3 function to make uploads concurrent
-	fname := imgFheader.Filename
-	flind := strings.LastIndexAny(fname, ".")
-	fpath := "id_cards/" + u.NationalId + "id_front" + fname[flind:]
-	err = qservices.UploadToS3(imgF, fpath)
+	// the code proves the number belongs to the user, it is used up even if the signup fails below
+	err = qservices.VerifyOtp(connPool, u.PhoneNum, qservices.OtpPurposeSignup, u.Otp)
 	if err != nil {
-		fmt.Fprintln(w, "error uploading file", err)
-		errorStr := fmt.Sprintf("Error occurred for user:\n%s, %s, %s, %s, %s", u.NationalId, u.FirstName, u.LastName, u.PhoneNum, u.Iban)
-		go qservices.EmailErrorLog(qservices.SubjSignupErr, errorStr)
+		serveOtpError(w, r, err, "otp")
 		return
 	}
 
-	bname := imgBheader.Filename
-	blind := strings.LastIndexAny(bname, ".")
-	bpath := "id_cards/" + u.NationalId + "id_back" + bname[blind:]
-	err = qservices.UploadToS3(imgB, bpath)
+	// object keys are generated here, nothing the client sends ends up in them
+	uploadId, err := qservices.NewUuid()
+	fpath := "id_cards/" + uploadId + "/front.jpg"
+	bpath := "id_cards/" + uploadId + "/back.jpg"
+	var keyId string
+	if err == nil {
+		keyId, err = storeIdImage(fpath, frontData)
+	}
+	if err == nil {
+		_, err = storeIdImage(bpath, backData)
+	}
 	if err != nil {
-		fmt.Fprintln(w, "error uploading file", err)
+		fmt.Println("error uploading file", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred during sign up")
 		errorStr := fmt.Sprintf("Error occurred for user:\n%s, %s, %s, %s, %s", u.NationalId, u.FirstName, u.LastName, u.PhoneNum, u.Iban)
 		go qservices.EmailErrorLog(qservices.SubjSignupErr, errorStr)
 		return
 	}
 
-	fmt.Fprintf(w, "signup attempting for user %v\n", u)
 	hashedPass, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
 	if err != nil {
 		fmt.Println("error generating password")
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred during sign up")
 		passwErr := fmt.Sprintf("error generating password hash:\n %s %s %s %s", u.NationalId, u.FirstName, u.LastName, u.PhoneNum)
 		go qservices.EmailErrorLog(qservices.SubjSignupErr, passwErr)
 		return
@@ -145,69 +149,84 @@ func postUserSignup(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Po
 	// QUERY EXECUTION
 	_, err = connPool.Exec(
 		context.Background(),
-		"INSERT INTO public.user (uuid, national_id, first_name, last_name, phone_number, iban, id_front, id_back, password_hash, verified) VALUES ((SELECT gen_random_uuid()), $1, $2, $3, $4, $5, $6, $7, $8, $9)",
-		u.NationalId, u.FirstName, u.LastName, u.PhoneNum, u.Iban, fpath, bpath, hashedPass, false)
+		"INSERT INTO public.user (uuid, national_id, first_name, last_name, phone_number, iban, id_front, id_back, password_hash, verified, id_key_id, phone_verified_at) VALUES ((SELECT gen_random_uuid()), $1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), NOW())",
+		u.NationalId, u.FirstName, u.LastName, u.PhoneNum, u.Iban, fpath, bpath, hashedPass, false, keyId)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Error occurred during sign up", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error occurred during sign up")
 		errorStr := fmt.Sprintf("Error occurred for user:\n%s, %s, %s, %s, %s", u.NationalId, u.FirstName, u.LastName, u.PhoneNum, u.Iban)
 		go qservices.EmailErrorLog(qservices.SubjSignupErr, errorStr)
 		return
 	}
-	fmt.Fprintln(w, "User added successfully")
-	mailingList := *qservices.GlobalState.MailList
-	notifierList := mailingList[qservices.MailUserNotifier]
+	qservices.ServeJsonStatus(w, r, http.StatusCreated, qstructs.MessageResponse{Message: "User added successfully"})
+	notifierList := qservices.MailRecipients(connPool, qservices.MailUserNotifier, "")
 	message := fmt.Sprintf("National Id, First Name, Last Name, Phone Number, Iban\n%s, %s, %s, %s, %s", u.NationalId, u.FirstName, u.LastName, u.PhoneNum, u.Iban)
 	go qservices.SendEmailString(notifierList, qservices.SubjUserSignup, message)
 }
 
 func postUserLogin(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	if !qservices.ValidateContentType(r, qservices.ContentJson) {
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
 		return
 	}
 	var u qstructs.User
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&u)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Invalid request body")
+		return
 	}
 	if !qservices.ValidatePhoneNum(u.PhoneNum) {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		qservices.ServeError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+	account := qservices.LoginAccount("user", u.PhoneNum)
+	if !qservices.AllowLoginAttempt(w, r, connPool, account) {
 		return
 	}
 	if !qservices.ValidatePassword(u.Password) {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		return
 	}
 
 	var auth qstructs.UserAuth
-	var verified bool = true
-	err = connPool.QueryRow(context.Background(), "select uuid, password_hash, national_id, verified from public.user where phone_number=$1", u.PhoneNum).Scan(&auth.Uuid, &auth.PasswordHash, &auth.NationalId, &verified)
+	var kycStatus string
+	var role int
+	err = connPool.QueryRow(context.Background(), "select uuid, password_hash, national_id, kyc_status, role from public.user where phone_number=$1", u.PhoneNum).Scan(&auth.Uuid, &auth.PasswordHash, &auth.NationalId, &kycStatus, &role)
 	if err != nil {
 		if err.Error() != qservices.StatusEmptyRequest {
 			fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
-			// TODO(talha): implement a better way of exiting the program
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 			return
 		}
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	if !verified {
-		fmt.Fprintln(w, "User is not verified, user verification may take upto 1-2 days for verification")
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword(auth.PasswordHash, []byte(u.Password))
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		qservices.RecordLoginFailure(connPool, account)
+		qservices.ServeError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
 		return
 	}
-	token, err := qservices.CreateJwtToken(auth.Uuid, qservices.USER)
+	amr, ok := loginAmr(w, r, connPool, account, auth.Uuid, u.Otp)
+	if !ok {
+		return
+	}
+	qservices.ClearLoginFailures(connPool, account)
+	// until their kyc is approved users can only follow up on their application
+	if kycStatus != qservices.KycApproved {
+		role = int(qservices.USER_APPLICANT)
+	}
+	tokens, err := qservices.CreateSession(connPool, auth.Uuid, qservices.Role(role), amr)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		fmt.Println("error creating session", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
 	}
-	fmt.Fprintf(w, "You are logged in\nuserId: %s\njwtToken: %s", auth.Uuid, token.Token)
+	qservices.ServeJson(w, r, tokens)
 }
 
 func getInterestRate(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
@@ -217,15 +236,15 @@ func getInterestRate(w http.ResponseWriter, r *http.Request, connPool *pgxpool.P
 	if err != nil {
 		if err.Error() != qservices.StatusEmptyRequest {
 			fmt.Fprintf(os.Stderr, "Query failed: %v\n", err)
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		} else {
-			fmt.Fprintln(w, "No interest rate exists")
+			qservices.ServeErrorCode(w, r, http.StatusNotFound, qservices.ErrCodeNoInterestRate, "No interest rate exists")
 		}
 		go qservices.EmailErrorLog(qservices.SubjGetInterestRateErr, err.Error())
 		return
 	}
 	ir.Date = dbDate.UTC().Format(time.RFC3339)
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "date: %s\ninterest rate: %f\n", ir.Date, ir.InterestRate)
+	qservices.ServeJson(w, r, ir)
 }
 
 func postTbillPurchase(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
@@ -238,7 +257,7 @@ func postTbillPurchase(w http.ResponseWriter, r *http.Request, connPool *pgxpool
 		* tenor_days
 	*/
 	if !qservices.ValidateContentType(r, qservices.ContentJson) {
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
 		return
 	}
 	userId, err := extractUserIdFromToken(w, r)
@@ -251,37 +270,45 @@ func postTbillPurchase(w http.ResponseWriter, r *http.Request, connPool *pgxpool
 	err = decoder.Decode(&user)
 	user.UserId = userId
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
-	errMsg := ""
-	invalidData := false
+	var fields []qstructs.FieldError
 	if user.AmountInvested < 1000 || user.AmountInvested > 50000 {
-		errMsg += "invalid investment amount, \namount >= 1000 pkr OR amount <= 10,000 pkr\n"
-		invalidData = true
+		fields = append(fields, qstructs.FieldError{Field: "amountInvested", Message: "invalid investment amount, amount >= 1000 pkr OR amount <= 50,000 pkr"})
 	}
 	if user.AmountInvested%500 != 0 {
-		errMsg += "invalid investment amount, \ncan only invest in multiples of 500 pkr\n"
-		invalidData = true
+		fields = append(fields, qstructs.FieldError{Field: "amountInvested", Message: "invalid investment amount, can only invest in multiples of 500 pkr"})
 	}
 	if user.TenorDays != 90 && user.TenorDays != 180 && user.TenorDays != 270 {
-		errMsg += "incorrect tenor days, \nsupported tenor days are: 90, 180, 270\n"
-		invalidData = true
+		fields = append(fields, qstructs.FieldError{Field: "tenorDays", Message: "incorrect tenor days, supported tenor days are: 90, 180, 270"})
 	}
-	if invalidData {
-		http.Error(w, errMsg, http.StatusBadRequest)
+	if claims, _ := qservices.RequestClaims(r); qservices.IsSandboxRole(claims.Aud) && user.AmountInvested > qservices.SandboxMaxInvestment {
+		fields = append(fields, qstructs.FieldError{Field: "amountInvested",
+			Message: fmt.Sprintf("invalid investment amount, sandbox accounts can invest at most %d pkr", qservices.SandboxMaxInvestment)})
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
 		return
 	}
 	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
 	if err != nil {
 		fmt.Println("error beginning transaction", err)
 		qservices.EmailErrorLog("ResolveMaturedTokens: Error beginning transaction", err.Error())
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		return
 	}
 	defer tx.Rollback(context.TODO())
+	// token id is generated up front so the ledger entry can reference it
+	var tokenId string
+	err = tx.QueryRow(context.TODO(), "SELECT gen_random_uuid()").Scan(&tokenId)
+	if err != nil {
+		fmt.Println("error generating token id", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
 	// ----------------------------------------
-	// $1 = user_id, $2 = tenor_days, $3 = buying_amount
+	// $1 = user_id, $2 = tenor_days, $3 = buying_amount, $4 = token_id
 	cmdTag, err := tx.Exec(context.TODO(), `
 	WITH get_interest_rate AS (
 		SELECT uuid AS ir_id, date as ir_date, interest_rate as ir_ir FROM PUBLIC.tbill_interest_rates
@@ -323,7 +350,7 @@ func postTbillPurchase(w http.ResponseWriter, r *http.Request, connPool *pgxpool
 		)
 	), get_tbill_fracs AS (
 		INSERT INTO public.tbill_tokens(token_id, user_id, amount_invested, maturity_date, tenor_days, interest_id, bond_id, investment_date) 
-			SELECT token_id, $1,
+			SELECT $4::UUID, $1,
 			token_data.amount_used, token_data.token_maturity_date, 
 			$2 AS tenor_days, token_data.ir_id, token_data.bond_id, buying_date
 			FROM (
@@ -333,7 +360,6 @@ func postTbillPurchase(w http.ResponseWriter, r *http.Request, connPool *pgxpool
 					SELECT * FROM get_interest_rate
 				) AS t_ir
 			) AS token_data
-			CROSS JOIN gen_random_uuid() AS token_id
 		RETURNING bond_id, amount_invested
 	), transact_cte AS (
 		UPDATE PUBLIC.tbills
@@ -348,7 +374,7 @@ func postTbillPurchase(w http.ResponseWriter, r *http.Request, connPool *pgxpool
 	FROM transact_cte
 	WHERE u.uuid = $1 AND amount_invested > 0
 	RETURNING *;
-		`, user.UserId, user.TenorDays, user.AmountInvested)
+		`, user.UserId, user.TenorDays, user.AmountInvested, tokenId)
 	if err != nil || cmdTag.RowsAffected() == 0 {
 		var errorStr string
 		if err != nil {
@@ -361,14 +387,32 @@ Possible causes are:
 3. Check bond available amount`
 		}
 		fmt.Fprintln(os.Stderr, errorStr)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if err != nil {
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		} else {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodePurchaseUnavailable,
+				"Purchase could not be completed, check your balance and the available tbills for this tenor")
+		}
 		go qservices.EmailErrorLog(qservices.SubjTbillPurchaseErr, errorStr)
 		return
 	}
-	tx.Commit(context.TODO())
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, http.StatusOK, http.StatusText(http.StatusOK))
+	err = qservices.PostLedgerTransfer(tx, qstructs.LedgerTransfer{
+		UserId: user.UserId, DebitAccount: qservices.LedgerUserWallet, CreditAccount: qservices.LedgerTbillHoldings,
+		Amount: user.AmountInvested, Source: qservices.LedgerSrcPurchase, SourceId: tokenId,
+	})
+	if err != nil {
+		fmt.Println("error recording purchase in ledger", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		go qservices.EmailErrorLog(qservices.SubjTbillPurchaseErr, err.Error())
+		return
+	}
+	err = tx.Commit(context.TODO())
+	if err != nil {
+		fmt.Println("error committing purchase", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	qservices.ServeMessage(w, r, "Tbill purchased successfully")
 }
 
 func getUserInvestments(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
@@ -409,31 +453,31 @@ func getUserInvestments(w http.ResponseWriter, r *http.Request, connPool *pgxpoo
 	) AS inv_info;
 	`, userId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("error fetching investments", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		go qservices.EmailErrorLog(qservices.SubjGetUserInvestErr, err.Error())
 		return
 	}
 	defer rows.Close()
 
-	var tokens []qstructs.TbillToken
+	tokens := []qstructs.TbillToken{}
 	// do something with the res Rows
 	for rows.Next() {
 		var token qstructs.TbillToken
 		err := rows.Scan(&token.TokenId, &token.TenorDays, &token.MaturityDate, &token.AmountInvested,
 			&token.InvestmentDate, &token.InterestRate, &token.CurrentValue)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fmt.Println("error scanning investments", err)
+			qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 			go qservices.EmailErrorLog(qservices.SubjGetUserInvestErr, err.Error())
 			return
 		}
 		tokens = append(tokens, token)
 	}
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(tokens)
+	err = qservices.ServeJson(w, r, tokens)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
 		go qservices.EmailErrorLog(qservices.SubjGetUserInvestErr, err.Error())
-		return
 	}
 }
 
@@ -442,15 +486,16 @@ func getDigitalWallet(w http.ResponseWriter, r *http.Request, connPool *pgxpool.
 	if err != nil {
 		return
 	}
-	var digitalBalance uint64
+	var digitalBalance int64
 	err = connPool.QueryRow(context.Background(),
 		"SELECT balance FROM PUBLIC.user WHERE uuid = $1", userId).Scan(&digitalBalance)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println("error fetching wallet balance", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		go qservices.EmailErrorLog(qservices.SubjGetWalletErr, err.Error())
 		return
 	}
-	fmt.Fprintf(w, `{"Balance": %d}`, digitalBalance)
+	qservices.ServeJson(w, r, qstructs.BalanceResponse{Balance: digitalBalance})
 }
 
 func postTbillSell(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
@@ -458,16 +503,18 @@ func postTbillSell(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Poo
 	if err != nil {
 		return
 	}
-	tokenId := r.URL.Query().Get("tokenId")
+	tokenId := qservices.PathParam(r, "tokenId")
 	if !qservices.ValidateUuid(tokenId) {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
 		return
 	}
 	var wdrawn_amount int64
 	tx, err := connPool.BeginTx(context.TODO(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
 	if err != nil {
 		fmt.Println("Error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		go qservices.EmailErrorLog(qservices.SubjTbillSellErr, err.Error())
+		return
 	}
 	defer tx.Rollback(context.TODO())
 	_, err = tx.Exec(context.TODO(), `
@@ -486,6 +533,7 @@ func postTbillSell(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Poo
 	`, tokenId, userId)
 	if err != nil {
 		fmt.Println("error replenishing bonds", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		go qservices.EmailErrorLog(qservices.SubjTbillSellErr, err.Error())
 		return
 	}
@@ -530,18 +578,36 @@ func postTbillSell(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Poo
 	`, tokenId, userId).Scan(&wdrawn_amount)
 	if err != nil {
 		fmt.Println("error updating token and user balance", err)
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "No active investment found for this token")
+			return
+		}
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		go qservices.EmailErrorLog(qservices.SubjTbillSellErr, err.Error())
 		return
 	}
-	tx.Commit(context.TODO())
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, http.StatusOK, http.StatusText(http.StatusOK))
+	err = qservices.PostLedgerTransfer(tx, qstructs.LedgerTransfer{
+		UserId: userId, DebitAccount: qservices.LedgerTbillHoldings, CreditAccount: qservices.LedgerUserWallet,
+		Amount: wdrawn_amount, Source: qservices.LedgerSrcSale, SourceId: tokenId,
+	})
+	if err != nil {
+		fmt.Println("error recording sale in ledger", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		go qservices.EmailErrorLog(qservices.SubjTbillSellErr, err.Error())
+		return
+	}
+	err = tx.Commit(context.TODO())
+	if err != nil {
+		fmt.Println("error committing sale", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	qservices.ServeMessage(w, r, "Tbill sold successfully")
 }
 
 func postBalanceWithdraw(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
 	if !qservices.ValidateContentType(r, qservices.ContentJson) {
-		http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
 		return
 	}
 	userId, err := extractUserIdFromToken(w, r)
@@ -552,13 +618,31 @@ func postBalanceWithdraw(w http.ResponseWriter, r *http.Request, connPool *pgxpo
 	err = qservices.DecodeJson(r, &req)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
 		return
 	}
 	req.UserId = userId
+	if req.Amount <= 0 {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid withdrawal amount")
+		return
+	}
+	if claims, _ := qservices.RequestClaims(r); qservices.IsSandboxRole(claims.Aud) && req.Amount > qservices.SandboxMaxWithdrawal {
+		qservices.ServeError(w, r, http.StatusBadRequest, fmt.Sprintf("sandbox accounts can withdraw at most %d pkr", qservices.SandboxMaxWithdrawal))
+		return
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error creating fund withdrawal request")
+		go qservices.EmailErrorLog(qservices.SubjBalanceWithdrawErr, err.Error())
+		return
+	}
+	defer tx.Rollback(context.TODO())
 
 	var balance int64
-	err = connPool.QueryRow(context.Background(), `
+	var requestId string
+	err = tx.QueryRow(context.TODO(), `
 		with subtract_user_balance AS (
 			SELECT uuid AS user_id, $1::BIGINT AS amount FROM
 			PUBLIC.user
@@ -573,23 +657,36 @@ func postBalanceWithdraw(w http.ResponseWriter, r *http.Request, connPool *pgxpo
 		SET withdraw_request_id = wdraw.request_id, balance = balance - $1
 		FROM create_wdraw_req AS wdraw
 		WHERE uuid = $2
-		RETURNING balance;
-	`, req.Amount, req.UserId).Scan(&balance)
+		RETURNING balance, wdraw.request_id;
+	`, req.Amount, req.UserId).Scan(&balance, &requestId)
 	if err != nil {
 		if err.Error() == qservices.StatusEmptyRequest {
 			fmt.Println(err)
-			http.Error(w, "user has a pending withdrawal request", http.StatusConflict)
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodePendingWithdrawal,
+				"user has a pending withdrawal request or insufficient balance")
 			return
 		}
 		fmt.Println("user wdraw req err", err)
-		http.Error(w, "Error creating fund withdrawal request", http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error creating fund withdrawal request")
 		go qservices.EmailErrorLog(qservices.SubjBalanceWithdrawErr, err.Error())
 		return
 	}
-	err = qservices.ServeJson(w, r, balance)
+	err = qservices.PostLedgerTransfer(tx, qstructs.LedgerTransfer{
+		UserId: req.UserId, DebitAccount: qservices.LedgerUserWallet, CreditAccount: qservices.LedgerWithdrawalsPayable,
+		Amount: req.Amount, Source: qservices.LedgerSrcWithdrawal, SourceId: requestId,
+	})
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		fmt.Println("error recording withdrawal in ledger", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error creating fund withdrawal request")
+		go qservices.EmailErrorLog(qservices.SubjBalanceWithdrawErr, err.Error())
+		return
+	}
+	err = qservices.ServeJson(w, r, qstructs.BalanceResponse{Balance: balance})
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "error parsing results", http.StatusInternalServerError)
 	}
 }
 
@@ -600,56 +697,141 @@ func getWdrawRequest(w http.ResponseWriter, r *http.Request, connPool *pgxpool.P
 	}
 	var wdrawRequest qstructs.UserBalanceWdrawRequest
 	err = connPool.QueryRow(context.Background(), `
-		SELECT u.withdraw_Request_id, wdraw.amount, wdraw.request_date
+		SELECT u.withdraw_Request_id, wdraw.amount, wdraw.request_date, wdraw.status
 		FROM PUBLIC.user AS u
 		LEFT JOIN PUBLIC.user_withdraw_requests AS wdraw
 		ON u.withdraw_Request_id = wdraw.request_id
-		WHERE u.uuid = $1 AND wdraw.valid = TRUE;
-	`, userId).Scan(&wdrawRequest.RequestId, &wdrawRequest.Amount, &wdrawRequest.RequestDate)
+		WHERE u.uuid = $1 AND wdraw.status = ANY($2);
+	`, userId, qservices.WithdrawOpenStatuses).Scan(&wdrawRequest.RequestId, &wdrawRequest.Amount, &wdrawRequest.RequestDate, &wdrawRequest.Status)
 	if err != nil {
 		if err.Error() == qservices.StatusEmptyRequest {
 			w.WriteHeader(http.StatusAccepted)
 			return
 		}
 		fmt.Println(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 		go qservices.EmailErrorLog(qservices.SubjGetWithdrawReqErr, err.Error())
 		return
 	}
 	err = qservices.ServeJson(w, r, wdrawRequest)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+/*
+Lists the user's wallet ledger entries, newest first
+ACCEPTS: ?limit=<page size>&before=<NextBefore from the previous page>
+*/
+func getWalletTransactions(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId, err := extractUserIdFromToken(w, r)
+	if err != nil {
+		return
+	}
+	query := r.URL.Query()
+	var before int64
+	if query.Get("before") != "" {
+		before, err = strconv.ParseInt(query.Get("before"), 10, 64)
+		if err != nil || before < 0 {
+			qservices.ServeError(w, r, http.StatusBadRequest, "invalid before cursor")
+			return
+		}
+	}
+	limit := 0
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			qservices.ServeError(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	page, err := qservices.GetWalletEntries(connPool, userId, before, limit)
+	if err != nil {
+		fmt.Println("error fetching wallet transactions", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		go qservices.EmailErrorLog(qservices.SubjGetWalletErr, err.Error())
+		return
+	}
+	err = qservices.ServeJson(w, r, page)
+	if err != nil {
+		fmt.Println(err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
 	}
 }
 
-func UserHandler(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
-	const prefix = "/user/"
-	const prefixLen = len(prefix)
-	switch path := r.URL.Path[prefixLen:]; path {
-	case "login":
-		qservices.MethodGuard(postUserLogin, w, r, connPool, "POST", qservices.NONE)
-	case "signup":
-		qservices.MethodGuard(postUserSignup, w, r, connPool, "POST", qservices.NONE)
-	case "home/investments":
-		qservices.MethodGuard(getUserInvestments, w, r, connPool, "GET", qservices.USER)
-	case "home/wallet":
-		qservices.MethodGuard(getDigitalWallet, w, r, connPool, "GET", qservices.USER)
-	case "home/wallet/withdraw":
-		qservices.MethodGuard(postBalanceWithdraw, w, r, connPool, "POST", qservices.USER)
-	case "home/wallet/withdraw/all":
-		qservices.MethodGuard(getWdrawRequest, w, r, connPool, "GET", qservices.USER)
-	case "tbill/interest-rate":
-		// TODO: add functionality to allow multiple user roles
-		// like: qservices.USER | qservices.ADMIN
-		qservices.MethodGuard(getInterestRate, w, r, connPool, "GET", qservices.USER)
-	case "tbill/purchase":
-		// TODO: add functionality to allow multiple user roles
-		// like: qservices.USER | qservices.ADMIN
-		qservices.MethodGuard(postTbillPurchase, w, r, connPool, "POST", qservices.USER)
-	case "tbill/sell":
-		qservices.MethodGuard(postTbillSell, w, r, connPool, "POST", qservices.USER)
-	default:
-		fmt.Fprintln(w, "404 page not found")
+// The user's latest in app notifications, newest first
+func getUserNotifications(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId, err := extractUserIdFromToken(w, r)
+	if err != nil {
+		return
+	}
+	notifications, err := qservices.GetUserNotifications(connPool, userId)
+	if err != nil {
+		fmt.Println("error fetching user notifications", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
 	}
+	err = qservices.ServeJson(w, r, notifications)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+/*
+Marks notifications as read
+ACCEPTS: ?upTo=<id of the newest notification seen>
+*/
+func postUserNotificationsRead(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId, err := extractUserIdFromToken(w, r)
+	if err != nil {
+		return
+	}
+	upTo, err := strconv.ParseInt(r.URL.Query().Get("upTo"), 10, 64)
+	if err != nil || upTo <= 0 {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "upTo", Message: "must be a notification id"}})
+		return
+	}
+	err = qservices.MarkUserNotificationsRead(connPool, userId, upTo)
+	if err != nil {
+		fmt.Println("error marking user notifications read", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	qservices.ServeMessage(w, r, "notifications marked as read")
+}
+
+// NewUserRouter declares the routes served under /user/
+func NewUserRouter(connPool *pgxpool.Pool) *qservices.Router {
+	router := qservices.NewRouter("/user/", connPool)
+	router.Use(qservices.RecoverPanics, qservices.LogRequests, qservices.LimitRequestsByIp)
+	router.UseAuthorized(qservices.LimitRequestsBySubject, qservices.IdempotentRequests)
+
+	router.Handle(http.MethodPost, "login", postUserLogin, qservices.NONE).Use(qservices.LimitLoginsByIp)
+	router.Handle(http.MethodPost, "signup", postUserSignup, qservices.NONE)
+	router.Handle(http.MethodPost, "signup/otp", postSignupOtp, qservices.NONE).Use(qservices.LimitOtpsByIp)
+	router.Handle(http.MethodPost, "password/forgot", postPasswordForgot, qservices.NONE).Use(qservices.LimitOtpsByIp)
+	router.Handle(http.MethodPost, "password/reset", postPasswordReset, qservices.NONE).Use(qservices.LimitLoginsByIp)
+	router.Handle(http.MethodPost, "password/change", postUserPasswordChange, qservices.USER, qservices.USER_APPLICANT).NotIdempotent()
+	router.Handle(http.MethodPost, "token/refresh", postTokenRefresh, qservices.NONE)
+	router.Handle(http.MethodPost, "logout", postLogout, qservices.USER, qservices.USER_APPLICANT)
+	router.Handle(http.MethodPost, "mfa/totp/enrol", postTotpEnrol, qservices.USER, qservices.USER_APPLICANT).NotIdempotent()
+	router.Handle(http.MethodPost, "mfa/totp/confirm", postTotpConfirm, qservices.USER, qservices.USER_APPLICANT).NotIdempotent()
+	router.Handle(http.MethodDelete, "mfa/totp", deleteUserTotp, qservices.USER, qservices.USER_APPLICANT)
+	router.Handle(http.MethodPost, "mfa/recovery-codes", postRecoveryCodes, qservices.USER, qservices.USER_APPLICANT).NotIdempotent()
+	router.Handle(http.MethodGet, "kyc", getKycApplication, qservices.USER, qservices.USER_APPLICANT)
+	router.Handle(http.MethodPost, "kyc/documents", postKycDocuments, qservices.USER_APPLICANT)
+	router.Handle(http.MethodGet, "notifications", getUserNotifications, qservices.USER, qservices.USER_APPLICANT)
+	router.Handle(http.MethodPost, "notifications/read", postUserNotificationsRead, qservices.USER, qservices.USER_APPLICANT)
+	router.Handle(http.MethodGet, "home/investments", getUserInvestments, qservices.USER)
+	router.Handle(http.MethodGet, "home/wallet", getDigitalWallet, qservices.USER)
+	router.Handle(http.MethodGet, "home/wallet/transactions", getWalletTransactions, qservices.USER)
+	router.Handle(http.MethodPost, "home/wallet/withdraw", postBalanceWithdraw, qservices.USER)
+	router.Handle(http.MethodGet, "home/wallet/withdraw/all", getWdrawRequest, qservices.USER)
+	router.Handle(http.MethodPost, "home/wallet/withdraw/{requestId}/cancel", postCancelWdrawRequest, qservices.USER)
+	router.Handle(http.MethodGet, "tbill/interest-rate", getInterestRate, qservices.USER, qservices.ADMIN)
+	// purchases are made from the caller's own wallet, so only user roles apply
+	router.Handle(http.MethodPost, "tbill/purchase", postTbillPurchase, qservices.USER)
+	router.Handle(http.MethodPost, "tbill/{tokenId}/sell", postTbillSell, qservices.USER)
+	return router
 }
@@ -0,0 +1,22 @@
+package qaimroutes
+
+import (
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+)
+
+/*
+JwksHandler publishes the public jwt signing keys, so other services can verify qaim tokens
+*/
+func JwksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		qservices.ServeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	err := qservices.ServeJson(w, r, qservices.JwksDocument())
+	if err != nil {
+		fmt.Println("error serving jwks", err)
+	}
+}
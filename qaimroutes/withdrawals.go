@@ -0,0 +1,177 @@
+package qaimroutes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	qservices "qaimbe/qaimservices"
+	qstructs "qaimbe/qaimstructs"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Reviews a withdraw request. Approving requests of at least the withdraw.approve approval threshold
+waits for another admin, answering 202 with the pending operation
+ACCEPTS: { Status: approved | paid | rejected, BankReference: required when paid, Reason: required when rejected }
+*/
+func patchUserWdrawRequest(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	if !qservices.ValidateContentType(r, qservices.ContentJson) {
+		qservices.ServeError(w, r, http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType))
+		return
+	}
+	requestId := qservices.PathParam(r, "requestId")
+	if len(requestId) == 0 || !qservices.ValidateUuid(requestId) {
+		qservices.ServeValidationErrors(w, r, []qstructs.FieldError{{Field: "requestId", Message: "missing or invalid request id"}})
+		return
+	}
+	var args qstructs.WithdrawReviewArgs
+	err := qservices.DecodeJson(r, &args)
+	if err != nil {
+		qservices.ServeError(w, r, http.StatusBadRequest, "Error parsing request body")
+		return
+	}
+	args.BankReference = strings.TrimSpace(args.BankReference)
+	args.Reason = strings.TrimSpace(args.Reason)
+	var fields []qstructs.FieldError
+	switch args.Status {
+	case qservices.WithdrawApproved:
+	case qservices.WithdrawPaid:
+		if args.BankReference == "" || len(args.BankReference) > 100 {
+			fields = append(fields, qstructs.FieldError{Field: "BankReference", Message: "the bank transfer's reference is required, at most 100 characters"})
+		}
+	case qservices.WithdrawRejected:
+		if args.Reason == "" {
+			fields = append(fields, qstructs.FieldError{Field: "Reason", Message: "a reason is required to reject a withdrawal"})
+		}
+	default:
+		// cancelling is left to the user
+		fields = append(fields, qstructs.FieldError{Field: "Status", Message: "must be one of approved, paid, rejected"})
+	}
+	if len(args.Reason) > 500 {
+		fields = append(fields, qstructs.FieldError{Field: "Reason", Message: "must be at most 500 characters"})
+	}
+	if len(fields) > 0 {
+		qservices.ServeValidationErrors(w, r, fields)
+		return
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error reviewing withdraw request")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	req, err := qservices.LockWithdrawRequest(tx, requestId)
+	var batchId int64
+	if err == nil {
+		batchId, err = qservices.PendingPayoutBatch(tx, requestId)
+	}
+	if err == nil && batchId != 0 {
+		qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodePayoutBatched,
+			fmt.Sprintf("withdraw request is part of payout batch %d, it is settled by reconciling the batch", batchId))
+		return
+	}
+	var needsApproval bool
+	if err == nil && args.Status == qservices.WithdrawApproved {
+		if !qservices.WithdrawTransitionAllowed(req.Status, args.Status) {
+			err = qservices.ErrWithdrawTransition
+		} else {
+			needsApproval, err = qservices.RequiresApproval(tx, qservices.OpWithdrawApprove, req.Amount)
+		}
+	}
+	var op qstructs.PendingOperation
+	if err == nil && needsApproval {
+		op, err = qservices.CreatePendingOperation(tx, r, qservices.OpWithdrawApprove, requestId, req.Amount,
+			map[string]any{"UserId": req.UserId, "Iban": req.Iban})
+	} else if err == nil {
+		err = qservices.ReviewWithdrawal(tx, r, &req, args.Status, args.BankReference, args.Reason, nil)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "withdraw request not found")
+			return
+		}
+		if err == qservices.ErrWithdrawTransition {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeWithdrawTransition,
+				fmt.Sprintf("a %s withdraw request can't be moved to %s", req.Status, args.Status))
+			return
+		}
+		if isUniqueViolation(err) {
+			if args.Status == qservices.WithdrawPaid {
+				qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeConflict,
+					"this bank reference already paid out another withdraw request")
+				return
+			}
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeApprovalPending,
+				"an approval of this withdraw request is already waiting")
+			return
+		}
+		fmt.Println("error reviewing withdraw request", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error reviewing withdraw request")
+		return
+	}
+	if needsApproval {
+		servePendingOperation(w, r, op)
+		return
+	}
+	err = qservices.ServeJson(w, r, req)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// The user cancels their withdraw request before it was approved, the amount is refunded to their wallet
+func postCancelWdrawRequest(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+	userId, err := extractUserIdFromToken(w, r)
+	if err != nil {
+		return
+	}
+	requestId := qservices.PathParam(r, "requestId")
+	if !qservices.ValidateUuid(requestId) {
+		qservices.ServeError(w, r, http.StatusBadRequest, "invalid request id")
+		return
+	}
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		fmt.Println("error beginning transaction", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error cancelling withdraw request")
+		return
+	}
+	defer tx.Rollback(context.TODO())
+	req, err := qservices.LockWithdrawRequest(tx, requestId)
+	if err == nil && req.UserId != userId {
+		// other users' requests are indistinguishable from missing ones
+		err = pgx.ErrNoRows
+	}
+	if err == nil {
+		err = qservices.ReviewWithdrawal(tx, r, &req, qservices.WithdrawCancelled, "", "", nil)
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			qservices.ServeError(w, r, http.StatusNotFound, "withdraw request not found")
+			return
+		}
+		if err == qservices.ErrWithdrawTransition {
+			qservices.ServeErrorCode(w, r, http.StatusConflict, qservices.ErrCodeWithdrawTransition,
+				fmt.Sprintf("a %s withdraw request can no longer be cancelled", req.Status))
+			return
+		}
+		fmt.Println("error cancelling withdraw request", err)
+		qservices.ServeError(w, r, http.StatusInternalServerError, "Error cancelling withdraw request")
+		return
+	}
+	err = qservices.ServeJson(w, r, req)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,209 @@
+package qaimservices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	qs "qaimbe/qaimstructs"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Maker-Checker Approvals
+Balance credits and withdraw approvals of at least their kind's threshold are not applied
+by the admin asking for them (the maker), they are stored as a pending operation that a
+different admin (the checker) approves, applying it, or rejects.
+Thresholds live in approval_thresholds and are changed by the superuser only, a threshold
+of 0 sends every operation of its kind for approval
+*/
+
+const (
+	OpWalletCredit    = "wallet.credit"
+	OpWithdrawApprove = "withdraw.approve"
+
+	OpStatusPending  = "pending"
+	OpStatusApproved = "approved"
+	OpStatusRejected = "rejected"
+
+	PendingOperationsPageLen = 200
+)
+
+var (
+	ErrOperationDecided = errors.New("operation was already decided")
+	ErrSameApprover     = errors.New("an operation can't be approved by the admin who requested it")
+)
+
+func ValidateOperationKind(kind string) bool {
+	return kind == OpWalletCredit || kind == OpWithdrawApprove
+}
+
+func ValidateOperationStatus(status string) bool {
+	return status == OpStatusPending || status == OpStatusApproved || status == OpStatusRejected
+}
+
+// RequiresApproval reports whether an operation of kind moving amount must wait for a checker
+func RequiresApproval(tx pgx.Tx, kind string, amount int64) (bool, error) {
+	var minAmount int64
+	err := tx.QueryRow(context.TODO(),
+		"SELECT min_amount FROM PUBLIC.approval_thresholds WHERE kind = $1", kind).Scan(&minAmount)
+	if err == pgx.ErrNoRows {
+		// a kind without a threshold always needs approval
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	return amount >= minAmount, nil
+}
+
+const pendingOperationColumns = `
+	id, kind, target_id, amount, payload, status, maker_id, COALESCE(checker_id, ''), reason, created_at, decided_at
+`
+
+func scanPendingOperation(row pgx.Row) (qs.PendingOperation, error) {
+	var op qs.PendingOperation
+	err := row.Scan(&op.Id, &op.Kind, &op.TargetId, &op.Amount, &op.Payload, &op.Status,
+		&op.MakerId, &op.CheckerId, &op.Reason, &op.CreatedAt, &op.DecidedAt)
+	return op, err
+}
+
+/*
+CreatePendingOperation stores an operation requested by the request's admin inside tx
+@param payload details the checker needs to review the operation, stored as json
+*/
+func CreatePendingOperation(tx pgx.Tx, r *http.Request, kind string, targetId string, amount int64, payload any) (qs.PendingOperation, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return qs.PendingOperation{}, err
+	}
+	op, err := scanPendingOperation(tx.QueryRow(context.TODO(), `
+		INSERT INTO PUBLIC.pending_operations (kind, target_id, amount, payload, maker_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+pendingOperationColumns,
+		kind, targetId, amount, data, RequestActor(r)))
+	if err != nil {
+		return op, err
+	}
+	err = AuditTx(tx, r, qs.AuditEvent{
+		Action: "approval.request", TargetType: "pending_operation", TargetId: strconv.FormatInt(op.Id, 10),
+		After: op,
+	})
+	return op, err
+}
+
+// LockPendingOperation fetches a pending operation for update, ErrOperationDecided if it was already decided
+func LockPendingOperation(tx pgx.Tx, id int64) (qs.PendingOperation, error) {
+	op, err := scanPendingOperation(tx.QueryRow(context.TODO(),
+		"SELECT "+pendingOperationColumns+" FROM PUBLIC.pending_operations WHERE id = $1 FOR UPDATE", id))
+	if err != nil {
+		return op, err
+	}
+	if op.Status != OpStatusPending {
+		return op, ErrOperationDecided
+	}
+	return op, nil
+}
+
+/*
+DecidePendingOperation records the request's admin approving or rejecting a locked operation.
+Only the maker may not approve, the maker rejecting withdraws the request.
+Approving doesn't apply the operation, the caller does that in the same tx
+*/
+func DecidePendingOperation(tx pgx.Tx, r *http.Request, op *qs.PendingOperation, status string, reason string) error {
+	checkerId := RequestActor(r)
+	if status == OpStatusApproved && checkerId == op.MakerId {
+		return ErrSameApprover
+	}
+	before := *op
+	err := tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.pending_operations
+		SET status = $2, checker_id = $3, reason = $4, decided_at = NOW()
+		WHERE id = $1
+		RETURNING decided_at
+	`, op.Id, status, checkerId, reason).Scan(&op.DecidedAt)
+	if err != nil {
+		return err
+	}
+	op.Status, op.CheckerId, op.Reason = status, checkerId, reason
+	action := "approval.approve"
+	if status == OpStatusRejected {
+		action = "approval.reject"
+	}
+	return AuditTx(tx, r, qs.AuditEvent{
+		Action: action, TargetType: "pending_operation", TargetId: strconv.FormatInt(op.Id, 10),
+		Before: before, After: *op,
+	})
+}
+
+// ListPendingOperations returns the latest operations with status, every status when empty
+func ListPendingOperations(connPool *pgxpool.Pool, status string) ([]qs.PendingOperation, error) {
+	ops := []qs.PendingOperation{}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT `+pendingOperationColumns+`
+		FROM PUBLIC.pending_operations
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, status, PendingOperationsPageLen)
+	if err != nil {
+		return ops, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		op, err := scanPendingOperation(rows)
+		if err != nil {
+			return ops, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, rows.Err()
+}
+
+func GetApprovalThresholds(connPool *pgxpool.Pool) ([]qs.ApprovalThreshold, error) {
+	thresholds := []qs.ApprovalThreshold{}
+	rows, err := connPool.Query(context.Background(),
+		"SELECT kind, min_amount, updated_at, updated_by FROM PUBLIC.approval_thresholds ORDER BY kind")
+	if err != nil {
+		return thresholds, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t qs.ApprovalThreshold
+		err = rows.Scan(&t.Kind, &t.MinAmount, &t.UpdatedAt, &t.UpdatedBy)
+		if err != nil {
+			return thresholds, err
+		}
+		thresholds = append(thresholds, t)
+	}
+	return thresholds, rows.Err()
+}
+
+// SetApprovalThreshold changes the amount from which operations of kind need approval, audited inside tx
+func SetApprovalThreshold(tx pgx.Tx, r *http.Request, kind string, minAmount int64) (qs.ApprovalThreshold, error) {
+	var previous int64
+	err := tx.QueryRow(context.TODO(),
+		"SELECT min_amount FROM PUBLIC.approval_thresholds WHERE kind = $1 FOR UPDATE", kind).Scan(&previous)
+	if err != nil && err != pgx.ErrNoRows {
+		return qs.ApprovalThreshold{}, err
+	}
+	t := qs.ApprovalThreshold{Kind: kind, MinAmount: minAmount, UpdatedBy: RequestActor(r)}
+	err = tx.QueryRow(context.TODO(), `
+		INSERT INTO PUBLIC.approval_thresholds (kind, min_amount, updated_by)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (kind) DO UPDATE SET min_amount = $2, updated_by = $3, updated_at = NOW()
+		RETURNING updated_at
+	`, kind, minAmount, t.UpdatedBy).Scan(&t.UpdatedAt)
+	if err != nil {
+		return t, err
+	}
+	err = AuditTx(tx, r, qs.AuditEvent{
+		Action: "approval.threshold", TargetType: "approval_threshold", TargetId: kind,
+		Before: map[string]any{"MinAmount": previous},
+		After:  map[string]any{"MinAmount": minAmount},
+	})
+	return t, err
+}
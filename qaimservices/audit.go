@@ -0,0 +1,369 @@
+package qaimservices
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	qs "qaimbe/qaimstructs"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Audit Log
+Every admin mutation is recorded in public.audit_log with the actor, their role, the action,
+its target, the before and after values, the caller's address and the request id.
+
+Handlers record what they changed with AuditTx, inside the transaction making the change.
+The AuditMutations middleware records a generic "<METHOD> <pattern>" entry for successful
+mutations whose handler didn't record one, so nothing goes unaudited.
+
+The table is append only (enforced by triggers) and hash chained: each row's hash covers
+its fields and the previous row's hash, VerifyAuditChain walks the chain to detect tampering
+*/
+
+const (
+	AuditDefaultPageLen = 50
+	AuditMaxPageSize    = 200
+
+	SubjAuditChainBroken = "Error: Audit Log Hash Chain Broken"
+	SubjAuditWriteErr    = "Error: Audit Log Write Failed"
+)
+
+// auditLockKey serializes appends, every entry must see the hash of the one before it
+const auditLockKey int64 = 0x617564_6974
+
+const auditVerifyBatch = 1000
+
+type auditCtxKey struct{}
+
+// auditState tells AuditMutations whether the handler recorded its own entry
+type auditState struct {
+	recorded bool
+}
+
+// RequestActor identifies the caller of an authorized request in audit records
+func RequestActor(r *http.Request) string {
+	claims, ok := RequestClaims(r)
+	if !ok {
+		return "anonymous"
+	}
+	if claims.Sub == "" {
+		// the superuser api key carries no subject
+		return "api-key"
+	}
+	return claims.Sub
+}
+
+/*
+canonicalJson re-encodes a json document so it hashes the same before it is stored
+and after it is read back from a jsonb column, nil for no document
+*/
+func canonicalJson(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// keeps numbers as written, int64 amounts would lose precision as float64
+	decoder.UseNumber()
+	var v any
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func auditValueJson(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return canonicalJson(raw)
+}
+
+// auditHash is the sha256 of the previous hash and the entry's length prefixed fields
+func auditHash(prevHash []byte, entry qs.AuditEntry) []byte {
+	h := sha256.New()
+	h.Write(prevHash)
+	for _, field := range []string{
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+		entry.Actor,
+		strconv.Itoa(entry.ActorRole),
+		entry.Action,
+		entry.TargetType,
+		entry.TargetId,
+		string(entry.Before),
+		string(entry.After),
+		entry.RemoteAddr,
+		entry.RequestId,
+	} {
+		binary.Write(h, binary.BigEndian, uint32(len(field)))
+		h.Write([]byte(field))
+	}
+	return h.Sum(nil)
+}
+
+func nullableJson(data []byte) any {
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+// AuditTx appends an entry for the request's actor inside tx, so it is only kept if the change commits
+func AuditTx(tx pgx.Tx, r *http.Request, event qs.AuditEvent) error {
+	before, err := auditValueJson(event.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditValueJson(event.After)
+	if err != nil {
+		return err
+	}
+	claims, _ := RequestClaims(r)
+	entry := qs.AuditEntry{
+		// stored with microsecond precision, the hash must cover what is read back
+		CreatedAt:  time.Now().UTC().Truncate(time.Microsecond),
+		Actor:      RequestActor(r),
+		ActorRole:  int(claims.Aud),
+		Action:     event.Action,
+		TargetType: event.TargetType,
+		TargetId:   event.TargetId,
+		Before:     before,
+		After:      after,
+		RemoteAddr: r.RemoteAddr,
+		RequestId:  RequestId(r),
+	}
+
+	_, err = tx.Exec(context.TODO(), "SELECT pg_advisory_xact_lock($1)", auditLockKey)
+	if err != nil {
+		return err
+	}
+	var prevHash []byte
+	err = tx.QueryRow(context.TODO(),
+		"SELECT hash FROM PUBLIC.audit_log ORDER BY id DESC LIMIT 1").Scan(&prevHash)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	hash := auditHash(prevHash, entry)
+	_, err = tx.Exec(context.TODO(), `
+		INSERT INTO PUBLIC.audit_log (created_at, actor, actor_role, action, target_type, target_id,
+			before, after, remote_addr, request_id, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::JSONB, $8::JSONB, $9, $10, $11, $12)
+	`, entry.CreatedAt, entry.Actor, entry.ActorRole, entry.Action, entry.TargetType, entry.TargetId,
+		nullableJson(before), nullableJson(after), entry.RemoteAddr, entry.RequestId, prevHash, hash)
+	if err != nil {
+		return err
+	}
+	if state, ok := r.Context().Value(auditCtxKey{}).(*auditState); ok {
+		state.recorded = true
+	}
+	return nil
+}
+
+// Audit appends an entry in its own transaction, for changes that aren't made in one
+func Audit(connPool *pgxpool.Pool, r *http.Request, event qs.AuditEvent) error {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
+	err = AuditTx(tx, r, event)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.TODO())
+}
+
+// AuditMutations records successful mutations whose handler didn't audit them itself
+func AuditMutations(next RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		// reads, and public endpoints like login, aren't admin mutations
+		_, authorized := RequestClaims(r)
+		if !authorized || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next(w, r, connPool)
+			return
+		}
+		state := &auditState{}
+		r = r.WithContext(context.WithValue(r.Context(), auditCtxKey{}, state))
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r, connPool)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if state.recorded || rec.status >= http.StatusBadRequest {
+			return
+		}
+		err := Audit(connPool, r, qs.AuditEvent{
+			Action: r.Method + " " + RoutePattern(r),
+			After:  map[string]any{"Status": rec.status, "Query": r.URL.RawQuery},
+		})
+		if err != nil {
+			fmt.Println("error writing audit entry", err)
+			go EmailErrorLog(SubjAuditWriteErr, fmt.Sprintf("%s %s %s by %s: %v", RequestId(r), r.Method, r.URL.Path, RequestActor(r), err))
+		}
+	}
+}
+
+func scanAuditEntry(row pgx.Row) (qs.AuditEntry, []byte, []byte, error) {
+	var entry qs.AuditEntry
+	var before, after *string
+	var prevHash, hash []byte
+	err := row.Scan(&entry.Id, &entry.CreatedAt, &entry.Actor, &entry.ActorRole, &entry.Action, &entry.TargetType,
+		&entry.TargetId, &before, &after, &entry.RemoteAddr, &entry.RequestId, &prevHash, &hash)
+	if err != nil {
+		return entry, nil, nil, err
+	}
+	if before != nil {
+		entry.Before = json.RawMessage(*before)
+	}
+	if after != nil {
+		entry.After = json.RawMessage(*after)
+	}
+	entry.PrevHash = hex.EncodeToString(prevHash)
+	entry.Hash = hex.EncodeToString(hash)
+	return entry, prevHash, hash, nil
+}
+
+const auditColumns = `id, created_at, actor, actor_role, action, target_type, target_id,
+	before::TEXT, after::TEXT, remote_addr, request_id, prev_hash, hash`
+
+// ListAuditLog returns a page of audit entries matching filter, newest first
+func ListAuditLog(connPool *pgxpool.Pool, filter qs.AuditLogFilter) (qs.AuditLogPage, error) {
+	var page qs.AuditLogPage
+	if filter.Limit <= 0 || filter.Limit > AuditMaxPageSize {
+		filter.Limit = AuditDefaultPageLen
+	}
+	var conds []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if filter.Actor != "" {
+		conds = append(conds, "actor = "+arg(filter.Actor))
+	}
+	if filter.Action != "" {
+		conds = append(conds, "action = "+arg(filter.Action))
+	}
+	if filter.TargetType != "" {
+		conds = append(conds, "target_type = "+arg(filter.TargetType))
+	}
+	if filter.TargetId != "" {
+		conds = append(conds, "target_id = "+arg(filter.TargetId))
+	}
+	if filter.From != nil {
+		conds = append(conds, "created_at >= "+arg(*filter.From))
+	}
+	if filter.To != nil {
+		conds = append(conds, "created_at < "+arg(*filter.To))
+	}
+	if filter.Before > 0 {
+		conds = append(conds, "id < "+arg(filter.Before))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	rows, err := connPool.Query(context.Background(), fmt.Sprintf(`
+		SELECT %s
+		FROM PUBLIC.audit_log
+		%s
+		ORDER BY id DESC
+		LIMIT %s
+	`, auditColumns, where, arg(filter.Limit)), args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	page.Entries = make([]qs.AuditEntry, 0, filter.Limit)
+	for rows.Next() {
+		entry, _, _, err := scanAuditEntry(rows)
+		if err != nil {
+			return page, err
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Entries) == filter.Limit {
+		page.NextBefore = page.Entries[len(page.Entries)-1].Id
+	}
+	return page, nil
+}
+
+// VerifyAuditChain recomputes every entry's hash in order, reporting the first one that doesn't match
+func VerifyAuditChain(connPool *pgxpool.Pool) (qs.AuditChainStatus, error) {
+	status := qs.AuditChainStatus{Valid: true}
+	var lastId int64
+	var lastHash []byte
+	for {
+		rows, err := connPool.Query(context.Background(), fmt.Sprintf(`
+			SELECT %s
+			FROM PUBLIC.audit_log
+			WHERE id > $1
+			ORDER BY id
+			LIMIT $2
+		`, auditColumns), lastId, auditVerifyBatch)
+		if err != nil {
+			return status, err
+		}
+		count := 0
+		for rows.Next() {
+			entry, prevHash, hash, err := scanAuditEntry(rows)
+			if err != nil {
+				rows.Close()
+				return status, err
+			}
+			count++
+			status.EntriesChecked++
+			// before and after are compared in the canonical form they were hashed in
+			entry.Before, err = canonicalJson(entry.Before)
+			if err == nil {
+				entry.After, err = canonicalJson(entry.After)
+			}
+			if err != nil || !bytes.Equal(prevHash, lastHash) || !bytes.Equal(hash, auditHash(prevHash, entry)) {
+				rows.Close()
+				status.Valid = false
+				status.BrokenAt = entry.Id
+				return status, nil
+			}
+			lastId, lastHash = entry.Id, hash
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return status, err
+		}
+		if count < auditVerifyBatch {
+			return status, nil
+		}
+	}
+}
+
+// VerifyAuditLog runs VerifyAuditChain and reports a broken chain
+func VerifyAuditLog(connPool *pgxpool.Pool) {
+	status, err := VerifyAuditChain(connPool)
+	if err != nil {
+		fmt.Println("error verifying audit log", err)
+		EmailErrorLog(SubjAuditChainBroken, "error verifying audit log: "+err.Error())
+		return
+	}
+	if !status.Valid {
+		EmailErrorLog(SubjAuditChainBroken, fmt.Sprintf("audit log hash chain is broken at entry %d", status.BrokenAt))
+	}
+}
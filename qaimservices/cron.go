@@ -1,9 +1,7 @@
 package qaimservices
 
 import (
-	"bytes"
 	"context"
-	"encoding/csv"
 	"fmt"
 	"qaimbe/qaimstructs"
 	qs "qaimbe/qaimstructs"
@@ -12,7 +10,7 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func ResolveMaturedTokens(mailList map[string][]string, connPool *pgxpool.Pool) {
+func ResolveMaturedTokens(connPool *pgxpool.Pool) {
 	/*
 		Function runs daily, checks which user tokens have reached their
 		maturity date and for each of them:
@@ -79,7 +77,7 @@ func ResolveMaturedTokens(mailList map[string][]string, connPool *pgxpool.Pool)
 		maturingTokens = append(maturingTokens, token)
 	}
 
-	_, err = tx.Exec(context.TODO(), `
+	payoutRows, err := tx.Query(context.TODO(), `
 		with invalidate_tokens AS ( -- 2. Update token status
 			UPDATE PUBLIC.tbill_tokens
 			SET VALID = false
@@ -113,32 +111,62 @@ func ResolveMaturedTokens(mailList map[string][]string, connPool *pgxpool.Pool)
 		UPDATE PUBLIC.user
 		SET balance = balance + tot_inv.u_return
 		FROM calc_tot_inv AS tot_inv
-		WHERE uuid = tot_inv.user_id;
+		WHERE uuid = tot_inv.user_id
+		RETURNING uuid, tot_inv.u_return;
 	`)
 	if err != nil {
 		fmt.Println("Error updating token and user balance", err)
+		EmailErrorLog("MatureTbillTokens: Error updating token and user balance", err.Error())
+		return
+	}
+	var payouts []qaimstructs.LedgerTransfer
+	for payoutRows.Next() {
+		payout := qaimstructs.LedgerTransfer{
+			DebitAccount: LedgerTbillHoldings, CreditAccount: LedgerUserWallet, Source: LedgerSrcMaturity,
+		}
+		err = payoutRows.Scan(&payout.UserId, &payout.Amount)
+		if err != nil {
+			fmt.Println("Error scanning maturity payouts", err)
+			EmailErrorLog("MatureTbillTokens: Error scanning maturity payouts", err.Error())
+			return
+		}
+		payouts = append(payouts, payout)
+	}
+	payoutRows.Close()
+	// 3. record payouts in the ledger
+	for i := 0; i < len(payouts); i++ {
+		err = PostLedgerTransfer(tx, payouts[i])
+		if err != nil {
+			fmt.Println("Error recording maturity payout in ledger", err)
+			EmailErrorLog("MatureTbillTokens: Error recording maturity payouts", err.Error())
+			return
+		}
+	}
+	err = tx.Commit(context.TODO())
+	if err != nil {
+		fmt.Println("Error committing matured tokens", err)
+		EmailErrorLog("MatureTbillTokens: Error committing matured tokens", err.Error())
 		return
 	}
-	tx.Commit(context.TODO())
 	// TODO(talha): Add maybe an email notification indicating that the cron job ran
 	headers := []string{"Token Id", "User Id", "Amount Invested", "Maturity Date",
 		"Tenor Days", "Bond Id", "Investment Date"}
 	data := [][]string{headers}
+	var totalInvested int64
 	for i := 0; i < len(maturingTokens); i++ {
 		token := maturingTokens[i]
+		totalInvested += token.AmountInvested
 		row := []string{
 			token.TokenId, token.UserId, fmt.Sprint(token.AmountInvested), token.MaturityDate.String(),
 			fmt.Sprint(token.TenorDays), token.BondId, token.InvestmentDate.String()}
 		data = append(data, row)
 	}
-	var b bytes.Buffer
-	w := csv.NewWriter(&b)
-	w.WriteAll(data)
+	totals := []qs.ReportTotal{{Label: "Amount Invested", Value: FormatPkr(totalInvested)}}
 	// * email csv
-	go SendEmailBytes(mailList[MailReporting], SubjTbillMaturity, b)
+	go SendReportEmail(MailRecipients(connPool, MailReporting, ReportTokenMaturity), SubjTbillMaturity, ReportTokenMaturity, totals, data)
 }
 
-func ResolveMaturedTbills(mailList map[string][]string, connPool *pgxpool.Pool) {
+func ResolveMaturedTbills(connPool *pgxpool.Pool) {
 	// TODO(talha): make transaction
 	rows, err := connPool.Query(context.TODO(), `
 		UPDATE PUBLIC.tbills
@@ -167,26 +195,26 @@ func ResolveMaturedTbills(mailList map[string][]string, connPool *pgxpool.Pool)
 
 	headers := []string{"Tbill Id", "Tenor Days", "Issue Date", "Interest Rate", "Maturity Date", "Amount"}
 	data := [][]string{headers}
+	var totalAmount int64
 	for i := 0; i < len(resolvedTbills); i++ {
 		tbills := resolvedTbills[i]
+		totalAmount += int64(tbills.Amount)
 		row := []string{
 			tbills.Uuid, fmt.Sprint(tbills.TenorDays), tbills.IssueDate.String(),
 			fmt.Sprint(tbills.InterestRate), tbills.MaturityDate.String(), fmt.Sprint(tbills.Amount)}
 		data = append(data, row)
 	}
-	var b bytes.Buffer
-	w := csv.NewWriter(&b)
-	w.WriteAll(data)
+	totals := []qs.ReportTotal{{Label: "Tbill Amount", Value: FormatPkr(totalAmount)}}
 	// * email csv
-	go SendEmailBytes(mailList[MailReporting], SubjTbillMaturity, b)
+	go SendReportEmail(MailRecipients(connPool, MailReporting, ReportTbillMaturity), SubjTbillMaturity, ReportTbillMaturity, totals, data)
 }
 
-func ResolveTbills(mailList map[string][]string, connPool *pgxpool.Pool) {
-	ResolveMaturedTokens(mailList, connPool)
-	ResolveMaturedTbills(mailList, connPool)
+func ResolveTbills(connPool *pgxpool.Pool) {
+	ResolveMaturedTokens(connPool)
+	ResolveMaturedTbills(connPool)
 }
 
-func CustomerTbillHolding(mailList map[string][]string, connPool *pgxpool.Pool) {
+func CustomerTbillHolding(connPool *pgxpool.Pool) {
 	rows, err := connPool.Query(context.TODO(), `
 		WITH get_interest_rate AS (
 			SELECT ROW_NUMBER() OVER (ORDER BY tok.amount_invested) AS serial_num, tok.user_id, 
@@ -225,21 +253,25 @@ func CustomerTbillHolding(mailList map[string][]string, connPool *pgxpool.Pool)
 	// * Parse
 	headers := []string{"Serial No.", "Customer ID", "Amount Invested", "Fraction Issue Date", "Fraction Maturity Date", "Current Value"}
 	data := [][]string{headers}
+	var totalInvested, totalValue int64
 	for i := 0; i < len(userPurchases); i++ {
 		purch := userPurchases[i]
+		totalInvested += purch.Amount
+		totalValue += purch.Value
 		row := []string{
 			fmt.Sprint(purch.SerialNumber), purch.UserId, fmt.Sprint(purch.Amount),
 			purch.InvestmentDate.String(), purch.MaturityDate.String(), fmt.Sprint(purch.Value)}
 		data = append(data, row)
 	}
-	var b bytes.Buffer
-	w := csv.NewWriter(&b)
-	w.WriteAll(data)
+	totals := []qs.ReportTotal{
+		{Label: "Amount Invested", Value: FormatPkr(totalInvested)},
+		{Label: "Current Value", Value: FormatPkr(totalValue)},
+	}
 	// * email csv
-	SendEmailBytes(mailList[MailReporting], SubjTbillHolding, b)
+	SendReportEmail(MailRecipients(connPool, MailReporting, ReportTbillHolding), SubjTbillHolding, ReportTbillHolding, totals, data)
 }
 
-func CustomerTbillPurchase(mailList map[string][]string, connPool *pgxpool.Pool) {
+func CustomerTbillPurchase(connPool *pgxpool.Pool) {
 	rows, err := connPool.Query(context.TODO(), `
 		SELECT ROW_NUMBER() OVER (ORDER BY tok.amount_invested), NOW()::DATE, tok.user_id, u.national_id, tok.investment_date, tok.maturity_date, tok.amount_invested
 		FROM PUBLIC.tbill_tokens AS tok
@@ -267,28 +299,29 @@ func CustomerTbillPurchase(mailList map[string][]string, connPool *pgxpool.Pool)
 	// * Parse
 	headers := []string{"Serial No.", "Date", "Customer Id", "CNIC", "Fraction Issue Date", "Fraction Maturity Date", "Value"}
 	data := [][]string{headers}
+	var totalAmount int64
 	for i := 0; i < len(userPurchases); i++ {
 		purch := userPurchases[i]
+		totalAmount += purch.Amount
 		row := []string{
 			fmt.Sprint(purch.SerialNumber), purch.Date, purch.UserId, purch.NationalId,
 			purch.InvestmentDate.String(), purch.MaturityDate.String(), fmt.Sprint(purch.Amount)}
 		data = append(data, row)
 	}
-	var b bytes.Buffer
-	w := csv.NewWriter(&b)
-	w.WriteAll(data)
+	totals := []qs.ReportTotal{{Label: "Amount Purchased", Value: FormatPkr(totalAmount)}}
 	// * email csv
-	SendEmailBytes(mailList[MailReporting], SubjTbillPurchase, b)
+	SendReportEmail(MailRecipients(connPool, MailReporting, ReportTbillPurchase), SubjTbillPurchase, ReportTbillPurchase, totals, data)
 }
 
-func CustomerWithdrawRequest(mailList map[string][]string, connPool *pgxpool.Pool) {
+func CustomerWithdrawRequest(connPool *pgxpool.Pool) {
 	rows, err := connPool.Query(context.TODO(), `
-		SELECT ROW_NUMBER() OVER (ORDER BY wdraw.amount) AS row_number, wdraw.request_date, wdraw.user_id, u.national_id, u.iban, wdraw.amount
+		SELECT ROW_NUMBER() OVER (ORDER BY wdraw.amount) AS row_number, wdraw.request_date, wdraw.user_id, u.national_id, u.iban,
+			wdraw.amount, wdraw.status
 		FROM PUBLIC.user_withdraw_requests AS wdraw
 		LEFT JOIN PUBLIC.user AS u 
 		ON u.uuid = wdraw.user_id
-		WHERE VALID = true;
-	`)
+		WHERE wdraw.status = ANY($1);
+	`, WithdrawOpenStatuses)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -298,7 +331,7 @@ func CustomerWithdrawRequest(mailList map[string][]string, connPool *pgxpool.Poo
 	var userPurchases []qs.CsvWdrawRequest
 	for rows.Next() {
 		var r qs.CsvWdrawRequest
-		err = rows.Scan(&r.SerialNumber, &r.Date, &r.UserId, &r.NationalId, &r.Iban, &r.Amount)
+		err = rows.Scan(&r.SerialNumber, &r.Date, &r.UserId, &r.NationalId, &r.Iban, &r.Amount, &r.Status)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -307,16 +340,16 @@ func CustomerWithdrawRequest(mailList map[string][]string, connPool *pgxpool.Poo
 	}
 
 	// * Parse
-	headers := []string{"Serial No.", "Date", "Customer Id", "CNIC", "IBAN", "Money Out Request"}
+	headers := []string{"Serial No.", "Date", "Customer Id", "CNIC", "IBAN", "Money Out Request", "Status"}
 	data := [][]string{headers}
+	var totalAmount int64
 	for i := 0; i < len(userPurchases); i++ {
 		purch := userPurchases[i]
-		row := []string{fmt.Sprint(purch.SerialNumber), purch.Date.String(), purch.UserId, purch.NationalId, purch.Iban, fmt.Sprint(purch.Amount)}
+		totalAmount += purch.Amount
+		row := []string{fmt.Sprint(purch.SerialNumber), purch.Date.String(), purch.UserId, purch.NationalId, purch.Iban, fmt.Sprint(purch.Amount), purch.Status}
 		data = append(data, row)
 	}
-	var b bytes.Buffer
-	w := csv.NewWriter(&b)
-	w.WriteAll(data)
+	totals := []qs.ReportTotal{{Label: "Amount Requested", Value: FormatPkr(totalAmount)}}
 	// * email csv
-	SendEmailBytes(mailList[MailReporting], SubjFundsWithdraw, b)
+	SendReportEmail(MailRecipients(connPool, MailReporting, ReportFundsWithdraw), SubjFundsWithdraw, ReportFundsWithdraw, totals, data)
 }
@@ -0,0 +1,61 @@
+package qaimservices
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testConnPool connects to DATABASE_URL and migrates it, skipping the test when it isn't set
+func testConnPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dbUrl := os.Getenv("DATABASE_URL")
+	if dbUrl == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	connPool, err := pgxpool.New(context.Background(), dbUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(connPool.Close)
+	err = MigrateUp(connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connPool
+}
+
+func randomHex(t *testing.T, n int) string {
+	t.Helper()
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// createTestUser inserts a user with the given balance column, removed with its ledger entries when the test ends
+func createTestUser(t *testing.T, connPool *pgxpool.Pool, balance int64) string {
+	t.Helper()
+	tag := randomHex(t, 6)
+	var userId string
+	err := connPool.QueryRow(context.Background(), `
+		INSERT INTO PUBLIC.user (national_id, first_name, last_name, phone_number, iban, id_front, id_back, password_hash, balance)
+		VALUES ($1, 'Test', 'User', $2, '', '', '', '\x00', $3)
+		RETURNING uuid
+	`, "test-"+tag, "test-"+tag, balance).Scan(&userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		connPool.Exec(ctx, "DELETE FROM PUBLIC.ledger_entries WHERE user_id = $1", userId)
+		connPool.Exec(ctx, "DELETE FROM PUBLIC.user WHERE uuid = $1", userId)
+	})
+	return userId
+}
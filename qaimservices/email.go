@@ -0,0 +1,280 @@
+package qaimservices
+
+import (
+	"bytes"
+	"embed"
+	b64 "encoding/base64"
+	"encoding/csv"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	qs "qaimbe/qaimstructs"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+/*
+# Emails
+Every email is a MIME message with From, To, Date and Message-ID headers.
+Reports carry an HTML and text summary rendered from templates/report.*.tmpl,
+with the report data attached as a csv file
+*/
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS
+
+var (
+	reportHtmlTemplate = htmltemplate.Must(htmltemplate.ParseFS(templateFiles, "templates/report.html.tmpl"))
+	reportTextTemplate = texttemplate.Must(texttemplate.ParseFS(templateFiles, "templates/report.txt.tmpl"))
+)
+
+const ContentCsv = "text/csv"
+
+// envSubject tags a subject with the deploy environment, so reports from dev and prod can be told apart
+func envSubject(subject string) string {
+	deployEnv := os.Getenv("DEPLOY_ENV")
+	if deployEnv == "" {
+		return subject
+	}
+	return subject + " " + deployEnv
+}
+
+func messageId(from string) string {
+	domain := "qaim.local"
+	if atInd := strings.LastIndex(from, "@"); atInd >= 0 && atInd < len(from)-1 {
+		domain = strings.TrimSuffix(from[atInd+1:], ">")
+	}
+	id, _ := NewUuid()
+	return "<" + id + "@" + domain + ">"
+}
+
+func writeTextPart(mw *multipart.Writer, contentType string, body string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	_, err = qp.Write([]byte(body))
+	if err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeAttachment(mw *multipart.Writer, attachment qs.EmailAttachment) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = ContentOctetStream
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": attachment.Filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	encoded := b64.StdEncoding.EncodeToString(attachment.Data)
+	// base64 lines may not exceed 76 characters
+	for len(encoded) > 76 {
+		_, err = part.Write([]byte(encoded[:76] + "\r\n"))
+		if err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = part.Write([]byte(encoded + "\r\n"))
+	return err
+}
+
+// writeAlternative writes the text and html bodies as a multipart/alternative entity into mw
+func writeAlternative(mw *multipart.Writer, text string, html string) error {
+	var alt bytes.Buffer
+	altWriter := multipart.NewWriter(&alt)
+	err := writeTextPart(altWriter, "text/plain", text)
+	if err != nil {
+		return err
+	}
+	err = writeTextPart(altWriter, "text/html", html)
+	if err != nil {
+		return err
+	}
+	err = altWriter.Close()
+	if err != nil {
+		return err
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/alternative; boundary="+altWriter.Boundary())
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(alt.Bytes())
+	return err
+}
+
+/*
+BuildEmail creates a MIME message
+@param html optional, when set the message carries both a text and an html body
+*/
+func BuildEmail(from string, to []string, subject string, text string, html string, attachments []qs.EmailAttachment) ([]byte, error) {
+	var msg bytes.Buffer
+	msg.WriteString("From: " + from + "\r\n")
+	msg.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	msg.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Message-ID: " + messageId(from) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+
+	if html == "" && len(attachments) == 0 {
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&msg)
+		_, err := qp.Write([]byte(text))
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		return msg.Bytes(), err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	var err error
+	if len(attachments) == 0 {
+		msg.WriteString("Content-Type: multipart/alternative; boundary=" + mw.Boundary() + "\r\n\r\n")
+		err = writeTextPart(mw, "text/plain", text)
+		if err == nil {
+			err = writeTextPart(mw, "text/html", html)
+		}
+	} else {
+		msg.WriteString("Content-Type: multipart/mixed; boundary=" + mw.Boundary() + "\r\n\r\n")
+		if html != "" {
+			err = writeAlternative(mw, text, html)
+		} else {
+			err = writeTextPart(mw, "text/plain", text)
+		}
+		for i := 0; i < len(attachments) && err == nil; i++ {
+			err = writeAttachment(mw, attachments[i])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+/*
+deliverEmail queues a built message in the outbox,
+when the outbox can't be reached the message is sent directly
+*/
+func deliverEmail(from string, to []string, subject string, msg []byte) {
+	if len(to) == 0 {
+		fmt.Println("email has no recipients, skipping:", subject)
+		return
+	}
+	if GlobalState != nil && GlobalState.ConnPool != nil {
+		err := QueueEmail(GlobalState.ConnPool, to, subject, msg)
+		if err == nil {
+			return
+		}
+		fmt.Println("error queueing email, sending directly", err)
+	}
+	if mailer == nil {
+		fmt.Println("error sending email: no mailer configured")
+		return
+	}
+	err := mailer.Send(from, to, msg)
+	if err != nil {
+		fmt.Println("error sending email", err)
+	}
+}
+
+// SendEmailString sends a plain text email
+func SendEmailString(mailList []string, subject string, message string) {
+	subject = envSubject(subject)
+	from := mailSender()
+	msg, err := BuildEmail(from, mailList, subject, message, "", nil)
+	if err != nil {
+		fmt.Println("error building email", err)
+		return
+	}
+	deliverEmail(from, mailList, subject, msg)
+}
+
+/*
+SendReportEmail mails data as a csv attachment named <filePrefix>-<date>.csv,
+with a summary of the row count and totals in the body
+@param data csv rows, the first row being the headers
+*/
+func SendReportEmail(mailList []string, subject string, filePrefix string, totals []qs.ReportTotal, data [][]string) {
+	now := time.Now()
+	var csvBuff bytes.Buffer
+	csvWriter := csv.NewWriter(&csvBuff)
+	err := csvWriter.WriteAll(data)
+	if err != nil {
+		fmt.Println("error writing report csv", err)
+		return
+	}
+	summary := qs.ReportSummary{
+		Title:       subject,
+		Environment: os.Getenv("DEPLOY_ENV"),
+		GeneratedAt: now,
+		RowCount:    len(data) - 1,
+		Totals:      totals,
+		Attachment:  fmt.Sprintf("%s-%s.csv", filePrefix, now.Format("2006-01-02")),
+	}
+	if summary.RowCount < 0 {
+		summary.RowCount = 0
+	}
+	var text, html bytes.Buffer
+	err = reportTextTemplate.Execute(&text, summary)
+	if err == nil {
+		err = reportHtmlTemplate.Execute(&html, summary)
+	}
+	if err != nil {
+		fmt.Println("error rendering report email", err)
+		return
+	}
+
+	subject = envSubject(subject)
+	from := mailSender()
+	msg, err := BuildEmail(from, mailList, subject, text.String(), html.String(), []qs.EmailAttachment{
+		{Filename: summary.Attachment, ContentType: ContentCsv, Data: csvBuff.Bytes()},
+	})
+	if err != nil {
+		fmt.Println("error building report email", err)
+		return
+	}
+	deliverEmail(from, mailList, subject, msg)
+}
+
+// FormatPkr formats an amount for report summaries, e.g. 1,250,000 PKR
+func FormatPkr(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	digits := fmt.Sprint(amount)
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return sign + grouped.String() + " PKR"
+}
@@ -1,27 +1,23 @@
 package qaimservices
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
 	json "encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"mime/multipart"
 	"net/http"
 	"net/mail"
-	"net/smtp"
 	"os"
 	qs "qaimbe/qaimstructs"
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/robfig/cron"
 
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -31,17 +27,6 @@ import (
 var GlobalState *qs.ApplicationState
 
 // * Email Constants
-const (
-	LoggingTalha = "sarcxd@gmail.com"
-	LoggingHasan = "hasan.tariq@qaim.finance"
-)
-
-const (
-	ReportingRabi     = "R.nasir1995@gmail.com"
-	ReportingRabiQaim = "Rabi.nasir@qaim.finance"
-	ReportingTalha    = "talhaaamirwork@gmail.com"
-)
-
 const (
 	MailReporting    = "reporting"
 	MailLogging      = "logging"
@@ -90,38 +75,68 @@ const (
 	EnvProd  = "prod"
 )
 
+// * Error codes, the machine readable part of the error envelope
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeValidation       = "validation_failed"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodeUnsupportedMedia = "unsupported_media_type"
+	ErrCodeInternal         = "internal_error"
+)
+
+const (
+	ErrCodeAccountUnverified     = "account_unverified"
+	ErrCodeInvalidRefreshToken   = "invalid_refresh_token"
+	ErrCodePendingWithdrawal     = "pending_withdrawal"
+	ErrCodePurchaseUnavailable   = "purchase_unavailable"
+	ErrCodeNoInterestRate        = "no_interest_rate"
+	ErrCodeKycTransition         = "kyc_transition_not_allowed"
+	ErrCodeSameApprover          = "same_approver"
+	ErrCodeOperationDecided      = "operation_already_decided"
+	ErrCodeApprovalPending       = "approval_pending"
+	ErrCodeWithdrawTransition    = "withdraw_transition_not_allowed"
+	ErrCodeNoPayouts             = "no_payouts"
+	ErrCodePayoutsMissingIban    = "payouts_missing_iban"
+	ErrCodePayoutBatchStatus     = "payout_batch_status"
+	ErrCodePayoutBatched         = "payout_batched"
+	ErrCodeIdempotencyKeyReused  = "idempotency_key_reused"
+	ErrCodeIdempotencyInProgress = "idempotency_key_in_progress"
+	ErrCodeRateLimited           = "rate_limited"
+	ErrCodeAccountLocked         = "account_locked"
+	ErrCodeMfaRequired           = "mfa_required"
+	ErrCodeOtpRequired           = "otp_required"
+	ErrCodeInvalidOtp            = "invalid_otp"
+	ErrCodeMfaEnrolled           = "mfa_already_enrolled"
+)
+
+const HeaderRequestId = "X-Request-Id"
+
 // ! ************ HELPER FUNCTIONS *******************
-// declares a type RequestHandlers for functions with a http.ResponseWriter parameter
-type requestHandlers func(w http.ResponseWriter, r *http.Request, conn *pgxpool.Pool)
-
-func MethodGuard(fn requestHandlers, w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, methodType string, userRole Role) {
-	// check if method (GET/POST/PUT/DELETE) of request url matches the function on that path
-	if r.Method == methodType {
-		// user role (and hence jwt token ) not required
-		// ! Only for Admin login, User login, User Signup endpoints
-		if userRole == NONE {
-			fn(w, r, connPool)
-			return
-		}
-		if userRole == SUPERUSER {
-			// get api key from request header
-			apiKey := r.Header.Get("apiKey")
-			if apiKey == os.Getenv("ADMIN_API_KEY") {
-				fn(w, r, connPool)
-				return
-			}
-		}
-		// user role is required
-		// verify jwt token, role and if token is expired
-		b64Token := r.Header.Get("Token")
-		if VerifyJwtToken(b64Token, userRole) {
-			fn(w, r, connPool)
-			return
+type requestIdCtxKey struct{}
+
+/*
+WithRequestId tags every request with an id, taken from the X-Request-Id header
+when the client supplies a valid one, and echoes it back in the response
+*/
+func WithRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(HeaderRequestId)
+		if requestId == "" || len(requestId) > 64 || !ValidateUuid(requestId) {
+			requestId, _ = NewUuid()
 		}
-		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-		return
-	}
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		w.Header().Set(HeaderRequestId, requestId)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdCtxKey{}, requestId)))
+	})
+}
+
+// RequestId returns the id WithRequestId assigned to the request
+func RequestId(r *http.Request) string {
+	requestId, _ := r.Context().Value(requestIdCtxKey{}).(string)
+	return requestId
 }
 
 func ValidateContentType(r *http.Request, mimetype string) bool {
@@ -175,23 +190,29 @@ func ValidateName(str string) bool {
 	return rgx.MatchString(str)
 }
 
+// ValidateEmail accepts a bare address, without a display name or angle brackets
 func ValidateEmail(str string) bool {
-	_, err := mail.ParseAddress(str)
-	return err != nil
+	addr, err := mail.ParseAddress(str)
+	return err == nil && addr.Address == str
 }
 
 func ValidatePassword(str string) bool {
 	/*
-		len: 8-100
-		chars-disallowed: .,*,\,\t,\n,\r,',",>,<
-		regex: ^[^\.\*\\\t\n\r'"><]{8,}$
-		^,$: Match exact string, from beginning to end
-		[^ : disallow any inside square brackets
-		\.\*\\\t\n\r'"><: characters to disallow
-		{8,100}: allow passwords from 8-100
+		len: 8-100 characters
+		chars: any printable character, spaces included
+		every query is parameterized, so no character needs to be kept out,
+		see CheckPasswordPolicy for the strength a new password needs
 	*/
-	rgx := regexp.MustCompile(`^[^\.\*\\\t\n\r'"><]{8,100}$`)
-	return rgx.MatchString(str)
+	length := utf8.RuneCountInString(str)
+	if !utf8.ValidString(str) || length < 8 || length > 100 {
+		return false
+	}
+	for _, c := range str {
+		if !unicode.IsPrint(c) {
+			return false
+		}
+	}
+	return true
 }
 
 func ValidateIban(str string) bool {
@@ -219,20 +240,16 @@ func ValidateUuid(str string) bool {
 	return rgx.MatchString(str)
 }
 
-func ValidateImage(imgHeader *multipart.FileHeader) bool {
-	/*
-		maxlen: 2mb
-		accept-type: [jpeg, png]
-	*/
-	imgBytes := imgHeader.Size
-	imgMb := Mb64(imgBytes)
-	if imgMb <= 2 {
-		contentType := imgHeader.Header.Get("Content-Type")
-		if contentType == ContentPng || contentType == ContentJpeg {
-			return true
-		}
+// NewUuid generates a random (version 4) uuid
+func NewUuid() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
-	return false
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
 }
 
 // ****************
@@ -248,6 +265,68 @@ func ServeJson[V qs.JsonEncodeSupported](w http.ResponseWriter, r *http.Request,
 	return err
 }
 
+// ServeJsonStatus is ServeJson with a status code other than 200 OK
+func ServeJsonStatus[V qs.JsonEncodeSupported](w http.ResponseWriter, r *http.Request, status int, v V) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	return err
+}
+
+// ServeMessage answers a successful request that has no data to return
+func ServeMessage(w http.ResponseWriter, r *http.Request, message string) {
+	err := ServeJson(w, r, qs.MessageResponse{Message: message})
+	if err != nil {
+		fmt.Println("error serving message", err)
+	}
+}
+
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	case http.StatusConflict:
+		return ErrCodeConflict
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupportedMedia
+	}
+	if status >= 500 {
+		return ErrCodeInternal
+	}
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+/*
+ServeError answers a failed request with the error envelope,
+the error code is derived from the status, use ServeErrorCode for a specific one
+*/
+func ServeError(w http.ResponseWriter, r *http.Request, status int, message string, fields ...qs.FieldError) {
+	ServeErrorCode(w, r, status, errorCodeForStatus(status), message, fields...)
+}
+
+func ServeErrorCode(w http.ResponseWriter, r *http.Request, status int, code string, message string, fields ...qs.FieldError) {
+	envelope := qs.ErrorEnvelope{Error: qs.ErrorBody{
+		Code: code, Message: message, RequestId: RequestId(r), Fields: fields,
+	}}
+	err := ServeJsonStatus(w, r, status, envelope)
+	if err != nil {
+		fmt.Println("error serving error envelope", err)
+	}
+}
+
+// ServeValidationErrors answers with 400 and the list of invalid fields
+func ServeValidationErrors(w http.ResponseWriter, r *http.Request, fields []qs.FieldError) {
+	ServeErrorCode(w, r, http.StatusBadRequest, ErrCodeValidation, "one or more fields are invalid", fields...)
+}
+
 // ! ************ DataBase ******************
 func ConnectToDb() (*pgxpool.Pool, error) {
 	host := os.Getenv("DBHOST")
@@ -269,114 +348,16 @@ func ConnectToDb() (*pgxpool.Pool, error) {
 
 // ! *************** REPORTING ************
 
-func SendEmailBytes(mailList []string, subject string, message bytes.Buffer) {
-	if GlobalState.EnvType == EnvLocal {
-		return
-	}
-	from := os.Getenv("EMAIL_USER")
-	passwd := os.Getenv("EMAIL_PASS")
-	to := mailList
-	toHeader := strings.Join(to, ",")
-	smtpHost := "smtp.gmail.com"
-	smtpPort := "587"
-	body := []byte("To:" + toHeader + "\n" +
-		"Subject: " + subject + " " + os.Getenv("DEPLOY_ENV") + "\n" +
-		"\n" +
-		message.String())
-	auth := smtp.PlainAuth("", from, passwd, smtpHost)
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, body)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func SendEmailString(mailList []string, subject string, message string) {
-	if GlobalState.EnvType == EnvLocal {
-		return
-	}
-	from := os.Getenv("EMAIL_USER")
-	passwd := os.Getenv("EMAIL_PASS")
-	to := mailList
-	toHeader := strings.Join(to, ",")
-	smtpHost := "smtp.gmail.com"
-	smtpPort := "587"
-	body := []byte("To:" + toHeader + "\n" +
-		"Subject: " + subject + " " + os.Getenv("DEPLOY_ENV") + "\n" +
-		"\n" +
-		message)
-	auth := smtp.PlainAuth("", from, passwd, smtpHost)
-	err := smtp.SendMail(smtpHost+":"+smtpPort, auth, from, to, body)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func EmailErrorLog(subject string, err string) {
-	if GlobalState.EnvType == EnvLocal {
+	if GlobalState == nil {
+		fmt.Println(subject, err)
 		return
 	}
-	loggingList := (*GlobalState.MailList)[MailLogging]
+	loggingList := MailRecipients(GlobalState.ConnPool, MailLogging, "")
 	fmtErr := fmt.Sprintf("error code: %s", err)
 	SendEmailString(loggingList, subject, fmtErr)
 }
 
-// ! *************** AWS ******************
-
-func UploadToS3(file multipart.File, fname string) error {
-	// don't want to be using aws services locally
-	if GlobalState.EnvType == EnvLocal {
-		return nil
-	}
-	// TODO(talha): Make function use channels to allow concurrent uploads
-	svc := s3.New(GlobalState.AwsSess)
-	s3Bucket := os.Getenv("AWS_S3_BUCKET")
-	inp := s3.PutObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Body:   file,
-		Key:    aws.String(fname),
-	}
-	_, err := svc.PutObject(&inp)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func GetFromS3(fname string) ([]byte, error) {
-	// TODO(talha): Make function use channels to allow concurrent downloads
-	svc := s3.New(GlobalState.AwsSess)
-	s3Bucket := os.Getenv("AWS_S3_BUCKET")
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(s3Bucket),
-		Key:    aws.String(fname),
-	}
-
-	result, err := svc.GetObject(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				fmt.Println(s3.ErrCodeNoSuchKey, aerr.Error())
-			case s3.ErrCodeInvalidObjectState:
-				fmt.Println(s3.ErrCodeInvalidObjectState, aerr.Error())
-			default:
-				fmt.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			fmt.Println(err.Error())
-		}
-		return nil, err
-	}
-	defer result.Body.Close()
-	fBuff, err := io.ReadAll(result.Body)
-	if err != nil {
-		return nil, err
-	}
-	return fBuff, nil
-}
-
 func InitAppState(env string) error {
 	awsRegion := os.Getenv("AWS_REGION")
 	accessKeyID := os.Getenv("AWS_ACCESS_KEY")
@@ -395,37 +376,94 @@ func InitAppState(env string) error {
 		return err
 	}
 
+	err = LoadJwtKeys()
+	if err != nil {
+		return err
+	}
+	err = LoadMailer(env)
+	if err != nil {
+		return err
+	}
+	err = LoadSmsSender(env)
+	if err != nil {
+		return err
+	}
+	err = LoadObjectStore(env, awsSess)
+	if err != nil {
+		return err
+	}
+	err = LoadKycKeys(env)
+	if err != nil {
+		return err
+	}
+	err = LoadFileUrlSecret()
+	if err != nil {
+		return err
+	}
+	err = LoadPayoutLayout()
+	if err != nil {
+		return err
+	}
+	err = LoadBreachedPasswords()
+	if err != nil {
+		return err
+	}
+
 	connPool, err := ConnectToDb()
 	if err != nil {
 		dbErr := errors.New("error initializing db pool")
 		return dbErr
 	}
-
-	mailList := make(map[string][]string, 3)
-	mailList[MailReporting] = []string{ReportingTalha, LoggingHasan, ReportingRabi}
-	mailList[MailLogging] = []string{LoggingTalha, LoggingHasan, ReportingRabi}
-	mailList[MailUserNotifier] = []string{ReportingRabi, LoggingHasan, ReportingTalha}
+	err = MigrateUp(connPool)
+	if err != nil {
+		return fmt.Errorf("error migrating db schema: %w", err)
+	}
 
 	cronRunner := cron.New()
 	// TODO: make these funcs use channels
 	cronRunner.AddFunc("@every 12h", func() {
-		ResolveTbills(mailList, connPool)
+		ResolveTbills(connPool)
 	})
 	cronRunner.AddFunc("@every 12h", func() {
-		CustomerTbillHolding(mailList, connPool)
+		CustomerTbillHolding(connPool)
 	})
 	cronRunner.AddFunc("@every 12h", func() {
-		CustomerTbillPurchase(mailList, connPool)
+		CustomerTbillPurchase(connPool)
 	})
 	cronRunner.AddFunc("@every 12h", func() {
-		CustomerWithdrawRequest(mailList, connPool)
+		CustomerWithdrawRequest(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		ReconcileLedgerBalances(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		PurgeExpiredSessions(connPool)
+	})
+	cronRunner.AddFunc("@every 1m", func() {
+		DeliverOutbox(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		RotateKycEncryption(connPool)
+		RotateTotpSecrets(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		VerifyAuditLog(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		PurgeIdempotencyKeys(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		PurgeRateLimits(connPool)
+	})
+	cronRunner.AddFunc("@every 24h", func() {
+		PurgeExpiredOtps(connPool)
 	})
 	cronRunner.Start()
 
 	GlobalState = &qs.ApplicationState{
 		AwsSess: awsSess, ConnPool: connPool,
-		CronRunner: cronRunner, MailList: &mailList,
-		EnvType: env,
+		CronRunner: cronRunner,
+		EnvType:    env,
 	}
 	return nil
 }
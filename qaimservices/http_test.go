@@ -0,0 +1,23 @@
+package qaimservices
+
+import "testing"
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"ops@qaim.finance", true},
+		{"first.last+reports@example.com", true},
+		{"not an email", false},
+		{"", false},
+		{"ops@", false},
+		{"Ops <ops@qaim.finance>", false},
+		{" ops@qaim.finance", false},
+	}
+	for _, tt := range tests {
+		if got := ValidateEmail(tt.email); got != tt.want {
+			t.Errorf("ValidateEmail(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
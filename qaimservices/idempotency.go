@@ -0,0 +1,244 @@
+package qaimservices
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Idempotency Keys
+Authorized mutating requests (anything but GET, HEAD and OPTIONS) may carry an Idempotency-Key header.
+The first request with a key runs and its response is stored with a hash of its method, path, query and body:
+  - retrying with the same key and request replays the stored response, marked Idempotent-Replayed: true
+  - reusing the key for a different request is refused with 422
+  - retrying while the first request is still running is refused with 409
+
+5xx responses aren't stored, so the request can be retried with the same key.
+Keys are scoped to the actor and kept for IdempotencyKeyTtl.
+Responses are stored in plaintext, so those carrying credentials are never replayed:
+  - anonymous requests (login, signup)
+  - routes marked NotIdempotent, for handlers that answer secrets
+  - any response sent with Cache-Control: no-store
+*/
+
+const (
+	HeaderIdempotencyKey      = "Idempotency-Key"
+	HeaderIdempotentReplayed  = "Idempotent-Replayed"
+	IdempotencyKeyTtl         = time.Hour * 24
+	maxIdempotencyKeyLen      = 255
+	maxIdempotentRequestSize  = 32 * 1024 * 1024
+	maxIdempotentResponseSize = 1024 * 1024
+)
+
+type storedIdempotentResponse struct {
+	requestHash []byte
+	status      *int
+	contentType string
+	response    []byte
+}
+
+// idempotencyRecorder passes the response through while keeping a copy to store
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body.Len()+len(b) > maxIdempotentResponseSize {
+		rec.overflow = true
+	} else if !rec.overflow {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+func idempotencyRequestHash(r *http.Request, body []byte) []byte {
+	hash := sha256.New()
+	// Encode sorts the query by key, reordered arguments are the same request
+	fmt.Fprintf(hash, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.Query().Encode())
+	hash.Write(body)
+	return hash.Sum(nil)
+}
+
+/*
+claimIdempotencyKey reserves the actor's key for this request,
+when another request holds it, that request is returned instead
+*/
+func claimIdempotencyKey(connPool *pgxpool.Pool, r *http.Request, actor string, key string, hash []byte) (bool, storedIdempotentResponse, error) {
+	var stored storedIdempotentResponse
+	_, err := connPool.Exec(context.Background(),
+		"DELETE FROM PUBLIC.idempotency_keys WHERE actor = $1 AND key = $2 AND created_at < $3",
+		actor, key, time.Now().Add(-IdempotencyKeyTtl))
+	if err != nil {
+		return false, stored, err
+	}
+	tag, err := connPool.Exec(context.Background(), `
+		INSERT INTO PUBLIC.idempotency_keys (actor, key, method, path, request_hash)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (actor, key) DO NOTHING
+	`, actor, key, r.Method, r.URL.Path, hash)
+	if err != nil {
+		return false, stored, err
+	}
+	if tag.RowsAffected() == 1 {
+		return true, stored, nil
+	}
+	err = connPool.QueryRow(context.Background(), `
+		SELECT request_hash, status, content_type, COALESCE(response, '')
+		FROM PUBLIC.idempotency_keys
+		WHERE actor = $1 AND key = $2
+	`, actor, key).Scan(&stored.requestHash, &stored.status, &stored.contentType, &stored.response)
+	if err == pgx.ErrNoRows {
+		// the holder released the key in between, the client can retry
+		stored.requestHash = hash
+	} else if err != nil {
+		return false, stored, err
+	}
+	return false, stored, nil
+}
+
+func releaseIdempotencyKey(connPool *pgxpool.Pool, actor string, key string) {
+	_, err := connPool.Exec(context.Background(),
+		"DELETE FROM PUBLIC.idempotency_keys WHERE actor = $1 AND key = $2", actor, key)
+	if err != nil {
+		fmt.Println("error releasing idempotency key", err)
+	}
+}
+
+func storeIdempotentResponse(connPool *pgxpool.Pool, actor string, key string, rec *idempotencyRecorder) {
+	_, err := connPool.Exec(context.Background(), `
+		UPDATE PUBLIC.idempotency_keys
+		SET status = $3, content_type = $4, response = $5, completed_at = NOW()
+		WHERE actor = $1 AND key = $2
+	`, actor, key, rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes())
+	if err != nil {
+		fmt.Println("error storing idempotent response", err)
+		releaseIdempotencyKey(connPool, actor, key)
+	}
+}
+
+// noStore reports whether the response forbids keeping a copy of it
+func noStore(header http.Header) bool {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return true
+		}
+	}
+	return false
+}
+
+// IdempotentRequests replays the stored response of authorized mutating requests retried with the same Idempotency-Key
+func IdempotentRequests(next RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		key := r.Header.Get(HeaderIdempotencyKey)
+		actor := RequestActor(r)
+		notIdempotent, _ := r.Context().Value(notIdempotentCtxKey{}).(bool)
+		if key == "" || actor == "anonymous" || notIdempotent ||
+			r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next(w, r, connPool)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			ServeError(w, r, http.StatusBadRequest, "Idempotency-Key must be at most 255 printable ascii characters")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestSize+1))
+		if err != nil {
+			ServeError(w, r, http.StatusBadRequest, "Error reading request body")
+			return
+		}
+		if len(body) > maxIdempotentRequestSize {
+			ServeError(w, r, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := idempotencyRequestHash(r, body)
+
+		claimed, stored, err := claimIdempotencyKey(connPool, r, actor, key, hash)
+		if err != nil {
+			fmt.Println("error claiming idempotency key", err)
+			ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		if !claimed {
+			switch {
+			case !bytes.Equal(stored.requestHash, hash):
+				ServeErrorCode(w, r, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused,
+					"this Idempotency-Key was already used for a different request")
+			case stored.status == nil:
+				ServeErrorCode(w, r, http.StatusConflict, ErrCodeIdempotencyInProgress,
+					"a request with this Idempotency-Key is still being processed")
+			default:
+				if stored.contentType != "" {
+					w.Header().Set("Content-Type", stored.contentType)
+				}
+				w.Header().Set(HeaderIdempotentReplayed, "true")
+				w.WriteHeader(*stored.status)
+				w.Write(stored.response)
+			}
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// a panicking handler leaves no response to replay
+			if !completed {
+				releaseIdempotencyKey(connPool, actor, key)
+			}
+		}()
+		next(rec, r, connPool)
+		completed = true
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError || rec.overflow || noStore(rec.Header()) {
+			releaseIdempotencyKey(connPool, actor, key)
+			return
+		}
+		storeIdempotentResponse(connPool, actor, key, rec)
+	}
+}
+
+// PurgeIdempotencyKeys removes keys that can no longer be replayed
+func PurgeIdempotencyKeys(connPool *pgxpool.Pool) {
+	_, err := connPool.Exec(context.Background(),
+		"DELETE FROM PUBLIC.idempotency_keys WHERE created_at < $1", time.Now().Add(-IdempotencyKeyTtl))
+	if err != nil {
+		fmt.Println("error purging idempotency keys", err)
+		EmailErrorLog("PurgeIdempotencyKeys: Error purging idempotency keys", err.Error())
+	}
+}
@@ -0,0 +1,170 @@
+package qaimservices
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestNoStore(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		want         bool
+	}{
+		{"", false},
+		{"no-store", true},
+		{"private, no-store", true},
+		{"No-Store", true},
+		{"no-cache", false},
+		{"max-age=0, no-store-ish", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		header.Set("Cache-Control", tt.cacheControl)
+		if got := noStore(header); got != tt.want {
+			t.Errorf("noStore(%q) = %v, want %v", tt.cacheControl, got, tt.want)
+		}
+	}
+}
+
+// secretHandler answers a fresh secret on every call, as endpoints handing out tokens do
+func secretHandler(calls *int, cacheControl string) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		*calls++
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Write([]byte("secret " + strconv.Itoa(*calls)))
+	}
+}
+
+func TestNotIdempotentRouteSkipsStore(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "test-key")
+	calls := 0
+	// without a pool, touching the key store would panic
+	router := NewRouter("/admin/", nil)
+	router.UseAuthorized(IdempotentRequests)
+	router.Handle(http.MethodPost, "secrets", secretHandler(&calls, ""), ADMIN).NotIdempotent()
+
+	header := http.Header{"Apikey": {"test-key"}, HeaderIdempotencyKey: {"retry-1"}}
+	for i := 0; i < 2; i++ {
+		rec := serveTest(router, http.MethodPost, "/admin/secrets", header)
+		if rec.Code != http.StatusOK || rec.Header().Get(HeaderIdempotentReplayed) != "" {
+			t.Fatalf("status %d, replayed %q", rec.Code, rec.Header().Get(HeaderIdempotentReplayed))
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want 2", calls)
+	}
+}
+
+func TestNoStoreResponseNotKept(t *testing.T) {
+	connPool := testConnPool(t)
+	t.Setenv("ADMIN_API_KEY", "test-key")
+	calls := 0
+	router := NewRouter("/admin/", connPool)
+	router.UseAuthorized(IdempotentRequests)
+	router.Handle(http.MethodPost, "secrets", secretHandler(&calls, "no-store"), ADMIN)
+
+	key := "test-" + randomHex(t, 8)
+	t.Cleanup(func() {
+		connPool.Exec(context.Background(), "DELETE FROM PUBLIC.idempotency_keys WHERE key = $1", key)
+	})
+	header := http.Header{"Apikey": {"test-key"}, HeaderIdempotencyKey: {key}}
+	for i := 0; i < 2; i++ {
+		rec := serveTest(router, http.MethodPost, "/admin/secrets", header)
+		if rec.Code != http.StatusOK || rec.Header().Get(HeaderIdempotentReplayed) != "" {
+			t.Fatalf("status %d, replayed %q", rec.Code, rec.Header().Get(HeaderIdempotentReplayed))
+		}
+	}
+	var stored int
+	err := connPool.QueryRow(context.Background(), "SELECT COUNT(*) FROM PUBLIC.idempotency_keys WHERE key = $1", key).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || stored != 0 {
+		t.Fatalf("handler ran %d times with %d stored responses, want 2 and 0", calls, stored)
+	}
+}
+
+func TestIdempotencyRequestHash(t *testing.T) {
+	hash := func(method string, target string, body string) []byte {
+		return idempotencyRequestHash(httptest.NewRequest(method, target, nil), []byte(body))
+	}
+	base := hash(http.MethodPost, "/admin/users/role?nationalId=1&role=ADMIN", "")
+	if !bytes.Equal(base, hash(http.MethodPost, "/admin/users/role?role=ADMIN&nationalId=1", "")) {
+		t.Error("reordering the query changed the hash")
+	}
+	for _, other := range [][]byte{
+		hash(http.MethodPost, "/admin/users/role?nationalId=2&role=ADMIN", ""),
+		hash(http.MethodPost, "/admin/users/role?nationalId=1", ""),
+		hash(http.MethodPost, "/admin/users/role", "nationalId=1&role=ADMIN"),
+		hash(http.MethodPut, "/admin/users/role?nationalId=1&role=ADMIN", ""),
+		hash(http.MethodPost, "/admin/users/verify?nationalId=1&role=ADMIN", ""),
+	} {
+		if bytes.Equal(base, other) {
+			t.Error("a different request has the same hash")
+		}
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	connPool := testConnPool(t)
+	t.Setenv("ADMIN_API_KEY", "test-key")
+	calls := 0
+	router := NewRouter("/admin/", connPool)
+	router.UseAuthorized(IdempotentRequests)
+	router.Handle(http.MethodPost, "users/role", func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("role set " + r.URL.Query().Get("role") + " " + strconv.Itoa(calls)))
+	}, ADMIN)
+
+	key := "test-" + randomHex(t, 8)
+	t.Cleanup(func() {
+		connPool.Exec(context.Background(), "DELETE FROM PUBLIC.idempotency_keys WHERE key = $1", key)
+	})
+	serve := func(target string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewBufferString(body))
+		req.Header.Set("Apikey", "test-key")
+		req.Header.Set(HeaderIdempotencyKey, key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := serve("/admin/users/role?nationalId=1&role=ADMIN", "")
+	if first.Code != http.StatusCreated || first.Header().Get(HeaderIdempotentReplayed) != "" {
+		t.Fatalf("first request: status %d, replayed %q", first.Code, first.Header().Get(HeaderIdempotentReplayed))
+	}
+	retry := serve("/admin/users/role?role=ADMIN&nationalId=1", "")
+	if retry.Code != http.StatusCreated || retry.Header().Get(HeaderIdempotentReplayed) != "true" ||
+		retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry: status %d, replayed %q, body %q, want the first response replayed",
+			retry.Code, retry.Header().Get(HeaderIdempotentReplayed), retry.Body.String())
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{"other query", "/admin/users/role?nationalId=1&role=USER", ""},
+		{"other query target", "/admin/users/role?nationalId=2&role=ADMIN", ""},
+		{"other body", "/admin/users/role?nationalId=1&role=ADMIN", `{"role":"USER"}`},
+	}
+	for _, tt := range tests {
+		rec := serve(tt.target, tt.body)
+		if rec.Code != http.StatusUnprocessableEntity || !bytes.Contains(rec.Body.Bytes(), []byte(ErrCodeIdempotencyKeyReused)) {
+			t.Errorf("%s: status %d, body %q, want 422 %s", tt.name, rec.Code, rec.Body.String(), ErrCodeIdempotencyKeyReused)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+}
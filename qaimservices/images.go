@@ -0,0 +1,249 @@
+package qaimservices
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+/*
+# ID Card Images
+Uploaded id card images are never stored as sent:
+  - the type is sniffed from the file's magic bytes, the client's Content-Type and filename are ignored
+  - the file is decoded as a real png or jpeg, anything else is rejected
+  - images larger than MaxImageDimension on either side are scaled down to fit
+  - jpeg EXIF orientation is applied, then the image is re-encoded as a jpeg, which drops
+    every metadata segment (EXIF, GPS, comments, color profiles)
+*/
+
+const (
+	MaxImageBytes     = 2 * 1024 * 1024
+	MaxImageDimension = 2048
+	// images with more pixels than this are rejected before decoding, guarding against decompression bombs.
+	// 16mp covers a phone camera's photo of a card, whose RGBA copy still takes 64mb
+	maxImagePixels   = 16_000_000
+	imageJpegQuality = 90
+)
+
+var (
+	ErrImageTooLarge = errors.New("image must be smaller than 2mb")
+	ErrImageFormat   = errors.New("image must be a jpeg or png")
+	ErrImagePixels   = errors.New("image dimensions are too large")
+)
+
+// NormalizeImage reads an uploaded png or jpeg and returns it re-encoded as a jpeg without metadata
+func NormalizeImage(file multipart.File, header *multipart.FileHeader) ([]byte, error) {
+	if header.Size > MaxImageBytes {
+		return nil, ErrImageTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(file, MaxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxImageBytes {
+		return nil, ErrImageTooLarge
+	}
+	return NormalizeImageBytes(data)
+}
+
+// NormalizeImageBytes is NormalizeImage for an image already in memory
+func NormalizeImageBytes(data []byte) ([]byte, error) {
+	var decodeConfig func(io.Reader) (image.Config, error)
+	var decode func(io.Reader) (image.Image, error)
+	switch http.DetectContentType(data) {
+	case ContentPng:
+		decodeConfig, decode = png.DecodeConfig, png.Decode
+	case ContentJpeg:
+		decodeConfig, decode = jpeg.DecodeConfig, jpeg.Decode
+	default:
+		return nil, ErrImageFormat
+	}
+	config, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageFormat
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, ErrImagePixels
+	}
+	src, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageFormat
+	}
+
+	// flatten onto white, jpegs have no transparency
+	bounds := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Over)
+
+	// scaled before it is rotated, so the rotation copies the small image rather than the full one
+	img = fitImage(img, MaxImageDimension)
+	img = orientImage(img, jpegOrientation(data))
+
+	var out bytes.Buffer
+	err = jpeg.Encode(&out, img, &jpeg.Options{Quality: imageJpegQuality})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+/*
+jpegOrientation reads the EXIF orientation tag of a jpeg,
+returning 1 (no transformation) when there is none
+*/
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// start of scan, the metadata segments are all behind us
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		segLen := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if segLen < 2 || pos+2+segLen > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+segLen]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + segLen
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag (0x0112) in the first IFD of a TIFF header
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientImage applies an EXIF orientation, so the image displays upright without its metadata
+func orientImage(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := img.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// fitImage scales img down, keeping its aspect ratio, until neither side exceeds maxDim
+func fitImage(img *image.RGBA, maxDim int) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w <= maxDim && h <= maxDim {
+		return img
+	}
+	dw, dh := maxDim, h*maxDim/w
+	if h > w {
+		dw, dh = w*maxDim/h, maxDim
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	// box filter, every destination pixel averages the source pixels it covers
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*h/dh, (dy+1)*h/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*w/dw, (dx+1)*w/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := img.PixOffset(x0, y)
+				for x := x0; x < x1; x++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(img.Pix[row+c])
+					}
+					row += 4
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			di := dst.PixOffset(dx, dy)
+			for c := 0; c < 4; c++ {
+				dst.Pix[di+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return dst
+}
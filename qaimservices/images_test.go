@@ -0,0 +1,221 @@
+package qaimservices
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage is a w by h image, red on the left half and blue on the right, so rotations can be told apart
+func testImage(w int, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeTestPng(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// exifTiff is a little endian TIFF header whose first IFD holds only the orientation tag
+func exifTiff(orientation uint16) []byte {
+	tiff := []byte("II*\x00")
+	tiff = binary.LittleEndian.AppendUint32(tiff, 8)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	// tag, type SHORT, count 1, value padded to 4 bytes
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	return binary.LittleEndian.AppendUint32(tiff, 0)
+}
+
+// jpegWithExif encodes img as a jpeg with an APP1 EXIF segment (orientation and a fake gps note) after SOI
+func jpegWithExif(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	payload := append([]byte("Exif\x00\x00"), exifTiff(orientation)...)
+	payload = append(payload, []byte("GPS 33.6844N 73.0479E")...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	out := append([]byte{}, encoded[:2]...)
+	out = append(out, segment...)
+	return append(out, encoded[2:]...)
+}
+
+// pngClaiming is a 1x1 png whose header claims w by h pixels
+func pngClaiming(t *testing.T, w uint32, h uint32) []byte {
+	t.Helper()
+	data := encodeTestPng(t, testImage(1, 1))
+	// signature (8) | IHDR length (4) | "IHDR" (4) | width | height | ... | crc over type and data
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func decodeNormalized(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		t.Fatal("normalized image is not a jpeg")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestNormalizeImageBytesRejects(t *testing.T) {
+	jpegData := jpegWithExif(t, testImage(16, 16), 1)
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrImageFormat},
+		{"text", []byte("not an image at all"), ErrImageFormat},
+		{"html", []byte("<html><body>hi</body></html>"), ErrImageFormat},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"), ErrImageFormat},
+		{"png magic only", []byte("\x89PNG\r\n\x1a\n"), ErrImageFormat},
+		{"truncated jpeg", jpegData[:len(jpegData)/2], ErrImageFormat},
+		{"decompression bomb", pngClaiming(t, 5000, 4000), ErrImagePixels},
+		{"zero width", pngClaiming(t, 0, 10), ErrImageFormat},
+	}
+	for _, tt := range tests {
+		out, err := NormalizeImageBytes(tt.data)
+		if err != tt.err || out != nil {
+			t.Errorf("%s: got %d bytes, %v, want %v", tt.name, len(out), err, tt.err)
+		}
+	}
+}
+
+func TestNormalizeImageBytesStripsExif(t *testing.T) {
+	// orientation 6: the stored image is displayed turned 90° clockwise
+	data := jpegWithExif(t, testImage(40, 20), 6)
+	if jpegOrientation(data) != 6 {
+		t.Fatalf("test jpeg orientation %d, want 6", jpegOrientation(data))
+	}
+	out, err := NormalizeImageBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte("GPS")) {
+		t.Fatal("metadata survived normalization")
+	}
+	if jpegOrientation(out) != 1 {
+		t.Fatal("normalized image still carries an orientation")
+	}
+	img := decodeNormalized(t, out)
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("oriented image is %dx%d, want 20x40", b.Dx(), b.Dy())
+	}
+	// the red left half ends up on top
+	if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+		t.Fatal("image was not rotated clockwise")
+	}
+}
+
+func TestNormalizeImageBytesFitsCaps(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		w, h int
+	}{
+		{"small png", encodeTestPng(t, testImage(300, 200)), 300, 200},
+		{"wide png", encodeTestPng(t, testImage(4096, 1024)), MaxImageDimension, 512},
+		{"tall rotated jpeg", jpegWithExif(t, testImage(1024, 4096), 6), MaxImageDimension, 512},
+	}
+	for _, tt := range tests {
+		out, err := NormalizeImageBytes(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(out) > MaxImageBytes {
+			t.Errorf("%s: normalized to %d bytes, over the %d byte cap", tt.name, len(out), MaxImageBytes)
+		}
+		if b := decodeNormalized(t, out).Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("%s: normalized to %dx%d, want %dx%d", tt.name, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+	}
+}
+
+func TestJpegOrientationTruncated(t *testing.T) {
+	data := jpegWithExif(t, testImage(8, 8), 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("jpegOrientation = %d, want 6", got)
+	}
+	// every prefix either still reaches the tag or gives up with 1, none may panic
+	for n := 0; n < len(data); n++ {
+		if got := jpegOrientation(data[:n]); got != 1 && got != 6 {
+			t.Fatalf("jpegOrientation of %d bytes = %d", n, got)
+		}
+	}
+	for _, data := range [][]byte{nil, {0xFF}, {0xFF, 0xD8}, {0xFF, 0xD8, 0xFF, 0xE1, 0x00}, {0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}} {
+		if got := jpegOrientation(data); got != 1 {
+			t.Errorf("jpegOrientation(%x) = %d, want 1", data, got)
+		}
+	}
+}
+
+func TestExifOrientationTruncated(t *testing.T) {
+	tiff := exifTiff(8)
+	if got := exifOrientation(tiff); got != 8 {
+		t.Fatalf("exifOrientation = %d, want 8", got)
+	}
+	for n := 0; n < len(tiff); n++ {
+		if got := exifOrientation(tiff[:n]); got != 1 && got != 8 {
+			t.Fatalf("exifOrientation of %d bytes = %d", n, got)
+		}
+	}
+
+	bigEndian := []byte("MM\x00*\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x03\x00\x00")
+	huge := exifTiff(6)
+	binary.LittleEndian.PutUint32(huge[4:], 0xFFFFFFF0)
+	manyEntries := exifTiff(6)
+	// claims 65535 entries, and the one there isn't the orientation tag
+	binary.LittleEndian.PutUint16(manyEntries[8:], 0xFFFF)
+	manyEntries[10] = 0
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"big endian", bigEndian, 3},
+		{"out of range value", exifTiff(9), 1},
+		{"zero value", exifTiff(0), 1},
+		{"unknown byte order", append([]byte("XX*\x00"), exifTiff(6)[4:]...), 1},
+		{"ifd offset past the end", huge, 1},
+		{"ifd offset inside the header", append(append([]byte("II*\x00"), 4, 0, 0, 0), exifTiff(6)[8:]...), 1},
+		{"entry count past the end", manyEntries, 1},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,13 +1,10 @@
 package qaimservices
 
 import (
-	"crypto"
-	"crypto/hmac"
 	b64 "encoding/base64"
 	json "encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 	"time"
 )
@@ -15,20 +12,75 @@ import (
 type Role uint
 
 const (
-	NONE           = iota
-	SUPERUSER Role = 1 + iota // Superuser, can create and manage admins
-	ADMIN                     // Admin User, can access admin functions only
-	USER                      // User is the normal user of the application
-	USER_SECP                 // User for the secp sandbox phase
-	USER_BETA                 // Beta test user
+	NONE                = iota
+	SUPERUSER      Role = 1 + iota // Superuser, can create and manage admins
+	ADMIN                          // Admin User, can access admin functions only
+	USER                           // User is the normal user of the application
+	USER_SECP                      // User for the secp sandbox phase
+	USER_BETA                      // Beta test user
+	USER_APPLICANT                 // Signed up user whose kyc is not approved, can only reach the kyc endpoints
 )
 
+// roleImplies lists the roles each role is granted on top of its own
+var roleImplies = map[Role][]Role{
+	SUPERUSER: {ADMIN},
+	USER_SECP: {USER},
+	USER_BETA: {USER},
+}
+
+// Implies reports if a holder of role may act as other, following the role hierarchy
+func (role Role) Implies(other Role) bool {
+	if role == other {
+		return true
+	}
+	for _, parent := range roleImplies[role] {
+		if parent.Implies(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleAllowed reports if role satisfies any of the allowed roles
+func RoleAllowed(role Role, allowedRoles []Role) bool {
+	for _, allowed := range allowedRoles {
+		if role.Implies(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// * Sandbox limits, applied to callers with a sandbox role
+const (
+	SandboxMaxInvestment = 5000
+	SandboxMaxWithdrawal = 5000
+)
+
+// IsSandboxRole reports if role is restricted to sandbox limits (secp sandbox and beta users)
+func IsSandboxRole(role Role) bool {
+	return role == USER_SECP || role == USER_BETA
+}
+
+// ParseUserRole maps the role names used by the admin api to application user roles
+func ParseUserRole(name string) (Role, bool) {
+	switch name {
+	case "user":
+		return USER, true
+	case "secp":
+		return USER_SECP, true
+	case "beta":
+		return USER_BETA, true
+	}
+	return NONE, false
+}
+
 /*
-TODO: Once basic implementation is done, move from a secret based signing approach to a pub/private key approach
 # JWT Setup
 Header: {
-(Algorithm) alg: algorithm used to sign token
+(Algorithm) alg: algorithm used to sign token, RS256 | EdDSA | HS256 (legacy)
 (type) typ: type of token, ALWAYS jwt
+(Key Id) kid: id of the key used to sign the token, see jwtkeys.go
 }
 
 	Payload: {
@@ -37,23 +89,28 @@ Header: {
 		(Audience) aud: Intended audience, for our case this can be (ADMIN, User, SandboxUser ... ${UserRole}{UserType})
 		(Expiry) exp: timestamp after which tokens should not be accepted
 		(Issued at) iat: token issuing date
+		(JWT Id) jti: unique token id, checked against the revocation list in public.access_tokens
+		(Authentication Methods) amr: how the session was authenticated, pwd and otp (RFC 8176)
 	}
 
 	Signature: {
-		sign(b64Header + b64Payload + My_Secret_Key)
+		sign(b64Header + "." + b64Payload, Signing_Key)
 	}
 */
 type JwtHeader struct {
-	Alg string `json:"alg"` // (Algorithm) alg: algorithm used to sign token
-	Typ string `json:"typ"` // (type) typ: type of token, ALWAYS jwt
+	Alg string `json:"alg"`           // (Algorithm) alg: algorithm used to sign token
+	Typ string `json:"typ"`           // (type) typ: type of token, ALWAYS jwt
+	Kid string `json:"kid,omitempty"` // (Key Id) kid: id of the key used to sign the token
 }
 
 type JwtPayload struct {
-	Iss string `json:"iss"` // (Issuer) iss: entity to generate and issue web token
-	Sub string `json:"sub"` // (Subject) sub: entity token is issued to, user id here
-	Aud Role   `json:"aud"` // (Audience) aud: Intended audience, for our case this can be (ADMIN, User, SandboxUser ... ${UserRole}{UserType})
-	Exp int64  `json:"exp"` // (Expiry) exp: timestamp after which tokens should not be accepted
-	Iat int64  `json:"iat"` // (Issued at) iat: token issuing date
+	Iss string   `json:"iss"`           // (Issuer) iss: entity to generate and issue web token
+	Sub string   `json:"sub"`           // (Subject) sub: entity token is issued to, user id here
+	Aud Role     `json:"aud"`           // (Audience) aud: Intended audience, for our case this can be (ADMIN, User, SandboxUser ... ${UserRole}{UserType})
+	Exp int64    `json:"exp"`           // (Expiry) exp: timestamp after which tokens should not be accepted
+	Iat int64    `json:"iat"`           // (Issued at) iat: token issuing date
+	Jti string   `json:"jti"`           // (JWT Id) jti: unique token id, used to revoke the token
+	Amr []string `json:"amr,omitempty"` // (Authentication Methods) amr: how the session was authenticated
 }
 
 type JwtToken struct {
@@ -68,24 +125,28 @@ type JwtToken struct {
 CreateJwtToken creates a b64encoded signed token
 @param sub the subject (Unique User Id) for the token
 @param aud the audience (User Role) for the token, used for restricting certain endpoints
+@param amr the authentication methods of the session, see RequireMfa
 */
-func CreateJwtToken(userIdentifier string, userType Role) (JwtToken, error) {
+func CreateJwtToken(userIdentifier string, userType Role, amr []string) (JwtToken, error) {
 	var issueTime time.Time = time.Now()
-	var hashFunc crypto.Hash
 	var t JwtToken
+	var err error
+	if jwtKeys == nil {
+		return t, errors.New("jwt keys have not been loaded")
+	}
+	signingKey := jwtKeys.signing
 	t.Header.Typ = "jwt"
+	t.Header.Alg = signingKey.Alg
+	t.Header.Kid = signingKey.Kid
 	t.Payload.Sub = userIdentifier
 	t.Payload.Aud = userType
 	t.Payload.Iss = "qaim"
 	t.Payload.Iat = issueTime.Unix()
-	t.Payload.Exp = issueTime.Add(time.Minute * 30).Unix()
-	if crypto.SHA256.Available() {
-		hashFunc = crypto.SHA256
-		t.Header.Alg = "HS256"
-	} else {
-		fmt.Println("User has no hash func")
-		calcErr := errors.New("auth server does not support required hash function")
-		return t, calcErr
+	t.Payload.Exp = issueTime.Add(AccessTokenTtl).Unix()
+	t.Payload.Amr = amr
+	t.Payload.Jti, err = NewUuid()
+	if err != nil {
+		return t, err
 	}
 	// encode header
 	jwt_header_b, err := json.Marshal(t.Header)
@@ -99,19 +160,14 @@ func CreateJwtToken(userIdentifier string, userType Role) (JwtToken, error) {
 		fmt.Println("error signing token:", err)
 	}
 	t.B64Payload = b64.RawURLEncoding.EncodeToString(jwt_payload_b)
-	// sign(eh,ep,sig)
-	// using Hmac + Sha(256/224)
-	secret := os.Getenv("JWTSECRET")
+	// sign(eh,ep) with the active signing key
 	encodedBody := t.B64Header + "." + t.B64Payload
-	hmacFunc := hmac.New(hashFunc.New, []byte(secret))
-	_, err = hmacFunc.Write([]byte(encodedBody))
+	signature_b, err := signingKey.sign([]byte(encodedBody))
 	if err != nil {
-		fmt.Println("Error signing jwt token")
-		// TODO: Return err for no sign
+		fmt.Println("Error signing jwt token", err)
 		calcErr := errors.New("error signing jwt token, check header and payload")
 		return t, calcErr
 	}
-	signature_b := hmacFunc.Sum(nil)
 	b64Signature := b64.RawURLEncoding.EncodeToString(signature_b)
 	t.Token = encodedBody + "." + b64Signature
 	return t, nil
@@ -120,88 +176,94 @@ func CreateJwtToken(userIdentifier string, userType Role) (JwtToken, error) {
 /*
 VerifyJwtToken verifies a signed base64 encoded token
 @param b64Token the signed base64 token to verify
+@param allowedRoles the token's audience must imply at least one of these roles
+*/
+func VerifyJwtToken(b64Token string, allowedRoles ...Role) bool {
+	payload, ok := ParseJwtToken(b64Token)
+	if !ok {
+		return false
+	}
+	return RoleAllowed(payload.Aud, allowedRoles)
+}
+
+/*
+ParseJwtToken verifies the signature, expiry and revocation status of a signed
+base64 encoded token and returns its payload
 */
-func VerifyJwtToken(b64Token string, userType Role) bool {
+func ParseJwtToken(b64Token string) (JwtPayload, bool) {
 	var t JwtToken
 	t.Token = b64Token
 	splitToken := strings.Split(t.Token, ".")
 	if len(splitToken) < 3 {
 		// err = errors.New("invalid token")
-		return false
+		return t.Payload, false
 	}
 	t.B64Header = splitToken[0]
 	header_b, err := b64.RawURLEncoding.DecodeString(t.B64Header)
 	if err != nil {
-		return false
+		return t.Payload, false
 	}
 	err = json.Unmarshal(header_b, &t.Header)
 	if err != nil {
-		return false
+		return t.Payload, false
 	}
 	t.B64Payload = splitToken[1]
 	payload_b, err := b64.RawURLEncoding.DecodeString(t.B64Payload)
 	if err != nil {
-		return false
+		return t.Payload, false
 	}
 	err = json.Unmarshal(payload_b, &t.Payload)
 	if err != nil {
-		return false
+		return t.Payload, false
 	}
 	signature := splitToken[2]
 	signature_b, err := b64.RawURLEncoding.DecodeString(signature)
 	if err != nil {
-		return false
+		return t.Payload, false
 	}
-	var hashFunc crypto.Hash
-	if t.Header.Alg == "HS256" {
-		hashFunc = crypto.SHA256
-	} else {
-		// err = errors.New("hash function not found")
-		return false
-	}
-	secret := os.Getenv("JWTSECRET")
-	hmacFunc := hmac.New(hashFunc.New, []byte(secret))
 	encodedBody := t.B64Header + "." + t.B64Payload
-	_, err = hmacFunc.Write([]byte(encodedBody))
-	if err != nil {
-		return false
-	}
-	genSign := hmacFunc.Sum(nil)
 
-	// * STEP 1: verify jwt token
-	eq := hmac.Equal(signature_b, genSign)
-	if !eq {
+	// * STEP 1: verify jwt token against every configured key
+	if !verifyJwtSignature(t.Header, []byte(encodedBody), signature_b) {
 		// err = errors.New("invalid token")
-		return false
+		return t.Payload, false
 	}
 
-	// * STEP 2: verify user role
-	if t.Payload.Aud != userType {
-		// err = errors.New("invalid token")
-		return false
+	// * STEP 2: check if token expired
+	unixTs := time.Now().Unix()
+	if unixTs > t.Payload.Exp {
+		return t.Payload, false
 	}
 
-	// * STEP 3: check if token expired
-	unixTs := time.Now().Unix()
-	return unixTs <= t.Payload.Exp
+	// * STEP 3: check token has not been revoked
+	return t.Payload, !IsJtiRevoked(t.Payload.Jti)
 }
 
 func GetJwtSubject(b64Token string) (string, error) {
+	payload, err := GetJwtPayload(b64Token)
+	return payload.Sub, err
+}
+
+/*
+GetJwtPayload decodes the payload of a token WITHOUT verifying it,
+only use on tokens that have already passed VerifyJwtToken
+*/
+func GetJwtPayload(b64Token string) (JwtPayload, error) {
 	var t JwtToken
 	t.Token = b64Token
 	splitToken := strings.Split(t.Token, ".")
 	if len(splitToken) < 3 {
 		err := errors.New("invalid token")
-		return "", err
+		return t.Payload, err
 	}
 	t.B64Payload = splitToken[1]
 	payload_b, err := b64.RawURLEncoding.DecodeString(t.B64Payload)
 	if err != nil {
-		return "", err
+		return t.Payload, err
 	}
 	err = json.Unmarshal(payload_b, &t.Payload)
 	if err != nil {
-		return "", err
+		return t.Payload, err
 	}
-	return t.Payload.Sub, nil
+	return t.Payload, nil
 }
@@ -0,0 +1,223 @@
+package qaimservices
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	qs "qaimbe/qaimstructs"
+	"strings"
+)
+
+/*
+# JWT Keys
+Keys are configured through the environment:
+  - JWT_SIGNING_KEY: "<kid>:<path to pem private key>", the key new tokens are signed with.
+    Supports RSA (RS256) and Ed25519 (EdDSA) keys in PKCS1/PKCS8 form.
+  - JWT_VERIFY_KEYS: comma separated "<kid>:<path to pem key>" list of retired keys
+    that are still accepted for verification, so keys can be rotated without logging users out.
+  - JWTSECRET: legacy HS256 secret, used for signing only when JWT_SIGNING_KEY is not set,
+    and otherwise still accepted for verification.
+
+Public halves of the asymmetric keys are published at /.well-known/jwks.json
+*/
+
+const (
+	JwtAlgHS256 = "HS256"
+	JwtAlgRS256 = "RS256"
+	JwtAlgEdDSA = "EdDSA"
+)
+
+const jwtLegacyKid = "hs256-legacy"
+
+type jwtKey struct {
+	Kid     string
+	Alg     string
+	secret  []byte
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+type jwtKeyRing struct {
+	signing *jwtKey
+	keys    []*jwtKey
+}
+
+var jwtKeys *jwtKeyRing
+
+/*
+LoadJwtKeys reads the signing and verification keys from the environment,
+it must be called before any token is created or verified
+*/
+func LoadJwtKeys() error {
+	ring := &jwtKeyRing{}
+	signingCfg := os.Getenv("JWT_SIGNING_KEY")
+	if signingCfg != "" {
+		key, err := loadJwtKeyFile(signingCfg)
+		if err != nil {
+			return fmt.Errorf("JWT_SIGNING_KEY: %w", err)
+		}
+		if key.private == nil {
+			return errors.New("JWT_SIGNING_KEY: a private key is required for signing")
+		}
+		ring.signing = key
+		ring.keys = append(ring.keys, key)
+	}
+	verifyCfg := os.Getenv("JWT_VERIFY_KEYS")
+	if verifyCfg != "" {
+		for _, entry := range strings.Split(verifyCfg, ",") {
+			key, err := loadJwtKeyFile(strings.TrimSpace(entry))
+			if err != nil {
+				return fmt.Errorf("JWT_VERIFY_KEYS: %w", err)
+			}
+			ring.keys = append(ring.keys, key)
+		}
+	}
+	secret := os.Getenv("JWTSECRET")
+	if secret != "" {
+		legacy := &jwtKey{Kid: jwtLegacyKid, Alg: JwtAlgHS256, secret: []byte(secret)}
+		if ring.signing == nil {
+			ring.signing = legacy
+		}
+		ring.keys = append(ring.keys, legacy)
+	}
+	if ring.signing == nil {
+		return errors.New("no jwt signing key configured, set JWT_SIGNING_KEY or JWTSECRET")
+	}
+	jwtKeys = ring
+	return nil
+}
+
+func loadJwtKeyFile(cfg string) (*jwtKey, error) {
+	sepInd := strings.Index(cfg, ":")
+	if sepInd <= 0 {
+		return nil, fmt.Errorf("invalid key config %q, expected <kid>:<path>", cfg)
+	}
+	kid := cfg[:sepInd]
+	pemBytes, err := os.ReadFile(cfg[sepInd+1:])
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("key %s is not pem encoded", kid)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key %s has unsupported pem type %s", kid, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", kid, err)
+	}
+
+	key := &jwtKey{Kid: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Alg, key.private, key.public = JwtAlgRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Alg, key.public = JwtAlgRS256, k
+	case ed25519.PrivateKey:
+		key.Alg, key.private, key.public = JwtAlgEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Alg, key.public = JwtAlgEdDSA, k
+	default:
+		return nil, fmt.Errorf("key %s must be an RSA or Ed25519 key", kid)
+	}
+	return key, nil
+}
+
+func (k *jwtKey) sign(body []byte) ([]byte, error) {
+	switch k.Alg {
+	case JwtAlgHS256:
+		hmacFunc := hmac.New(crypto.SHA256.New, k.secret)
+		hmacFunc.Write(body)
+		return hmacFunc.Sum(nil), nil
+	case JwtAlgRS256:
+		hashFunc := crypto.SHA256.New()
+		hashFunc.Write(body)
+		return k.private.Sign(rand.Reader, hashFunc.Sum(nil), crypto.SHA256)
+	case JwtAlgEdDSA:
+		return k.private.Sign(rand.Reader, body, crypto.Hash(0))
+	}
+	return nil, errors.New("unsupported jwt algorithm " + k.Alg)
+}
+
+func (k *jwtKey) verify(body []byte, signature []byte) bool {
+	switch k.Alg {
+	case JwtAlgHS256:
+		expected, _ := k.sign(body)
+		return hmac.Equal(signature, expected)
+	case JwtAlgRS256:
+		hashFunc := crypto.SHA256.New()
+		hashFunc.Write(body)
+		return rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, hashFunc.Sum(nil), signature) == nil
+	case JwtAlgEdDSA:
+		return ed25519.Verify(k.public.(ed25519.PublicKey), body, signature)
+	}
+	return false
+}
+
+/*
+verifyJwtSignature tries every configured key for the token's algorithm,
+starting with the key named in the header's kid
+*/
+func verifyJwtSignature(header JwtHeader, body []byte, signature []byte) bool {
+	if jwtKeys == nil {
+		return false
+	}
+	for _, key := range jwtKeys.keys {
+		if key.Alg == header.Alg && key.Kid == header.Kid && key.verify(body, signature) {
+			return true
+		}
+	}
+	for _, key := range jwtKeys.keys {
+		if key.Alg == header.Alg && key.Kid != header.Kid && key.verify(body, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// JwksDocument returns the public signing keys in JSON Web Key Set format
+func JwksDocument() qs.Jwks {
+	jwks := qs.Jwks{Keys: []qs.Jwk{}}
+	if jwtKeys == nil {
+		return jwks
+	}
+	for _, key := range jwtKeys.keys {
+		jwk := qs.Jwk{Kid: key.Kid, Alg: key.Alg, Use: "sig"}
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = b64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = b64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = b64.RawURLEncoding.EncodeToString(pub)
+		default:
+			// symmetric keys are never published
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
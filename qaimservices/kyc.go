@@ -0,0 +1,148 @@
+package qaimservices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	qs "qaimbe/qaimstructs"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# KYC Review
+A signup starts as a pending kyc application, reviewers move it on:
+
+	pending -> approved | rejected | resubmission_requested
+	resubmission_requested -> pending (the user uploaded new documents) | rejected
+	rejected -> resubmission_requested
+
+Approved is final. Every transition is recorded in public.kyc_reviews and the user is
+notified in app, the notifier list gets an email.
+Until approved the user logs in with the USER_APPLICANT role, which only opens the kyc endpoints
+*/
+
+const (
+	KycPending               = "pending"
+	KycApproved              = "approved"
+	KycRejected              = "rejected"
+	KycResubmissionRequested = "resubmission_requested"
+)
+
+const SubjKycTransition = "Notification: KYC Application Updated"
+
+var kycTransitions = map[string][]string{
+	KycPending:               {KycApproved, KycRejected, KycResubmissionRequested},
+	KycResubmissionRequested: {KycPending, KycRejected},
+	KycRejected:              {KycResubmissionRequested},
+}
+
+var ErrKycTransition = errors.New("kyc application can't move to this status")
+
+// kycUserMessages are the in app notifications sent on entering each status
+var kycUserMessages = map[string]string{
+	KycPending:               "We received your documents, verification may take 1-2 days",
+	KycApproved:              "Your identity has been verified, you can now start investing",
+	KycRejected:              "Your application was rejected",
+	KycResubmissionRequested: "Please upload your id card images again",
+}
+
+func ValidateKycStatus(status string) bool {
+	_, ok := kycUserMessages[status]
+	return ok
+}
+
+func KycTransitionAllowed(from string, to string) bool {
+	for _, allowed := range kycTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// KycReasonRequired reports if moving to status needs a reason the user can act on
+func KycReasonRequired(status string) bool {
+	return status == KycRejected || status == KycResubmissionRequested
+}
+
+/*
+TransitionKyc moves the user's kyc application to status inside tx, returning the status it left
+@param reviewerId empty for transitions made by the user
+Returns pgx.ErrNoRows for unknown users and ErrKycTransition when the move isn't allowed
+*/
+func TransitionKyc(tx pgx.Tx, userId string, to string, reviewerId string, reason string) (string, error) {
+	var from string
+	err := tx.QueryRow(context.TODO(),
+		"SELECT kyc_status FROM PUBLIC.user WHERE uuid = $1 FOR UPDATE", userId).Scan(&from)
+	if err != nil {
+		return "", err
+	}
+	if !KycTransitionAllowed(from, to) {
+		return from, ErrKycTransition
+	}
+	_, err = tx.Exec(context.TODO(),
+		"UPDATE PUBLIC.user SET kyc_status = $2, verified = ($2 = 'approved') WHERE uuid = $1", userId, to)
+	if err != nil {
+		return from, err
+	}
+	_, err = tx.Exec(context.TODO(), `
+		INSERT INTO PUBLIC.kyc_reviews (user_id, from_status, to_status, reviewer_id, reason)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5)
+	`, userId, from, to, reviewerId, reason)
+	if err != nil {
+		return from, err
+	}
+	message := kycUserMessages[to]
+	if reason != "" {
+		message += ": " + reason
+	}
+	return from, NotifyUser(tx, userId, "kyc_"+to, message)
+}
+
+// NotifyKycTransition emails the notifier list about a kyc transition
+func NotifyKycTransition(connPool *pgxpool.Pool, userId string, from string, to string, reviewerId string, reason string) {
+	if reviewerId == "" {
+		reviewerId = "user"
+	}
+	message := fmt.Sprintf("User: %s\nStatus: %s -> %s\nBy: %s\nReason: %s", userId, from, to, reviewerId, reason)
+	SendEmailString(MailRecipients(connPool, MailUserNotifier, ""), SubjKycTransition, message)
+}
+
+// GetKycApplication returns the user's kyc status together with its review history, oldest first
+func GetKycApplication(connPool *pgxpool.Pool, userId string) (qs.KycApplication, error) {
+	application := qs.KycApplication{UserId: userId, Reviews: []qs.KycReview{}}
+	err := connPool.QueryRow(context.Background(),
+		"SELECT kyc_status, created_at FROM PUBLIC.user WHERE uuid = $1", userId).Scan(&application.Status, &application.UpdatedAt)
+	if err != nil {
+		return application, err
+	}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT id, from_status, to_status, COALESCE(reviewer_id, ''), reason, created_at
+		FROM PUBLIC.kyc_reviews
+		WHERE user_id = $1
+		ORDER BY id
+	`, userId)
+	if err != nil {
+		return application, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var review qs.KycReview
+		err = rows.Scan(&review.Id, &review.FromStatus, &review.ToStatus, &review.ReviewerId, &review.Reason, &review.CreatedAt)
+		if err != nil {
+			return application, err
+		}
+		application.Reviews = append(application.Reviews, review)
+	}
+	if err = rows.Err(); err != nil {
+		return application, err
+	}
+	if len(application.Reviews) > 0 {
+		latest := application.Reviews[len(application.Reviews)-1]
+		application.Reason = latest.Reason
+		application.UpdatedAt = latest.CreatedAt
+	}
+	return application, nil
+}
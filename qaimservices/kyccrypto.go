@@ -0,0 +1,289 @@
+package qaimservices
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# KYC Document Encryption
+ID card images are encrypted before they reach the object store (envelope encryption):
+  - every object gets a random AES-256 data key, the image is sealed with AES-GCM under it
+  - the data key is wrapped (AES-GCM) by the master key and stored in the object's header
+    together with the master key's id, the user's id_key_id column records it as well
+
+Master keys are configured through the environment:
+  - KYC_MASTER_KEY: "<kid>:<base64 32 byte key>", the key new documents are wrapped with
+  - KYC_RETIRED_MASTER_KEYS: comma separated "<kid>:<base64 key>" list of old keys, still
+    used to open documents until RotateKycEncryption has re-encrypted them
+
+Objects without the header are legacy plaintext uploads, they are opened as is and
+encrypted by the next rotation run.
+Without KYC_MASTER_KEY the local environment stores documents unencrypted, every other
+environment refuses to start
+*/
+
+var kycMagic = []byte("QKYC\x01")
+
+const kycRotationBatch = 100
+
+type kycKeyRing struct {
+	current *kycMasterKey
+	keys    map[string]*kycMasterKey
+}
+
+type kycMasterKey struct {
+	Kid  string
+	aead cipher.AEAD
+}
+
+var kycKeys = &kycKeyRing{keys: map[string]*kycMasterKey{}}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseKycMasterKey(cfg string) (*kycMasterKey, error) {
+	sepInd := strings.Index(cfg, ":")
+	if sepInd <= 0 || sepInd > 255 {
+		return nil, fmt.Errorf("invalid key config, expected <kid>:<base64 key>")
+	}
+	kid := cfg[:sepInd]
+	key, err := b64.StdEncoding.DecodeString(cfg[sepInd+1:])
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", kid, err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key %s must be 32 bytes", kid)
+	}
+	aead, err := newGcm(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", kid, err)
+	}
+	return &kycMasterKey{Kid: kid, aead: aead}, nil
+}
+
+// LoadKycKeys reads the master keys from the environment
+func LoadKycKeys(env string) error {
+	ring := &kycKeyRing{keys: map[string]*kycMasterKey{}}
+	currentCfg := os.Getenv("KYC_MASTER_KEY")
+	if currentCfg != "" {
+		key, err := parseKycMasterKey(currentCfg)
+		if err != nil {
+			return fmt.Errorf("KYC_MASTER_KEY: %w", err)
+		}
+		ring.current = key
+		ring.keys[key.Kid] = key
+	} else if env != EnvLocal {
+		return errors.New("KYC_MASTER_KEY is required to store kyc documents")
+	} else {
+		fmt.Println("warning: KYC_MASTER_KEY not set, kyc documents are stored unencrypted")
+	}
+	retiredCfg := os.Getenv("KYC_RETIRED_MASTER_KEYS")
+	if retiredCfg != "" {
+		for _, entry := range strings.Split(retiredCfg, ",") {
+			key, err := parseKycMasterKey(strings.TrimSpace(entry))
+			if err != nil {
+				return fmt.Errorf("KYC_RETIRED_MASTER_KEYS: %w", err)
+			}
+			if _, ok := ring.keys[key.Kid]; !ok {
+				ring.keys[key.Kid] = key
+			}
+		}
+	}
+	kycKeys = ring
+	return nil
+}
+
+/*
+SealKycDocument encrypts a document stored under objectKey,
+returning the sealed object and the id of the master key that wrapped its data key.
+The kid is empty, and the document returned as is, when no master key is configured
+*/
+func SealKycDocument(objectKey string, plaintext []byte) ([]byte, string, error) {
+	master := kycKeys.current
+	if master == nil {
+		return plaintext, "", nil
+	}
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	dataAead, err := newGcm(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	wrapNonce := make([]byte, master.aead.NonceSize())
+	_, err = rand.Read(wrapNonce)
+	if err != nil {
+		return nil, "", err
+	}
+	wrappedKey := master.aead.Seal(wrapNonce, wrapNonce, dataKey, []byte(master.Kid))
+
+	dataNonce := make([]byte, dataAead.NonceSize())
+	_, err = rand.Read(dataNonce)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// magic | kid len | kid | wrapped key len | wrapped key | data nonce | ciphertext
+	var sealed bytes.Buffer
+	sealed.Write(kycMagic)
+	sealed.WriteByte(byte(len(master.Kid)))
+	sealed.WriteString(master.Kid)
+	binary.Write(&sealed, binary.BigEndian, uint16(len(wrappedKey)))
+	sealed.Write(wrappedKey)
+	sealed.Write(dataNonce)
+	// the object key is authenticated, so a sealed document can't be swapped for another user's
+	sealed.Write(dataAead.Seal(nil, dataNonce, plaintext, []byte(objectKey)))
+	return sealed.Bytes(), master.Kid, nil
+}
+
+// OpenKycDocument decrypts a document sealed by SealKycDocument, legacy plaintext is returned as is
+func OpenKycDocument(objectKey string, sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, kycMagic) {
+		return sealed, nil
+	}
+	errCorrupt := errors.New("kyc document is corrupt")
+	rest := sealed[len(kycMagic):]
+	if len(rest) < 1 {
+		return nil, errCorrupt
+	}
+	kidLen := int(rest[0])
+	rest = rest[1:]
+	if len(rest) < kidLen+2 {
+		return nil, errCorrupt
+	}
+	kid := string(rest[:kidLen])
+	rest = rest[kidLen:]
+	wrappedLen := int(binary.BigEndian.Uint16(rest[:2]))
+	rest = rest[2:]
+	if len(rest) < wrappedLen {
+		return nil, errCorrupt
+	}
+	wrappedKey := rest[:wrappedLen]
+	rest = rest[wrappedLen:]
+
+	master, ok := kycKeys.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("kyc master key %s is not configured", kid)
+	}
+	nonceSize := master.aead.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, errCorrupt
+	}
+	dataKey, err := master.aead.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], []byte(kid))
+	if err != nil {
+		return nil, errCorrupt
+	}
+	dataAead, err := newGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < dataAead.NonceSize() {
+		return nil, errCorrupt
+	}
+	plaintext, err := dataAead.Open(nil, rest[:dataAead.NonceSize()], rest[dataAead.NonceSize():], []byte(objectKey))
+	if err != nil {
+		return nil, errCorrupt
+	}
+	return plaintext, nil
+}
+
+// reencryptKycObject opens the object stored under key and seals it again with the current master key
+func reencryptKycObject(key string) error {
+	sealed, err := GetObject(key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := OpenKycDocument(key, sealed)
+	if err != nil {
+		return err
+	}
+	resealed, _, err := SealKycDocument(key, plaintext)
+	if err != nil {
+		return err
+	}
+	return PutObject(key, resealed, ContentOctetStream)
+}
+
+/*
+RotateKycEncryption re-encrypts every user's id card images whose data keys are not
+wrapped by the current master key, legacy plaintext images included.
+Once it has run, the retired master key can be removed from KYC_RETIRED_MASTER_KEYS
+*/
+func RotateKycEncryption(connPool *pgxpool.Pool) {
+	master := kycKeys.current
+	if master == nil {
+		return
+	}
+	// users that fail are skipped for the rest of the run, so one bad object can't stall it
+	failed := []string{}
+	for {
+		rows, err := connPool.Query(context.Background(), `
+			SELECT uuid, id_front, id_back
+			FROM PUBLIC.user
+			WHERE id_key_id IS DISTINCT FROM $1 AND NOT (uuid::TEXT = ANY($2))
+			ORDER BY uuid
+			LIMIT $3
+		`, master.Kid, failed, kycRotationBatch)
+		if err != nil {
+			fmt.Println("error fetching kyc documents to rotate", err)
+			EmailErrorLog("RotateKycEncryption: Error fetching documents", err.Error())
+			return
+		}
+		type userDocs struct{ userId, front, back string }
+		var batch []userDocs
+		for rows.Next() {
+			var docs userDocs
+			err = rows.Scan(&docs.userId, &docs.front, &docs.back)
+			if err != nil {
+				rows.Close()
+				fmt.Println("error scanning kyc documents to rotate", err)
+				EmailErrorLog("RotateKycEncryption: Error scanning documents", err.Error())
+				return
+			}
+			batch = append(batch, docs)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, docs := range batch {
+			err = reencryptKycObject(docs.front)
+			if err == nil {
+				err = reencryptKycObject(docs.back)
+			}
+			if err == nil {
+				_, err = connPool.Exec(context.Background(),
+					"UPDATE PUBLIC.user SET id_key_id = $2 WHERE uuid = $1", docs.userId, master.Kid)
+			}
+			if err != nil {
+				fmt.Println("error re-encrypting kyc documents of user", docs.userId, err)
+				failed = append(failed, docs.userId)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		EmailErrorLog("RotateKycEncryption: Error re-encrypting documents",
+			fmt.Sprintf("%d users could not be re-encrypted:\n%s", len(failed), strings.Join(failed, "\n")))
+	}
+}
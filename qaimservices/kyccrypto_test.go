@@ -0,0 +1,136 @@
+package qaimservices
+
+import (
+	"bytes"
+	b64 "encoding/base64"
+	"testing"
+)
+
+func testMasterKey(kid string, fill byte) string {
+	return kid + ":" + b64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+// useKycKeys loads a key ring from the environment for the test, restoring the previous one after it
+func useKycKeys(t *testing.T, current string, retired string) {
+	t.Helper()
+	previous := kycKeys
+	t.Cleanup(func() { kycKeys = previous })
+	t.Setenv("KYC_MASTER_KEY", current)
+	t.Setenv("KYC_RETIRED_MASTER_KEYS", retired)
+	err := LoadKycKeys(EnvProd)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKycDocumentRoundTrip(t *testing.T) {
+	useKycKeys(t, testMasterKey("k1", 1), "")
+	plaintext := []byte("id card image bytes")
+	sealed, kid, err := SealKycDocument("kyc/user-a/front", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid != "k1" || !bytes.HasPrefix(sealed, kycMagic) || bytes.Contains(sealed, plaintext) {
+		t.Fatalf("kid %q, sealed %x: not sealed with k1", kid, sealed)
+	}
+	opened, err := OpenKycDocument("kyc/user-a/front", sealed)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("opened %q, %v", opened, err)
+	}
+	// legacy plaintext objects are returned as is
+	opened, err = OpenKycDocument("kyc/user-a/front", plaintext)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("legacy document opened as %q, %v", opened, err)
+	}
+}
+
+func TestKycDocumentTampering(t *testing.T) {
+	useKycKeys(t, testMasterKey("k1", 1), "")
+	sealed, _, err := SealKycDocument("kyc/user-a/front", []byte("id card image bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenKycDocument("kyc/user-b/front", sealed); err == nil {
+		t.Fatal("document opened under another object key")
+	}
+	// flip every byte after the magic in turn: the kid, lengths, wrapped key, nonce and ciphertext
+	for i := len(kycMagic); i < len(sealed); i++ {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+		if _, err = OpenKycDocument("kyc/user-a/front", tampered); err == nil {
+			t.Fatalf("document with byte %d flipped was opened", i)
+		}
+	}
+	for n := len(kycMagic); n < len(sealed); n++ {
+		if _, err = OpenKycDocument("kyc/user-a/front", sealed[:n]); err == nil {
+			t.Fatalf("document truncated to %d bytes was opened", n)
+		}
+	}
+}
+
+func TestKycKeyRotation(t *testing.T) {
+	useKycKeys(t, testMasterKey("k1", 1), "")
+	store := &MemoryObjectStore{}
+	previousStore := objectStore
+	SetObjectStore(store)
+	t.Cleanup(func() { objectStore = previousStore })
+
+	plaintext := []byte("id card image bytes")
+	sealed, _, err := SealKycDocument("kyc/user-a/front", plaintext)
+	if err == nil {
+		err = store.Put("kyc/user-a/front", sealed, ContentOctetStream)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// k2 takes over, k1 is kept to open what it sealed
+	useKycKeys(t, testMasterKey("k2", 2), testMasterKey("k1", 1))
+	opened, err := OpenKycDocument("kyc/user-a/front", sealed)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("document sealed with the retired key opened as %q, %v", opened, err)
+	}
+	err = reencryptKycObject("kyc/user-a/front")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// once re-encrypted, k1 can be dropped
+	useKycKeys(t, testMasterKey("k2", 2), "")
+	if _, err = OpenKycDocument("kyc/user-a/front", sealed); err == nil {
+		t.Fatal("document sealed with a removed key was opened")
+	}
+	resealed, err := store.Get("kyc/user-a/front")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err = OpenKycDocument("kyc/user-a/front", resealed)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("re-encrypted document opened as %q, %v", opened, err)
+	}
+}
+
+func TestLoadKycKeys(t *testing.T) {
+	previous := kycKeys
+	t.Cleanup(func() { kycKeys = previous })
+	tests := []struct {
+		env     string
+		current string
+		retired string
+		ok      bool
+	}{
+		{EnvProd, testMasterKey("k1", 1), testMasterKey("k0", 0), true},
+		{EnvProd, "", "", false},
+		{EnvLocal, "", "", true},
+		{EnvProd, "k1:" + b64.StdEncoding.EncodeToString([]byte("short")), "", false},
+		{EnvProd, "no-separator", "", false},
+		{EnvProd, testMasterKey("k1", 1), "k0:not base64!", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("KYC_MASTER_KEY", tt.current)
+		t.Setenv("KYC_RETIRED_MASTER_KEYS", tt.retired)
+		if err := LoadKycKeys(tt.env); (err == nil) != tt.ok {
+			t.Errorf("LoadKycKeys(%s) with %q, %q: %v", tt.env, tt.current, tt.retired, err)
+		}
+	}
+}
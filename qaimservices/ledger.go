@@ -0,0 +1,179 @@
+package qaimservices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	qs "qaimbe/qaimstructs"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Every change to a user's digital balance is recorded as a balanced
+debit/credit pair in public.ledger_entries.
+The user_wallet account is a liability (money qaim owes the user), so
+user balance = SUM(credit) - SUM(debit) for the user's user_wallet entries
+*/
+
+// * Ledger accounts
+const (
+	LedgerUserWallet         = "user_wallet"
+	LedgerBankCash           = "bank_cash"
+	LedgerTbillHoldings      = "tbill_holdings"
+	LedgerWithdrawalsPayable = "withdrawals_payable"
+	LedgerOpeningBalance     = "opening_balance"
+)
+
+// * Ledger sources, what caused the movement
+const (
+	LedgerSrcDeposit    = "deposit"
+	LedgerSrcPurchase   = "purchase"
+	LedgerSrcSale       = "sale"
+	LedgerSrcMaturity   = "maturity_payout"
+	LedgerSrcWithdrawal = "withdrawal"
+	LedgerSrcOpeningBal = "opening_balance"
+
+	LedgerSrcWithdrawalPayout = "withdrawal_payout"
+	LedgerSrcWithdrawalRefund = "withdrawal_refund"
+)
+
+const (
+	LedgerMaxPageSize    = 100
+	LedgerDefaultPageLen = 20
+)
+
+const (
+	SubjLedgerMismatch = "Error: User Balance Does Not Match Ledger"
+)
+
+/*
+PostLedgerTransfer records a movement of t.Amount from t.CreditAccount to t.DebitAccount
+a negative amount posts the reverse movement, and a zero amount records nothing
+must be called inside the transaction that changes the balance
+*/
+func PostLedgerTransfer(tx pgx.Tx, t qs.LedgerTransfer) error {
+	if t.Amount == 0 {
+		return nil
+	}
+	if t.DebitAccount == "" || t.CreditAccount == "" || t.Source == "" {
+		return errors.New("ledger transfer requires both accounts and a source")
+	}
+	if t.Amount < 0 {
+		t.DebitAccount, t.CreditAccount = t.CreditAccount, t.DebitAccount
+		t.Amount = -t.Amount
+	}
+	var userId *string
+	if t.UserId != "" {
+		userId = &t.UserId
+	}
+	_, err := tx.Exec(context.TODO(), `
+		WITH txn AS (
+			SELECT gen_random_uuid() AS transaction_id
+		)
+		INSERT INTO PUBLIC.ledger_entries (transaction_id, account, user_id, debit, credit, source, source_id)
+		SELECT transaction_id, $1::TEXT, $3::UUID, $4::BIGINT, 0, $5::TEXT, $6::TEXT FROM txn
+		UNION ALL
+		SELECT transaction_id, $2::TEXT, $3::UUID, 0, $4::BIGINT, $5::TEXT, $6::TEXT FROM txn
+	`, t.DebitAccount, t.CreditAccount, userId, t.Amount, t.Source, t.SourceId)
+	return err
+}
+
+/*
+GetWalletEntries returns a page of the user's wallet entries, newest first
+before: only entries with an id lower than this are returned, 0 for the first page
+*/
+func GetWalletEntries(connPool *pgxpool.Pool, userId string, before int64, limit int) (qs.LedgerEntryPage, error) {
+	var page qs.LedgerEntryPage
+	if limit <= 0 || limit > LedgerMaxPageSize {
+		limit = LedgerDefaultPageLen
+	}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT id, transaction_id, account, debit, credit, source, source_id, created_at
+		FROM PUBLIC.ledger_entries
+		WHERE account = $1 AND user_id = $2 AND ($3::BIGINT = 0 OR id < $3::BIGINT)
+		ORDER BY id DESC
+		LIMIT $4
+	`, LedgerUserWallet, userId, before, limit)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	page.Entries = make([]qs.LedgerEntry, 0, limit)
+	for rows.Next() {
+		var e qs.LedgerEntry
+		err = rows.Scan(&e.Id, &e.TransactionId, &e.Account, &e.Debit, &e.Credit, &e.Source, &e.SourceId, &e.CreatedAt)
+		if err != nil {
+			return page, err
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Entries) == limit {
+		page.NextBefore = page.Entries[len(page.Entries)-1].Id
+	}
+	return page, nil
+}
+
+// LedgerMismatch is a user whose balance column disagrees with their wallet ledger entries
+type LedgerMismatch struct {
+	UserId        string
+	Balance       int64
+	LedgerBalance int64
+}
+
+// FindLedgerMismatches compares every user's balance column against the balance derived from their wallet entries
+func FindLedgerMismatches(connPool *pgxpool.Pool) ([]LedgerMismatch, error) {
+	rows, err := connPool.Query(context.Background(), `
+		WITH ledger_balance AS (
+			SELECT user_id, SUM(credit) - SUM(debit) AS balance
+			FROM PUBLIC.ledger_entries
+			WHERE account = $1
+			GROUP BY user_id
+		)
+		SELECT u.uuid, u.balance, COALESCE(l.balance, 0)
+		FROM PUBLIC.user AS u
+		LEFT JOIN ledger_balance AS l
+		ON l.user_id = u.uuid
+		WHERE u.balance <> COALESCE(l.balance, 0);
+	`, LedgerUserWallet)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mismatches []LedgerMismatch
+	for rows.Next() {
+		var m LedgerMismatch
+		err = rows.Scan(&m.UserId, &m.Balance, &m.LedgerBalance)
+		if err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// ReconcileLedgerBalances emails the users whose balance drifted from the ledger
+func ReconcileLedgerBalances(connPool *pgxpool.Pool) {
+	mismatches, err := FindLedgerMismatches(connPool)
+	if err != nil {
+		fmt.Println("error reconciling ledger", err)
+		EmailErrorLog(SubjLedgerMismatch, err.Error())
+		return
+	}
+	if len(mismatches) == 0 {
+		return
+	}
+	lines := make([]string, 0, len(mismatches))
+	for _, m := range mismatches {
+		lines = append(lines, fmt.Sprintf("%s, %d, %d", m.UserId, m.Balance, m.LedgerBalance))
+	}
+	report := "User Id, Balance, Ledger Balance\n" + strings.Join(lines, "\n")
+	EmailErrorLog(SubjLedgerMismatch, report)
+}
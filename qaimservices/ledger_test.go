@@ -0,0 +1,122 @@
+package qaimservices
+
+import (
+	"context"
+	qs "qaimbe/qaimstructs"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPostLedgerTransferBalanced(t *testing.T) {
+	connPool := testConnPool(t)
+	userId := createTestUser(t, connPool, 0)
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(context.TODO())
+	_, err = tx.Exec(context.TODO(), "UPDATE PUBLIC.user SET balance = balance + 500 WHERE uuid = $1", userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PostLedgerTransfer(tx, qs.LedgerTransfer{
+		UserId: userId, DebitAccount: LedgerBankCash, CreditAccount: LedgerUserWallet, Amount: 500, Source: LedgerSrcDeposit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a negative amount posts the reverse movement
+	_, err = tx.Exec(context.TODO(), "UPDATE PUBLIC.user SET balance = balance - 200 WHERE uuid = $1", userId)
+	if err == nil {
+		err = PostLedgerTransfer(tx, qs.LedgerTransfer{
+			UserId: userId, DebitAccount: LedgerBankCash, CreditAccount: LedgerUserWallet, Amount: -200, Source: LedgerSrcWithdrawal,
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit(context.TODO())
+	if err != nil {
+		t.Fatalf("commit failed, the deferred balance trigger rejected the transfer: %v", err)
+	}
+
+	page, err := GetWalletEntries(connPool, userId, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var balance int64
+	for _, e := range page.Entries {
+		balance += e.Credit - e.Debit
+	}
+	if len(page.Entries) != 2 || balance != 300 {
+		t.Fatalf("wallet has %d entries summing to %d, want 2 summing to 300", len(page.Entries), balance)
+	}
+	for _, m := range mustFindLedgerMismatches(t, connPool) {
+		if m.UserId == userId {
+			t.Fatalf("balanced user reported as drifted: %+v", m)
+		}
+	}
+}
+
+func TestLedgerTriggerRejectsUnbalanced(t *testing.T) {
+	connPool := testConnPool(t)
+	userId := createTestUser(t, connPool, 0)
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(context.TODO())
+	_, err = tx.Exec(context.TODO(), `
+		INSERT INTO PUBLIC.ledger_entries (transaction_id, account, user_id, debit, credit, source)
+		VALUES (gen_random_uuid(), $1, $2, 0, 100, $3)
+	`, LedgerUserWallet, userId, LedgerSrcDeposit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(context.TODO()); err == nil {
+		t.Fatal("a single leg transfer was committed")
+	}
+}
+
+func TestFindLedgerMismatchesFlagsDrift(t *testing.T) {
+	connPool := testConnPool(t)
+	// the balance column says 700 but the ledger only ever credited 500
+	userId := createTestUser(t, connPool, 700)
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(context.TODO())
+	err = PostLedgerTransfer(tx, qs.LedgerTransfer{
+		UserId: userId, DebitAccount: LedgerBankCash, CreditAccount: LedgerUserWallet, Amount: 500, Source: LedgerSrcDeposit,
+	})
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range mustFindLedgerMismatches(t, connPool) {
+		if m.UserId == userId {
+			if m.Balance != 700 || m.LedgerBalance != 500 {
+				t.Fatalf("got %+v, want balance 700 and ledger balance 500", m)
+			}
+			return
+		}
+	}
+	t.Fatal("drifted user was not reported")
+}
+
+func mustFindLedgerMismatches(t *testing.T, connPool *pgxpool.Pool) []LedgerMismatch {
+	t.Helper()
+	mismatches, err := FindLedgerMismatches(connPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mismatches
+}
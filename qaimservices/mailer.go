@@ -0,0 +1,234 @@
+package qaimservices
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+# Mailer
+Emails are sent through the Mailer configured by MAIL_BACKEND:
+  - smtp: SMTP_HOST (smtp.gmail.com), SMTP_PORT (587), SMTP_TLS (starttls | tls | none),
+    SMTP_USER and SMTP_PASS (default to EMAIL_USER and EMAIL_PASS)
+  - file: every message is written to a maildir at MAIL_DIR (./maildir), for development
+  - memory: messages are kept in memory, for tests
+
+When MAIL_BACKEND is not set the local environment uses the file backend and every other uses smtp.
+MAIL_FROM sets the sender, defaulting to EMAIL_USER
+*/
+
+const (
+	MailBackendSmtp   = "smtp"
+	MailBackendFile   = "file"
+	MailBackendMemory = "memory"
+)
+
+const (
+	SmtpTlsStartTls = "starttls"
+	SmtpTlsImplicit = "tls"
+	SmtpTlsNone     = "none"
+)
+
+// Mailer delivers a fully formed RFC 5322 message to the recipients
+type Mailer interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+var mailer Mailer
+
+// SetMailer replaces the mailer used to deliver emails
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// LoadMailer configures the mailer from the environment
+func LoadMailer(env string) error {
+	backend := os.Getenv("MAIL_BACKEND")
+	if backend == "" {
+		backend = MailBackendSmtp
+		if env == EnvLocal {
+			backend = MailBackendFile
+		}
+	}
+	switch backend {
+	case MailBackendSmtp:
+		port := 587
+		if os.Getenv("SMTP_PORT") != "" {
+			var err error
+			port, err = strconv.Atoi(os.Getenv("SMTP_PORT"))
+			if err != nil {
+				return fmt.Errorf("SMTP_PORT: %w", err)
+			}
+		}
+		m := &SmtpMailer{
+			Host:     envOr("SMTP_HOST", "smtp.gmail.com"),
+			Port:     port,
+			Tls:      envOr("SMTP_TLS", SmtpTlsStartTls),
+			Username: envOr("SMTP_USER", os.Getenv("EMAIL_USER")),
+			Password: envOr("SMTP_PASS", os.Getenv("EMAIL_PASS")),
+		}
+		if m.Tls != SmtpTlsStartTls && m.Tls != SmtpTlsImplicit && m.Tls != SmtpTlsNone {
+			return fmt.Errorf("SMTP_TLS: unsupported mode %q", m.Tls)
+		}
+		mailer = m
+	case MailBackendFile:
+		mailer = &FileMailer{Dir: envOr("MAIL_DIR", "maildir")}
+	case MailBackendMemory:
+		mailer = &MemoryMailer{}
+	default:
+		return fmt.Errorf("MAIL_BACKEND: unsupported backend %q", backend)
+	}
+	return nil
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// mailSender is the From address of every outgoing email
+func mailSender() string {
+	return envOr("MAIL_FROM", os.Getenv("EMAIL_USER"))
+}
+
+// ****************
+type SmtpMailer struct {
+	Host     string
+	Port     int
+	Tls      string
+	Username string
+	Password string
+}
+
+func (m *SmtpMailer) Send(from string, to []string, msg []byte) error {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	var client *smtp.Client
+	var err error
+	if m.Tls == SmtpTlsImplicit {
+		conn, dialErr := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: m.Host})
+		if dialErr != nil {
+			return dialErr
+		}
+		client, err = smtp.NewClient(conn, m.Host)
+	} else {
+		conn, dialErr := net.DialTimeout("tcp", addr, 30*time.Second)
+		if dialErr != nil {
+			return dialErr
+		}
+		client, err = smtp.NewClient(conn, m.Host)
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.Tls == SmtpTlsStartTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		err = client.StartTLS(&tls.Config{ServerName: m.Host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		err = client.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// ****************
+// FileMailer writes every message into the new/ folder of a maildir
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(from string, to []string, msg []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(m.Dir, sub), 0o755)
+		if err != nil {
+			return err
+		}
+	}
+	id, err := NewUuid()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%s.qaim", time.Now().UnixNano(), id)
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	err = os.WriteFile(tmpPath, msg, 0o644)
+	if err != nil {
+		return err
+	}
+	// maildir readers only ever see complete messages in new/
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
+
+// ****************
+type SentMail struct {
+	From string
+	To   []string
+	Msg  []byte
+}
+
+// MemoryMailer keeps every message it is given, for tests
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []SentMail
+}
+
+func (m *MemoryMailer) Send(from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, SentMail{From: from, To: append([]string{}, to...), Msg: append([]byte{}, msg...)})
+	return nil
+}
+
+// Sent returns a copy of the messages sent so far
+func (m *MemoryMailer) Sent() []SentMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SentMail{}, m.sent...)
+}
+
+// Reset forgets every sent message
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+}
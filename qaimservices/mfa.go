@@ -0,0 +1,398 @@
+package qaimservices
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	qs "qaimbe/qaimstructs"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+/*
+# Two Factor Authentication
+Users and admins enrol a TOTP authenticator (RFC 6238, sha1, 6 digits, 30 second steps):
+  - BeginTotpEnrolment generates a secret, shown as an otpauth uri and its qr code
+  - ConfirmTotpEnrolment checks a first code from the authenticator and issues RecoveryCodeCount
+    single use recovery codes, from then on login asks for a code (Otp) after the password
+
+Sessions record how they were authenticated in their tokens' amr claim, pwd for the password and
+otp once a totp or recovery code was given. Admins must use a second factor, RequireMfa refuses
+their pwd only tokens everywhere but the routes marked MfaOptional, where they enrol one.
+For users it's optional.
+
+Secrets are sealed like kyc documents (see kyccrypto.go) and re-encrypted by RotateTotpSecrets.
+A code is accepted one step either side of the current one, and only once
+*/
+
+const (
+	AmrPassword = "pwd"
+	AmrOtp      = "otp"
+
+	TotpIssuer        = "Qaim"
+	totpDigits        = 6
+	totpStep          = 30
+	totpSkew          = 1
+	totpSecretSize    = 20
+	RecoveryCodeCount = 10
+)
+
+var (
+	ErrTotpEnrolled    = errors.New("a second factor is already enrolled")
+	ErrTotpNotEnrolled = errors.New("no second factor enrolment was started")
+	ErrInvalidOtp      = errors.New("invalid one time code")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpObjectKey authenticates a sealed secret to its subject, like the object key of a kyc document
+func totpObjectKey(subject string) string {
+	return "totp/" + subject
+}
+
+// totpCode is the code of the time step (RFC 4226 dynamic truncation)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTotpCode returns the time step code was generated for, zero when it matches none around now
+func matchTotpCode(secret []byte, code string, now time.Time) int64 {
+	if len(code) != totpDigits {
+		return 0
+	}
+	current := now.Unix() / totpStep
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// normalizeOtp drops the spaces and dashes people type into codes
+func normalizeOtp(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) []byte {
+	h := sha256.Sum256([]byte(normalizeOtp(code)))
+	return h[:]
+}
+
+// newRecoveryCodes generates codes of 10 base32 characters, shown as xxxxx-xxxxx
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		code := totpEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// replaceRecoveryCodes invalidates the subject's recovery codes and issues new ones
+func replaceRecoveryCodes(tx pgx.Tx, subject string) ([]string, error) {
+	_, err := tx.Exec(context.TODO(), "DELETE FROM PUBLIC.totp_recovery_codes WHERE subject = $1", subject)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err = tx.Exec(context.TODO(),
+			"INSERT INTO PUBLIC.totp_recovery_codes (subject, code_hash) VALUES ($1, $2)", subject, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// TotpUri is the otpauth uri authenticator apps enrol from
+func TotpUri(secret string, account string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TotpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpStep))
+	label := url.PathEscape(TotpIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+/*
+BeginTotpEnrolment generates a new totp secret for subject, replacing one that was never confirmed
+@param account names the account in the authenticator app, the phone number or username
+*/
+func BeginTotpEnrolment(connPool *pgxpool.Pool, subject string, account string) (qs.TotpEnrolment, error) {
+	var enrolment qs.TotpEnrolment
+	secret := make([]byte, totpSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return enrolment, err
+	}
+	sealed, kid, err := SealKycDocument(totpObjectKey(subject), secret)
+	if err != nil {
+		return enrolment, err
+	}
+	tag, err := connPool.Exec(context.Background(), `
+		INSERT INTO PUBLIC.totp_credentials (subject, secret, key_id) VALUES ($1, $2, NULLIF($3, ''))
+		ON CONFLICT (subject) DO UPDATE
+		SET secret = EXCLUDED.secret, key_id = EXCLUDED.key_id, last_used_step = NULL, created_at = NOW()
+		WHERE totp_credentials.confirmed_at IS NULL
+	`, subject, sealed, kid)
+	if err != nil {
+		return enrolment, err
+	}
+	if tag.RowsAffected() == 0 {
+		return enrolment, ErrTotpEnrolled
+	}
+	enrolment.Secret = totpEncoding.EncodeToString(secret)
+	enrolment.OtpauthUri = TotpUri(enrolment.Secret, account)
+	png, err := qrcode.Encode(enrolment.OtpauthUri, qrcode.Medium, 256)
+	if err != nil {
+		return enrolment, err
+	}
+	enrolment.QrCode = "data:image/png;base64," + b64.StdEncoding.EncodeToString(png)
+	return enrolment, nil
+}
+
+// lockTotpCredential reads the subject's secret, locking its row until tx ends
+func lockTotpCredential(tx pgx.Tx, subject string) ([]byte, bool, error) {
+	var sealed []byte
+	var confirmed bool
+	err := tx.QueryRow(context.TODO(), `
+		SELECT secret, confirmed_at IS NOT NULL FROM PUBLIC.totp_credentials WHERE subject = $1 FOR UPDATE
+	`, subject).Scan(&sealed, &confirmed)
+	if err != nil {
+		return nil, false, err
+	}
+	secret, err := OpenKycDocument(totpObjectKey(subject), sealed)
+	return secret, confirmed, err
+}
+
+// ConfirmTotpEnrolment completes the enrolment with a first code, returning the recovery codes
+func ConfirmTotpEnrolment(connPool *pgxpool.Pool, subject string, code string) ([]string, error) {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.TODO())
+	secret, confirmed, err := lockTotpCredential(tx, subject)
+	if err == pgx.ErrNoRows {
+		return nil, ErrTotpNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrTotpEnrolled
+	}
+	step := matchTotpCode(secret, normalizeOtp(code), time.Now())
+	if step == 0 {
+		return nil, ErrInvalidOtp
+	}
+	_, err = tx.Exec(context.TODO(), `
+		UPDATE PUBLIC.totp_credentials SET confirmed_at = NOW(), last_used_step = $2 WHERE subject = $1
+	`, subject, step)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, subject)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(context.TODO())
+}
+
+// TotpEnrolled reports if subject confirmed a second factor, login then asks for it
+func TotpEnrolled(connPool *pgxpool.Pool, subject string) (bool, error) {
+	var enrolled bool
+	err := connPool.QueryRow(context.Background(), `
+		SELECT EXISTS (SELECT 1 FROM PUBLIC.totp_credentials WHERE subject = $1 AND confirmed_at IS NOT NULL)
+	`, subject).Scan(&enrolled)
+	return enrolled, err
+}
+
+/*
+VerifySecondFactor checks a totp or recovery code of subject's confirmed enrolment,
+the code is used up either way
+*/
+func VerifySecondFactor(connPool *pgxpool.Pool, subject string, code string) (bool, error) {
+	code = normalizeOtp(code)
+	if len(code) != totpDigits {
+		tag, err := connPool.Exec(context.Background(), `
+			UPDATE PUBLIC.totp_recovery_codes SET used_at = NOW()
+			WHERE subject = $1 AND code_hash = $2 AND used_at IS NULL
+		`, subject, hashRecoveryCode(code))
+		return err == nil && tag.RowsAffected() == 1, err
+	}
+
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.TODO())
+	secret, confirmed, err := lockTotpCredential(tx, subject)
+	if err == pgx.ErrNoRows || (err == nil && !confirmed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	step := matchTotpCode(secret, code, time.Now())
+	if step == 0 {
+		return false, nil
+	}
+	// a code that was already accepted, or one older than it, is a replay
+	tag, err := tx.Exec(context.TODO(), `
+		UPDATE PUBLIC.totp_credentials SET last_used_step = $2
+		WHERE subject = $1 AND (last_used_step IS NULL OR last_used_step < $2)
+	`, subject, step)
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	return err == nil && tag.RowsAffected() == 1, err
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of subject's confirmed enrolment
+func RegenerateRecoveryCodes(connPool *pgxpool.Pool, subject string) ([]string, error) {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.TODO())
+	_, confirmed, err := lockTotpCredential(tx, subject)
+	if err == pgx.ErrNoRows || (err == nil && !confirmed) {
+		return nil, ErrTotpNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, subject)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(context.TODO())
+}
+
+// RemoveTotp removes subject's second factor along with its recovery codes
+func RemoveTotp(connPool *pgxpool.Pool, subject string) error {
+	_, err := connPool.Exec(context.Background(), "DELETE FROM PUBLIC.totp_credentials WHERE subject = $1", subject)
+	return err
+}
+
+// MfaRequired reports if holders of role must log in with a second factor
+func MfaRequired(role Role) bool {
+	return role.Implies(ADMIN)
+}
+
+// HasAmr reports if the token's session was authenticated with method
+func HasAmr(claims JwtPayload, method string) bool {
+	for _, amr := range claims.Amr {
+		if amr == method {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireMfa refuses tokens of roles that must use a second factor when their session was authenticated without one
+func RequireMfa(next RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		claims, ok := RequestClaims(r)
+		mfaOptional, _ := r.Context().Value(mfaOptionalCtxKey{}).(bool)
+		// the superuser api key carries no subject to enrol
+		if !ok || claims.Sub == "" || mfaOptional || !MfaRequired(claims.Aud) || HasAmr(claims, AmrOtp) {
+			next(w, r, connPool)
+			return
+		}
+		ServeErrorCode(w, r, http.StatusForbidden, ErrCodeMfaRequired,
+			"enrol a second factor and log in with it to use this endpoint")
+	}
+}
+
+// RotateTotpSecrets re-encrypts the totp secrets that are not sealed with the current kyc master key
+func RotateTotpSecrets(connPool *pgxpool.Pool) {
+	master := kycKeys.current
+	if master == nil {
+		return
+	}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT subject, secret FROM PUBLIC.totp_credentials WHERE key_id IS DISTINCT FROM $1
+	`, master.Kid)
+	if err != nil {
+		fmt.Println("error fetching totp secrets to rotate", err)
+		EmailErrorLog("RotateTotpSecrets: Error fetching secrets", err.Error())
+		return
+	}
+	type sealedSecret struct {
+		subject string
+		secret  []byte
+	}
+	var secrets []sealedSecret
+	for rows.Next() {
+		var s sealedSecret
+		err = rows.Scan(&s.subject, &s.secret)
+		if err != nil {
+			break
+		}
+		secrets = append(secrets, s)
+	}
+	rows.Close()
+	if err != nil {
+		fmt.Println("error scanning totp secrets to rotate", err)
+		EmailErrorLog("RotateTotpSecrets: Error scanning secrets", err.Error())
+		return
+	}
+
+	failed := []string{}
+	for _, s := range secrets {
+		secret, err := OpenKycDocument(totpObjectKey(s.subject), s.secret)
+		var resealed []byte
+		if err == nil {
+			resealed, _, err = SealKycDocument(totpObjectKey(s.subject), secret)
+		}
+		if err == nil {
+			// an enrolment restarted in between keeps its new secret
+			_, err = connPool.Exec(context.Background(), `
+				UPDATE PUBLIC.totp_credentials SET secret = $3, key_id = $4 WHERE subject = $1 AND secret = $2
+			`, s.subject, s.secret, resealed, master.Kid)
+		}
+		if err != nil {
+			fmt.Println("error re-encrypting totp secret of", s.subject, err)
+			failed = append(failed, s.subject)
+		}
+	}
+	if len(failed) > 0 {
+		EmailErrorLog("RotateTotpSecrets: Error re-encrypting secrets",
+			fmt.Sprintf("%d totp secrets could not be re-encrypted:\n%s", len(failed), strings.Join(failed, "\n")))
+	}
+}
@@ -0,0 +1,103 @@
+package qaimservices
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, sha1 with the 20 byte ascii secret. The rfc lists 8 digit codes, ours are their last 6
+func TestTotpCodeRfc6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpStep); got != tt.code {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+		step := tt.unix / totpStep
+		if got := matchTotpCode(secret, tt.code, time.Unix(tt.unix, 0)); got != step {
+			t.Errorf("matchTotpCode at %d = %d, want step %d", tt.unix, got, step)
+		}
+	}
+}
+
+func TestMatchTotpCodeSkew(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpStep
+	tests := []struct {
+		step int64
+		want int64
+	}{
+		{current, current},
+		{current - 1, current - 1},
+		{current + 1, current + 1},
+		{current - 2, 0},
+		{current + 2, 0},
+	}
+	for _, tt := range tests {
+		if got := matchTotpCode(secret, totpCode(secret, tt.step), now); got != tt.want {
+			t.Errorf("code of step %+d matched step %d, want %d", tt.step-current, got, tt.want)
+		}
+	}
+	for _, code := range []string{"", "00592", "0059244", "abcdef"} {
+		if got := matchTotpCode(secret, code, now); got != 0 {
+			t.Errorf("matchTotpCode(%q) = %d, want 0", code, got)
+		}
+	}
+}
+
+func TestVerifySecondFactorOnlyOnce(t *testing.T) {
+	connPool := testConnPool(t)
+	var subject string
+	err := connPool.QueryRow(context.Background(), "SELECT gen_random_uuid()::TEXT").Scan(&subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		connPool.Exec(context.Background(), "DELETE FROM PUBLIC.totp_credentials WHERE subject = $1", subject)
+	})
+
+	enrolment, err := BeginTotpEnrolment(connPool, subject, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totpEncoding.DecodeString(enrolment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := time.Now().Unix() / totpStep
+	// confirming uses up the current step's code
+	recoveryCodes, err := ConfirmTotpEnrolment(connPool, subject, totpCode(secret, current))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(code string, want bool, what string) {
+		t.Helper()
+		ok, err := VerifySecondFactor(connPool, subject, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("%s: accepted %v, want %v", what, ok, want)
+		}
+	}
+	verify(totpCode(secret, current), false, "the code used to confirm")
+	verify(totpCode(secret, current-1), false, "a code older than an accepted one")
+	verify(totpCode(secret, current+1), true, "the next step's code")
+	verify(totpCode(secret, current+1), false, "the same code again")
+	verify(recoveryCodes[0], true, "a recovery code")
+	verify(recoveryCodes[0], false, "the same recovery code again")
+	verify("AAAAA-AAAAA", false, "an unknown recovery code")
+}
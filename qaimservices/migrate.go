@@ -0,0 +1,250 @@
+package qaimservices
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	qs "qaimbe/qaimstructs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Schema migrations are embedded into the binary from the migrations directory.
+Each version has a pair of files:
+  - NNNN_name.up.sql: applied by MigrateUp
+  - NNNN_name.down.sql: applied by MigrateDown
+
+Applied versions are tracked in public.schema_migrations, and every run holds
+a postgres advisory lock so two replicas starting at once cannot both migrate.
+*/
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// arbitrary, but must stay the same across releases
+const migrationLockId int64 = 72616571
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fname := entry.Name()
+		var direction string
+		if strings.HasSuffix(fname, ".up.sql") {
+			direction = "up"
+		} else if strings.HasSuffix(fname, ".down.sql") {
+			direction = "down"
+		} else {
+			continue
+		}
+		base := strings.TrimSuffix(fname, "."+direction+".sql")
+		sepInd := strings.Index(base, "_")
+		if sepInd <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", fname)
+		}
+		version, err := strconv.Atoi(base[:sepInd])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", fname, err)
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + fname)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: base[sepInd+1:]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+/*
+withMigrationLock runs fn on a single connection holding the migration
+advisory lock, creating the version tracking table if required
+*/
+func withMigrationLock(connPool *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := connPool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(context.Background(), "SELECT pg_advisory_lock($1)", migrationLockId)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockId)
+
+	_, err = conn.Exec(context.Background(), `
+		CREATE TABLE IF NOT EXISTS public.schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(conn *pgxpool.Conn) (map[int]qs.MigrationStatus, error) {
+	rows, err := conn.Query(context.Background(),
+		"SELECT version, name, applied_at FROM public.schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]qs.MigrationStatus)
+	for rows.Next() {
+		var s qs.MigrationStatus
+		err = rows.Scan(&s.Version, &s.Name, &s.AppliedAt)
+		if err != nil {
+			return nil, err
+		}
+		s.Applied = true
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+func runMigration(conn *pgxpool.Conn, m migration, up bool) error {
+	tx, err := conn.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
+
+	if up {
+		_, err = tx.Exec(context.TODO(), m.Up)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err)
+		}
+		_, err = tx.Exec(context.TODO(),
+			"INSERT INTO public.schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+	} else {
+		_, err = tx.Exec(context.TODO(), m.Down)
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err)
+		}
+		_, err = tx.Exec(context.TODO(),
+			"DELETE FROM public.schema_migrations WHERE version = $1", m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.TODO())
+}
+
+// MigrateUp applies every embedded migration that has not been applied yet, in version order
+func MigrateUp(connPool *pgxpool.Pool) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(connPool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			err = runMigration(conn, m, true)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("applied migration %04d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts the latest `steps` applied migrations
+func MigrateDown(connPool *pgxpool.Pool, steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(connPool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %04d_%s cannot be reverted", m.Version, m.Name)
+			}
+			err = runMigration(conn, m, false)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("reverted migration %04d_%s\n", m.Version, m.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatuses lists every embedded migration along with whether it has been applied
+func MigrationStatuses(connPool *pgxpool.Pool) ([]qs.MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []qs.MigrationStatus
+	err = withMigrationLock(connPool, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			s, ok := applied[m.Version]
+			if !ok {
+				s = qs.MigrationStatus{Version: m.Version, Name: m.Name}
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS public.user_withdraw_requests;
+DROP TABLE IF EXISTS public.tbill_tokens;
+DROP TABLE IF EXISTS public.tbills;
+DROP TABLE IF EXISTS public.tbill_interest_rates;
+DROP TABLE IF EXISTS public.user;
+DROP TABLE IF EXISTS public.admin;
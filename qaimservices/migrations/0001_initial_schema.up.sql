@@ -0,0 +1,69 @@
+-- Baseline schema, reconstructed from the queries in qaimroutes and qaimservices
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE IF NOT EXISTS public.admin (
+	uuid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	user_name TEXT NOT NULL UNIQUE,
+	phone_num TEXT NOT NULL,
+	password_hash BYTEA NOT NULL,
+	verified BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS public.user (
+	uuid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	national_id TEXT NOT NULL UNIQUE,
+	first_name TEXT NOT NULL,
+	last_name TEXT NOT NULL,
+	phone_number TEXT NOT NULL UNIQUE,
+	iban TEXT NOT NULL,
+	id_front TEXT NOT NULL,
+	id_back TEXT NOT NULL,
+	password_hash BYTEA NOT NULL,
+	verified BOOLEAN NOT NULL DEFAULT FALSE,
+	balance BIGINT NOT NULL DEFAULT 0,
+	withdraw_request_id UUID
+);
+
+CREATE TABLE IF NOT EXISTS public.tbill_interest_rates (
+	uuid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	date TIMESTAMPTZ NOT NULL,
+	interest_rate REAL NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS public.tbills (
+	uuid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	tenor_days INTEGER NOT NULL,
+	issue_date DATE NOT NULL,
+	interest_rate REAL NOT NULL,
+	amount INTEGER NOT NULL,
+	available_amount INTEGER NOT NULL,
+	maturity_date DATE NOT NULL,
+	valid BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+-- a single purchase can span several bonds, so token_id repeats across rows
+CREATE TABLE IF NOT EXISTS public.tbill_tokens (
+	id BIGSERIAL PRIMARY KEY,
+	token_id UUID NOT NULL,
+	user_id UUID NOT NULL REFERENCES public.user (uuid),
+	amount_invested BIGINT NOT NULL,
+	maturity_date DATE NOT NULL,
+	tenor_days INTEGER NOT NULL,
+	interest_id UUID REFERENCES public.tbill_interest_rates (uuid),
+	bond_id UUID NOT NULL REFERENCES public.tbills (uuid),
+	investment_date DATE NOT NULL,
+	valid BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE INDEX IF NOT EXISTS tbill_tokens_user_id_idx ON public.tbill_tokens (user_id);
+CREATE INDEX IF NOT EXISTS tbill_tokens_token_id_idx ON public.tbill_tokens (token_id);
+
+CREATE TABLE IF NOT EXISTS public.user_withdraw_requests (
+	request_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	user_id UUID NOT NULL REFERENCES public.user (uuid),
+	amount BIGINT NOT NULL,
+	request_date TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	valid BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE INDEX IF NOT EXISTS user_withdraw_requests_user_id_idx ON public.user_withdraw_requests (user_id);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.ledger_entries;
+DROP FUNCTION IF EXISTS public.ledger_check_balanced();
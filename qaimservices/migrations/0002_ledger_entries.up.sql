@@ -0,0 +1,45 @@
+-- Double-entry ledger, every balance movement is a balanced set of rows sharing a transaction_id
+CREATE TABLE IF NOT EXISTS public.ledger_entries (
+	id BIGSERIAL PRIMARY KEY,
+	transaction_id UUID NOT NULL,
+	account TEXT NOT NULL,
+	user_id UUID REFERENCES public.user (uuid),
+	debit BIGINT NOT NULL DEFAULT 0,
+	credit BIGINT NOT NULL DEFAULT 0,
+	source TEXT NOT NULL,
+	source_id TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	CHECK (debit >= 0 AND credit >= 0 AND (debit = 0) <> (credit = 0))
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_user_idx ON public.ledger_entries (account, user_id, id);
+CREATE INDEX IF NOT EXISTS ledger_entries_transaction_idx ON public.ledger_entries (transaction_id);
+
+CREATE OR REPLACE FUNCTION public.ledger_check_balanced() RETURNS TRIGGER AS $$
+BEGIN
+	IF (
+		SELECT SUM(debit) - SUM(credit) FROM public.ledger_entries
+		WHERE transaction_id = NEW.transaction_id
+	) <> 0 THEN
+		RAISE EXCEPTION 'ledger transaction % is not balanced', NEW.transaction_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- checked at commit time, so both legs of a transfer can be inserted separately
+CREATE CONSTRAINT TRIGGER ledger_entries_balanced
+	AFTER INSERT ON public.ledger_entries
+	DEFERRABLE INITIALLY DEFERRED
+	FOR EACH ROW EXECUTE FUNCTION public.ledger_check_balanced();
+
+-- carry over balances that existed before the ledger
+WITH opening AS (
+	SELECT gen_random_uuid() AS transaction_id, uuid AS user_id, balance
+	FROM public.user
+	WHERE balance > 0
+)
+INSERT INTO public.ledger_entries (transaction_id, account, user_id, debit, credit, source)
+SELECT transaction_id, 'opening_balance', user_id, balance, 0, 'opening_balance' FROM opening
+UNION ALL
+SELECT transaction_id, 'user_wallet', user_id, 0, balance, 'opening_balance' FROM opening;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.access_tokens;
+DROP TABLE IF EXISTS public.refresh_tokens;
+DROP TABLE IF EXISTS public.auth_sessions;
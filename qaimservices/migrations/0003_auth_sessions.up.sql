@@ -0,0 +1,30 @@
+-- A session is created at login and lives as long as its refresh tokens keep being rotated
+CREATE TABLE IF NOT EXISTS public.auth_sessions (
+	session_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	subject UUID NOT NULL,
+	role INTEGER NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS auth_sessions_subject_idx ON public.auth_sessions (subject);
+
+-- only the sha256 of a refresh token is stored, a used token can never be presented again
+CREATE TABLE IF NOT EXISTS public.refresh_tokens (
+	token_hash BYTEA PRIMARY KEY,
+	session_id UUID NOT NULL REFERENCES public.auth_sessions (session_id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- every issued access token, keyed by its jti claim, doubles as the revocation list
+CREATE TABLE IF NOT EXISTS public.access_tokens (
+	jti UUID PRIMARY KEY,
+	session_id UUID NOT NULL REFERENCES public.auth_sessions (session_id) ON DELETE CASCADE,
+	subject UUID NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS access_tokens_session_idx ON public.access_tokens (session_id);
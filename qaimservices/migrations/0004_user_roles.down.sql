@@ -0,0 +1,2 @@
+ALTER TABLE public.user DROP CONSTRAINT IF EXISTS user_role_check;
+ALTER TABLE public.user DROP COLUMN IF EXISTS role;
@@ -0,0 +1,3 @@
+-- values follow qaimservices.Role: 4 = USER, 5 = USER_SECP, 6 = USER_BETA
+ALTER TABLE public.user ADD COLUMN IF NOT EXISTS role INTEGER NOT NULL DEFAULT 4;
+ALTER TABLE public.user ADD CONSTRAINT user_role_check CHECK (role IN (4, 5, 6));
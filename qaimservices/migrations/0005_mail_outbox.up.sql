@@ -0,0 +1,17 @@
+-- outgoing emails are queued here and delivered by the outbox worker, failed sends are retried with backoff
+CREATE TABLE IF NOT EXISTS public.mail_outbox (
+	id BIGSERIAL PRIMARY KEY,
+	sender TEXT NOT NULL,
+	recipients TEXT[] NOT NULL,
+	subject TEXT NOT NULL,
+	message BYTEA NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_error TEXT,
+	sent_at TIMESTAMPTZ,
+	failed_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS mail_outbox_pending_idx ON public.mail_outbox (next_attempt_at)
+WHERE sent_at IS NULL AND failed_at IS NULL;
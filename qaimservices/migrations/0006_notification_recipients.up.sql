@@ -0,0 +1,23 @@
+-- who receives the reporting, logging and user notifier emails
+-- an empty reports array subscribes the recipient to every report sent to the list
+CREATE TABLE IF NOT EXISTS public.notification_recipients (
+	id BIGSERIAL PRIMARY KEY,
+	email TEXT NOT NULL,
+	list TEXT NOT NULL CHECK (list IN ('reporting', 'logging', 'notifier')),
+	reports TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	UNIQUE (email, list)
+);
+
+-- the recipients that used to be compiled into the server
+INSERT INTO public.notification_recipients (email, list) VALUES
+	('talhaaamirwork@gmail.com', 'reporting'),
+	('hasan.tariq@qaim.finance', 'reporting'),
+	('R.nasir1995@gmail.com', 'reporting'),
+	('sarcxd@gmail.com', 'logging'),
+	('hasan.tariq@qaim.finance', 'logging'),
+	('R.nasir1995@gmail.com', 'logging'),
+	('R.nasir1995@gmail.com', 'notifier'),
+	('hasan.tariq@qaim.finance', 'notifier'),
+	('talhaaamirwork@gmail.com', 'notifier')
+ON CONFLICT (email, list) DO NOTHING;
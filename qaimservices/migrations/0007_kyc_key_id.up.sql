@@ -0,0 +1,2 @@
+-- id of the master key wrapping the data keys of the user's id card images, NULL for plaintext uploads
+ALTER TABLE public.user ADD COLUMN IF NOT EXISTS id_key_id TEXT;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS public.kyc_access_log;
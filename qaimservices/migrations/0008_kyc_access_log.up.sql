@@ -0,0 +1,16 @@
+-- every signed id card url handed to an admin, and when it was used
+CREATE TABLE IF NOT EXISTS public.kyc_access_log (
+	id BIGSERIAL PRIMARY KEY,
+	admin_id TEXT NOT NULL,
+	user_id UUID NOT NULL,
+	side TEXT NOT NULL CHECK (side IN ('front', 'back')),
+	object_key TEXT NOT NULL,
+	request_id TEXT NOT NULL DEFAULT '',
+	remote_addr TEXT NOT NULL DEFAULT '',
+	expires_at TIMESTAMPTZ NOT NULL,
+	issued_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	fetch_count INTEGER NOT NULL DEFAULT 0,
+	last_fetched_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS kyc_access_log_user_idx ON public.kyc_access_log (user_id);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS public.user_unverified_created_at_idx;
+DROP INDEX IF EXISTS public.user_first_name_uuid_idx;
+DROP INDEX IF EXISTS public.user_last_name_uuid_idx;
+DROP INDEX IF EXISTS public.user_balance_uuid_idx;
+DROP INDEX IF EXISTS public.user_created_at_uuid_idx;
+ALTER TABLE public.user DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,9 @@
+-- signup date for the admin user listings, existing users get the migration date
+ALTER TABLE public.user ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- keyset pagination indexes, one per sortable column with uuid as the tie breaker
+CREATE INDEX IF NOT EXISTS user_created_at_uuid_idx ON public.user (created_at, uuid);
+CREATE INDEX IF NOT EXISTS user_balance_uuid_idx ON public.user (balance, uuid);
+CREATE INDEX IF NOT EXISTS user_last_name_uuid_idx ON public.user (last_name, uuid);
+CREATE INDEX IF NOT EXISTS user_first_name_uuid_idx ON public.user (first_name, uuid);
+CREATE INDEX IF NOT EXISTS user_unverified_created_at_idx ON public.user (created_at, uuid) WHERE verified = FALSE;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.user_notifications;
+DROP TABLE IF EXISTS public.kyc_reviews;
+DROP INDEX IF EXISTS public.user_kyc_status_idx;
+ALTER TABLE public.user DROP COLUMN IF EXISTS kyc_status;
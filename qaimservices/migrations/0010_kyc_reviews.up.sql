@@ -0,0 +1,32 @@
+-- kyc applications move between pending, approved, rejected and resubmission_requested,
+-- verified is kept in sync (verified = approved) for the queries that only need the flag
+ALTER TABLE public.user ADD COLUMN IF NOT EXISTS kyc_status TEXT NOT NULL DEFAULT 'pending'
+	CHECK (kyc_status IN ('pending', 'approved', 'rejected', 'resubmission_requested'));
+UPDATE public.user SET kyc_status = 'approved' WHERE verified;
+
+CREATE INDEX IF NOT EXISTS user_kyc_status_idx ON public.user (kyc_status);
+
+-- every transition of a kyc application, reviewer_id is NULL for transitions made by the user
+CREATE TABLE IF NOT EXISTS public.kyc_reviews (
+	id BIGSERIAL PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES public.user (uuid),
+	from_status TEXT NOT NULL,
+	to_status TEXT NOT NULL,
+	reviewer_id TEXT,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS kyc_reviews_user_id_idx ON public.kyc_reviews (user_id, id);
+
+-- in app notifications shown to users
+CREATE TABLE IF NOT EXISTS public.user_notifications (
+	id BIGSERIAL PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES public.user (uuid),
+	kind TEXT NOT NULL,
+	message TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	read_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS user_notifications_user_id_idx ON public.user_notifications (user_id, id);
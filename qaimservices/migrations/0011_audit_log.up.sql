@@ -0,0 +1,38 @@
+-- every admin mutation, each row's hash covers its fields and the previous row's hash,
+-- so editing or removing a row breaks the chain from that row on
+CREATE TABLE IF NOT EXISTS public.audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL,
+	actor TEXT NOT NULL,
+	actor_role INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	target_type TEXT NOT NULL DEFAULT '',
+	target_id TEXT NOT NULL DEFAULT '',
+	before JSONB,
+	after JSONB,
+	remote_addr TEXT NOT NULL DEFAULT '',
+	request_id TEXT NOT NULL DEFAULT '',
+	prev_hash BYTEA,
+	hash BYTEA NOT NULL UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON public.audit_log (actor, id);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON public.audit_log (target_type, target_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON public.audit_log (action, id);
+
+-- the table is append only, rows can't be changed or removed
+CREATE OR REPLACE FUNCTION public.audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_log is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_no_update ON public.audit_log;
+CREATE TRIGGER audit_log_no_update
+	BEFORE UPDATE OR DELETE ON public.audit_log
+	FOR EACH ROW EXECUTE FUNCTION public.audit_log_append_only();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON public.audit_log;
+CREATE TRIGGER audit_log_no_truncate
+	BEFORE TRUNCATE ON public.audit_log
+	FOR EACH STATEMENT EXECUTE FUNCTION public.audit_log_append_only();
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.approval_thresholds;
+DROP TABLE IF EXISTS public.pending_operations;
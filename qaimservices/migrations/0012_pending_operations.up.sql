@@ -0,0 +1,34 @@
+-- maker-checker: money moving admin actions above a threshold wait here until a second admin approves them
+CREATE TABLE IF NOT EXISTS public.pending_operations (
+	id BIGSERIAL PRIMARY KEY,
+	kind TEXT NOT NULL CHECK (kind IN ('wallet.credit', 'withdraw.resolve')),
+	target_id TEXT NOT NULL,
+	amount BIGINT NOT NULL,
+	payload JSONB NOT NULL DEFAULT '{}',
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+	maker_id TEXT NOT NULL,
+	checker_id TEXT,
+	reason TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	decided_at TIMESTAMPTZ,
+	-- the admin approving can never be the one who asked
+	CHECK (status <> 'approved' OR checker_id <> maker_id)
+);
+
+CREATE INDEX IF NOT EXISTS pending_operations_status_idx ON public.pending_operations (status, id);
+-- a withdraw request can only wait on one resolution at a time
+CREATE UNIQUE INDEX IF NOT EXISTS pending_operations_withdraw_idx ON public.pending_operations (target_id)
+	WHERE kind = 'withdraw.resolve' AND status = 'pending';
+
+-- operations of at least min_amount need approval, 0 sends every operation of the kind for approval
+CREATE TABLE IF NOT EXISTS public.approval_thresholds (
+	kind TEXT PRIMARY KEY,
+	min_amount BIGINT NOT NULL CHECK (min_amount >= 0),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_by TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO public.approval_thresholds (kind, min_amount) VALUES
+	('wallet.credit', 0),
+	('withdraw.resolve', 0)
+ON CONFLICT (kind) DO NOTHING;
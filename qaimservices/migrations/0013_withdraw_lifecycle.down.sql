@@ -0,0 +1,23 @@
+UPDATE public.approval_thresholds SET kind = 'withdraw.resolve' WHERE kind = 'withdraw.approve';
+DROP INDEX IF EXISTS public.pending_operations_withdraw_idx;
+ALTER TABLE public.pending_operations DROP CONSTRAINT IF EXISTS pending_operations_kind_check;
+UPDATE public.pending_operations SET kind = 'withdraw.resolve' WHERE kind = 'withdraw.approve';
+ALTER TABLE public.pending_operations
+	ADD CONSTRAINT pending_operations_kind_check CHECK (kind IN ('wallet.credit', 'withdraw.resolve'));
+CREATE UNIQUE INDEX IF NOT EXISTS pending_operations_withdraw_idx ON public.pending_operations (target_id)
+	WHERE kind = 'withdraw.resolve' AND status = 'pending';
+
+ALTER TABLE public.user_withdraw_requests ADD COLUMN IF NOT EXISTS valid BOOLEAN NOT NULL DEFAULT TRUE;
+UPDATE public.user_withdraw_requests SET valid = status IN ('requested', 'approved');
+
+DROP INDEX IF EXISTS public.user_withdraw_requests_bank_reference_idx;
+DROP INDEX IF EXISTS public.user_withdraw_requests_status_idx;
+ALTER TABLE public.user_withdraw_requests
+	DROP COLUMN IF EXISTS cancelled_at,
+	DROP COLUMN IF EXISTS rejected_at,
+	DROP COLUMN IF EXISTS paid_at,
+	DROP COLUMN IF EXISTS approved_at,
+	DROP COLUMN IF EXISTS reason,
+	DROP COLUMN IF EXISTS reviewer_id,
+	DROP COLUMN IF EXISTS bank_reference,
+	DROP COLUMN IF EXISTS status;
@@ -0,0 +1,30 @@
+-- withdraw requests move through explicit states instead of a single valid flag
+ALTER TABLE public.user_withdraw_requests
+	ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'requested'
+		CHECK (status IN ('requested', 'approved', 'paid', 'rejected', 'cancelled')),
+	ADD COLUMN IF NOT EXISTS bank_reference TEXT,
+	ADD COLUMN IF NOT EXISTS reviewer_id TEXT,
+	ADD COLUMN IF NOT EXISTS reason TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS approved_at TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS paid_at TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS rejected_at TIMESTAMPTZ,
+	ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMPTZ;
+
+-- resolving a request used to mean it was paid out, the transfer reference was never recorded
+UPDATE public.user_withdraw_requests SET status = 'paid' WHERE valid = FALSE;
+ALTER TABLE public.user_withdraw_requests DROP COLUMN IF EXISTS valid;
+
+CREATE INDEX IF NOT EXISTS user_withdraw_requests_status_idx ON public.user_withdraw_requests (status, request_date);
+-- a bank transfer pays out exactly one request
+CREATE UNIQUE INDEX IF NOT EXISTS user_withdraw_requests_bank_reference_idx ON public.user_withdraw_requests (bank_reference)
+	WHERE bank_reference IS NOT NULL;
+
+-- maker-checker now gates approving a withdraw request, paying it out is recorded afterwards
+DROP INDEX IF EXISTS public.pending_operations_withdraw_idx;
+ALTER TABLE public.pending_operations DROP CONSTRAINT IF EXISTS pending_operations_kind_check;
+UPDATE public.pending_operations SET kind = 'withdraw.approve' WHERE kind = 'withdraw.resolve';
+ALTER TABLE public.pending_operations
+	ADD CONSTRAINT pending_operations_kind_check CHECK (kind IN ('wallet.credit', 'withdraw.approve'));
+CREATE UNIQUE INDEX IF NOT EXISTS pending_operations_withdraw_idx ON public.pending_operations (target_id)
+	WHERE kind = 'withdraw.approve' AND status = 'pending';
+UPDATE public.approval_thresholds SET kind = 'withdraw.approve' WHERE kind = 'withdraw.resolve';
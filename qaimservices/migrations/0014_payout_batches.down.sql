@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.payout_batch_items;
+DROP TABLE IF EXISTS public.payout_batches;
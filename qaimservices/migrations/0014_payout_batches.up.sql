@@ -0,0 +1,32 @@
+-- approved withdraw requests are paid out in batches exported to the bank's bulk transfer format
+CREATE TABLE IF NOT EXISTS public.payout_batches (
+	id BIGSERIAL PRIMARY KEY,
+	status TEXT NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'submitted', 'reconciled')),
+	item_count INT NOT NULL DEFAULT 0,
+	total_amount BIGINT NOT NULL DEFAULT 0,
+	created_by TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	submitted_by TEXT,
+	submitted_at TIMESTAMPTZ,
+	reconciled_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS payout_batches_status_idx ON public.payout_batches (status, id);
+
+-- the payee details are copied when the batch is drawn up, the file always matches what was sent
+CREATE TABLE IF NOT EXISTS public.payout_batch_items (
+	batch_id BIGINT NOT NULL REFERENCES public.payout_batches (id) ON DELETE CASCADE,
+	seq INT NOT NULL,
+	reference TEXT NOT NULL UNIQUE,
+	request_id UUID NOT NULL UNIQUE REFERENCES public.user_withdraw_requests (request_id),
+	user_id UUID NOT NULL,
+	iban TEXT NOT NULL,
+	name TEXT NOT NULL,
+	national_id TEXT NOT NULL,
+	amount BIGINT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'paid', 'failed')),
+	bank_reference TEXT,
+	failure_reason TEXT NOT NULL DEFAULT '',
+	settled_at TIMESTAMPTZ,
+	PRIMARY KEY (batch_id, seq)
+);
@@ -0,0 +1,17 @@
+-- responses of mutating requests sent with an Idempotency-Key, replayed when the client retries
+CREATE TABLE IF NOT EXISTS public.idempotency_keys (
+	actor TEXT NOT NULL,
+	key TEXT NOT NULL,
+	method TEXT NOT NULL,
+	path TEXT NOT NULL,
+	request_hash BYTEA NOT NULL,
+	-- NULL until the request completes
+	status INT,
+	content_type TEXT NOT NULL DEFAULT '',
+	response BYTEA,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	completed_at TIMESTAMPTZ,
+	PRIMARY KEY (actor, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON public.idempotency_keys (created_at);
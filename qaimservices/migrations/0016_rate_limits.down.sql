@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.login_failures;
+DROP TABLE IF EXISTS public.rate_limit_buckets;
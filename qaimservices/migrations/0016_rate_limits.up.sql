@@ -0,0 +1,16 @@
+-- token buckets shared by every replica, keyed by limit and client ip, login account or subject
+CREATE TABLE IF NOT EXISTS public.rate_limit_buckets (
+	bucket TEXT PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS rate_limit_buckets_updated_at_idx ON public.rate_limit_buckets (updated_at);
+
+-- consecutive failed logins of an account, locking it out for longer with every failure past the threshold
+CREATE TABLE IF NOT EXISTS public.login_failures (
+	account TEXT PRIMARY KEY,
+	failures INT NOT NULL DEFAULT 0,
+	locked_until TIMESTAMPTZ,
+	last_failure_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
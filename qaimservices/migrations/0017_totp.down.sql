@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.totp_recovery_codes;
+DROP TABLE IF EXISTS public.totp_credentials;
+ALTER TABLE public.auth_sessions DROP COLUMN IF EXISTS amr;
@@ -0,0 +1,23 @@
+-- authentication methods of the session, carried by its tokens' amr claim
+ALTER TABLE public.auth_sessions ADD COLUMN IF NOT EXISTS amr TEXT[] NOT NULL DEFAULT '{pwd}';
+
+-- totp second factor of a user or admin, sealed with the kyc master key
+CREATE TABLE IF NOT EXISTS public.totp_credentials (
+	subject UUID PRIMARY KEY,
+	secret BYTEA NOT NULL,
+	key_id TEXT,
+	-- NULL until the first code is confirmed, an unconfirmed secret isn't asked for at login
+	confirmed_at TIMESTAMPTZ,
+	-- the time step of the last accepted code, a code is only accepted once
+	last_used_step BIGINT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- single use codes for a lost authenticator, only their sha256 is stored
+CREATE TABLE IF NOT EXISTS public.totp_recovery_codes (
+	subject UUID NOT NULL REFERENCES public.totp_credentials (subject) ON DELETE CASCADE,
+	code_hash BYTEA NOT NULL,
+	used_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (subject, code_hash)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE public.user DROP COLUMN IF EXISTS phone_verified_at;
+DROP TABLE IF EXISTS public.phone_otps;
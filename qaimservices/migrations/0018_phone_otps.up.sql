@@ -0,0 +1,13 @@
+-- the pending one time code of a phone number, per purpose, only its bcrypt hash is stored
+CREATE TABLE IF NOT EXISTS public.phone_otps (
+	phone_number TEXT NOT NULL,
+	purpose TEXT NOT NULL CHECK (purpose IN ('signup', 'password_reset')),
+	code_hash BYTEA NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (phone_number, purpose)
+);
+
+-- NULL for users that signed up before phone numbers were verified
+ALTER TABLE public.user ADD COLUMN IF NOT EXISTS phone_verified_at TIMESTAMPTZ;
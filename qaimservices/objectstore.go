@@ -0,0 +1,252 @@
+package qaimservices
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+# Object Store
+Uploaded files (id card images) are kept in the ObjectStore configured by OBJECT_STORE:
+  - s3: the AWS_S3_BUCKET bucket
+  - disk: files under OBJECT_STORE_DIR (./objectstore), for development
+  - memory: objects are kept in memory, for tests
+
+When OBJECT_STORE is not set the local environment uses the disk backend and every other uses s3
+*/
+
+const (
+	ObjectStoreS3     = "s3"
+	ObjectStoreDisk   = "disk"
+	ObjectStoreMemory = "memory"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+type ObjectStore interface {
+	Put(key string, data []byte, contentType string) error
+	// Get returns ErrObjectNotFound when no object is stored under key
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// ObjectPresigner is implemented by stores that can hand out direct, time limited download urls
+type ObjectPresigner interface {
+	PresignGet(key string, ttl time.Duration) (string, error)
+}
+
+var objectStore ObjectStore
+
+// SetObjectStore replaces the store uploaded files are kept in
+func SetObjectStore(store ObjectStore) {
+	objectStore = store
+}
+
+// LoadObjectStore configures the object store from the environment
+func LoadObjectStore(env string, awsSess *session.Session) error {
+	backend := os.Getenv("OBJECT_STORE")
+	if backend == "" {
+		backend = ObjectStoreS3
+		if env == EnvLocal {
+			backend = ObjectStoreDisk
+		}
+	}
+	switch backend {
+	case ObjectStoreS3:
+		bucket := os.Getenv("AWS_S3_BUCKET")
+		if bucket == "" {
+			return errors.New("AWS_S3_BUCKET is required for the s3 object store")
+		}
+		objectStore = &S3ObjectStore{Sess: awsSess, Bucket: bucket}
+	case ObjectStoreDisk:
+		objectStore = &DiskObjectStore{Dir: envOr("OBJECT_STORE_DIR", "objectstore")}
+	case ObjectStoreMemory:
+		objectStore = &MemoryObjectStore{}
+	default:
+		return fmt.Errorf("OBJECT_STORE: unsupported backend %q", backend)
+	}
+	return nil
+}
+
+func PutObject(key string, data []byte, contentType string) error {
+	if objectStore == nil {
+		return errors.New("no object store configured")
+	}
+	return objectStore.Put(key, data, contentType)
+}
+
+func GetObject(key string) ([]byte, error) {
+	if objectStore == nil {
+		return nil, errors.New("no object store configured")
+	}
+	return objectStore.Get(key)
+}
+
+func DeleteObject(key string) error {
+	if objectStore == nil {
+		return errors.New("no object store configured")
+	}
+	return objectStore.Delete(key)
+}
+
+// PresignObject returns a direct download url for key, ok is false when the store can't presign
+func PresignObject(key string, ttl time.Duration) (url string, ok bool, err error) {
+	presigner, ok := objectStore.(ObjectPresigner)
+	if !ok {
+		return "", false, nil
+	}
+	url, err = presigner.PresignGet(key, ttl)
+	return url, true, err
+}
+
+// ****************
+type S3ObjectStore struct {
+	Sess   *session.Session
+	Bucket string
+}
+
+func (store *S3ObjectStore) Put(key string, data []byte, contentType string) error {
+	svc := s3.New(store.Sess)
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(store.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (store *S3ObjectStore) Get(key string) ([]byte, error) {
+	svc := s3.New(store.Sess)
+	result, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(store.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	defer result.Body.Close()
+	return io.ReadAll(result.Body)
+}
+
+func (store *S3ObjectStore) PresignGet(key string, ttl time.Duration) (string, error) {
+	svc := s3.New(store.Sess)
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(store.Bucket),
+		Key:    aws.String(key),
+	})
+	return req.Presign(ttl)
+}
+
+func (store *S3ObjectStore) Delete(key string) error {
+	svc := s3.New(store.Sess)
+	_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(store.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// ****************
+// DiskObjectStore keeps every object as a file under Dir, keys may contain "/" but never ".."
+type DiskObjectStore struct {
+	Dir string
+}
+
+func (store *DiskObjectStore) path(key string) (string, error) {
+	if key == "" || filepath.IsAbs(key) || strings.Contains(key, "..") || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(store.Dir, filepath.FromSlash(key)), nil
+}
+
+func (store *DiskObjectStore) Put(key string, data []byte, contentType string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	// write then rename, so a reader never sees a partial object
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (store *DiskObjectStore) Get(key string) ([]byte, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrObjectNotFound
+	}
+	return data, err
+}
+
+func (store *DiskObjectStore) Delete(key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ****************
+// MemoryObjectStore keeps objects in a map, for tests
+type MemoryObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (store *MemoryObjectStore) Put(key string, data []byte, contentType string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.objects == nil {
+		store.objects = map[string][]byte{}
+	}
+	store.objects[key] = append([]byte{}, data...)
+	return nil
+}
+
+func (store *MemoryObjectStore) Get(key string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	data, ok := store.objects[key]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (store *MemoryObjectStore) Delete(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.objects, key)
+	return nil
+}
@@ -0,0 +1,177 @@
+package qaimservices
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+# Phone Verification Codes
+A 6 digit code is texted (see sms.go) to prove a phone number belongs to the user, at signup
+and to reset a forgotten password. Each number has at most one pending code per purpose:
+  - it expires after OtpTtl and is refused after OtpMaxAttempts wrong guesses
+  - a new code replaces the pending one, but not within OtpResendAfter of it
+  - sending codes is limited per number (OtpPhoneRateLimit) and client ip (OtpIpRateLimit)
+
+Codes are stored as bcrypt hashes and used up by the first successful VerifyOtp
+*/
+
+const (
+	OtpPurposeSignup        = "signup"
+	OtpPurposePasswordReset = "password_reset"
+
+	OtpTtl         = time.Minute * 10
+	OtpResendAfter = time.Minute
+	OtpMaxAttempts = 5
+)
+
+var (
+	OtpPhoneRateLimit = RateLimit{Name: "otp-phone", Burst: 5, Per: time.Hour}
+	OtpIpRateLimit    = RateLimit{Name: "otp-ip", Burst: 20, Per: time.Hour}
+)
+
+var (
+	ErrOtpInvalid  = errors.New("the code is wrong or has expired, request a new one")
+	ErrOtpAttempts = errors.New("too many wrong codes, request a new one")
+	ErrOtpCooldown = errors.New("a code was just sent, wait before requesting another")
+)
+
+func newOtpCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func otpMessage(purpose string, code string) string {
+	if purpose == OtpPurposePasswordReset {
+		return fmt.Sprintf("Your Qaim password reset code is %s. It expires in %d minutes, don't share it with anyone.", code, int(OtpTtl.Minutes()))
+	}
+	return fmt.Sprintf("Your Qaim verification code is %s. It expires in %d minutes, don't share it with anyone.", code, int(OtpTtl.Minutes()))
+}
+
+// LimitOtpsByIp limits requests for codes by their client ip
+var LimitOtpsByIp = limitRequests(OtpIpRateLimit, ClientIp)
+
+/*
+AllowOtp answers 429 when codes were sent to the number too often
+@return false when the request was answered and must stop
+*/
+func AllowOtp(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, phoneNum string) bool {
+	wait, err := TakeRateLimitToken(connPool, OtpPhoneRateLimit, phoneNum)
+	if err != nil {
+		fmt.Println("error taking rate limit token", OtpPhoneRateLimit.Name, err)
+		ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return false
+	}
+	if wait > 0 {
+		ServeRateLimited(w, r, ErrCodeRateLimited, wait, "too many codes were sent to this number, try again later")
+		return false
+	}
+	return true
+}
+
+// IssueOtp texts a new code for purpose to the number, replacing its pending one
+func IssueOtp(connPool *pgxpool.Pool, phoneNum string, purpose string) error {
+	code, err := newOtpCode()
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tag, err := connPool.Exec(context.Background(), `
+		INSERT INTO PUBLIC.phone_otps (phone_number, purpose, code_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (phone_number, purpose) DO UPDATE
+		SET code_hash = EXCLUDED.code_hash, attempts = 0, expires_at = EXCLUDED.expires_at, created_at = EXCLUDED.created_at
+		WHERE phone_otps.created_at < $6
+	`, phoneNum, purpose, hash, now.Add(OtpTtl), now, now.Add(-OtpResendAfter))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrOtpCooldown
+	}
+	err = SendSms(phoneNum, otpMessage(purpose, code))
+	if err != nil {
+		// a code that never arrived mustn't hold back the next request
+		_, delErr := connPool.Exec(context.Background(),
+			"DELETE FROM PUBLIC.phone_otps WHERE phone_number = $1 AND purpose = $2", phoneNum, purpose)
+		if delErr != nil {
+			fmt.Println("error removing unsent otp", delErr)
+		}
+	}
+	return err
+}
+
+/*
+VerifyOtp checks the number's pending code for purpose, using it up when it matches.
+Wrong guesses are counted even if the caller's request fails afterwards
+*/
+func VerifyOtp(connPool *pgxpool.Pool, phoneNum string, purpose string, code string) error {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
+	var hash []byte
+	var attempts int
+	var expired bool
+	err = tx.QueryRow(context.TODO(), `
+		SELECT code_hash, attempts, expires_at <= NOW()
+		FROM PUBLIC.phone_otps
+		WHERE phone_number = $1 AND purpose = $2
+		FOR UPDATE
+	`, phoneNum, purpose).Scan(&hash, &attempts, &expired)
+	if err == pgx.ErrNoRows || (err == nil && expired) {
+		return ErrOtpInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if attempts >= OtpMaxAttempts {
+		return ErrOtpAttempts
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(code)) != nil {
+		_, err = tx.Exec(context.TODO(),
+			"UPDATE PUBLIC.phone_otps SET attempts = attempts + 1 WHERE phone_number = $1 AND purpose = $2", phoneNum, purpose)
+		if err == nil {
+			err = tx.Commit(context.TODO())
+		}
+		if err != nil {
+			return err
+		}
+		if attempts+1 >= OtpMaxAttempts {
+			return ErrOtpAttempts
+		}
+		return ErrOtpInvalid
+	}
+	_, err = tx.Exec(context.TODO(),
+		"DELETE FROM PUBLIC.phone_otps WHERE phone_number = $1 AND purpose = $2", phoneNum, purpose)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.TODO())
+}
+
+// PurgeExpiredOtps removes codes that can no longer be used
+func PurgeExpiredOtps(connPool *pgxpool.Pool) {
+	_, err := connPool.Exec(context.Background(), "DELETE FROM PUBLIC.phone_otps WHERE expires_at < NOW()")
+	if err != nil {
+		fmt.Println("error purging expired otps", err)
+		EmailErrorLog("PurgeExpiredOtps: Error purging expired otps", err.Error())
+	}
+}
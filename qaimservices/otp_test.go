@@ -0,0 +1,207 @@
+package qaimservices
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// capturingSmsSender keeps the texted messages so tests can read the codes
+type capturingSmsSender struct {
+	messages []string
+	err      error
+}
+
+func (s *capturingSmsSender) Send(to string, message string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+var otpCodeRgx = regexp.MustCompile(`\b\d{6}\b`)
+
+func (s *capturingSmsSender) lastCode(t *testing.T) string {
+	t.Helper()
+	if len(s.messages) == 0 {
+		t.Fatal("no code was texted")
+	}
+	code := otpCodeRgx.FindString(s.messages[len(s.messages)-1])
+	if code == "" {
+		t.Fatalf("no code in %q", s.messages[len(s.messages)-1])
+	}
+	return code
+}
+
+// useCapturingSmsSender replaces the sms sender for the test
+func useCapturingSmsSender(t *testing.T) *capturingSmsSender {
+	t.Helper()
+	previous := smsSender
+	t.Cleanup(func() { smsSender = previous })
+	sender := &capturingSmsSender{}
+	SetSmsSender(sender)
+	return sender
+}
+
+// testOtpPhoneNum returns an unused number whose codes are removed when the test ends
+func testOtpPhoneNum(t *testing.T, connPool *pgxpool.Pool) string {
+	t.Helper()
+	phoneNum := "0399" + randomHex(t, 4)[:7]
+	t.Cleanup(func() {
+		connPool.Exec(context.Background(), "DELETE FROM PUBLIC.phone_otps WHERE phone_number = $1", phoneNum)
+	})
+	return phoneNum
+}
+
+// wrongOtpCode is a code that isn't code
+func wrongOtpCode(code string) string {
+	if code == "000000" {
+		return "111111"
+	}
+	return "000000"
+}
+
+func otpAttempts(t *testing.T, connPool *pgxpool.Pool, phoneNum string) int {
+	t.Helper()
+	var attempts int
+	err := connPool.QueryRow(context.Background(),
+		"SELECT attempts FROM PUBLIC.phone_otps WHERE phone_number = $1 AND purpose = $2",
+		phoneNum, OtpPurposeSignup).Scan(&attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attempts
+}
+
+func TestOtpSingleUse(t *testing.T) {
+	connPool := testConnPool(t)
+	sender := useCapturingSmsSender(t)
+	phoneNum := testOtpPhoneNum(t, connPool)
+
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != nil {
+		t.Fatal(err)
+	}
+	code := sender.lastCode(t)
+	if err := VerifyOtp(connPool, phoneNum, OtpPurposePasswordReset, code); err != ErrOtpInvalid {
+		t.Fatalf("code verified for another purpose: %v", err)
+	}
+	if err := VerifyOtp(connPool, phoneNum, OtpPurposeSignup, code); err != nil {
+		t.Fatalf("correct code refused: %v", err)
+	}
+	if err := VerifyOtp(connPool, phoneNum, OtpPurposeSignup, code); err != ErrOtpInvalid {
+		t.Fatalf("code verified twice: %v", err)
+	}
+}
+
+func TestOtpAttempts(t *testing.T) {
+	connPool := testConnPool(t)
+	sender := useCapturingSmsSender(t)
+	phoneNum := testOtpPhoneNum(t, connPool)
+
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != nil {
+		t.Fatal(err)
+	}
+	code := sender.lastCode(t)
+	wrong := wrongOtpCode(code)
+	for i := 1; i < OtpMaxAttempts; i++ {
+		if err := VerifyOtp(connPool, phoneNum, OtpPurposeSignup, wrong); err != ErrOtpInvalid {
+			t.Fatalf("wrong guess %d: %v, want ErrOtpInvalid", i, err)
+		}
+		// the guess is committed although VerifyOtp failed
+		if attempts := otpAttempts(t, connPool, phoneNum); attempts != i {
+			t.Fatalf("after wrong guess %d attempts = %d", i, attempts)
+		}
+	}
+	if err := VerifyOtp(connPool, phoneNum, OtpPurposeSignup, wrong); err != ErrOtpAttempts {
+		t.Fatalf("wrong guess %d: %v, want ErrOtpAttempts", OtpMaxAttempts, err)
+	}
+	if err := VerifyOtp(connPool, phoneNum, OtpPurposeSignup, code); err != ErrOtpAttempts {
+		t.Fatalf("correct code after lockout: %v, want ErrOtpAttempts", err)
+	}
+}
+
+func TestOtpExpired(t *testing.T) {
+	connPool := testConnPool(t)
+	sender := useCapturingSmsSender(t)
+	phoneNum := testOtpPhoneNum(t, connPool)
+
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != nil {
+		t.Fatal(err)
+	}
+	_, err := connPool.Exec(context.Background(),
+		"UPDATE PUBLIC.phone_otps SET expires_at = NOW() - INTERVAL '1 second' WHERE phone_number = $1", phoneNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyOtp(connPool, phoneNum, OtpPurposeSignup, sender.lastCode(t)); err != ErrOtpInvalid {
+		t.Fatalf("expired code: %v, want ErrOtpInvalid", err)
+	}
+}
+
+func TestOtpCooldown(t *testing.T) {
+	connPool := testConnPool(t)
+	sender := useCapturingSmsSender(t)
+	phoneNum := testOtpPhoneNum(t, connPool)
+
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != nil {
+		t.Fatal(err)
+	}
+	first := sender.lastCode(t)
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != ErrOtpCooldown {
+		t.Fatalf("resend within OtpResendAfter: %v, want ErrOtpCooldown", err)
+	}
+	if len(sender.messages) != 1 {
+		t.Fatalf("%d codes texted, want 1", len(sender.messages))
+	}
+	// the other purpose has its own code
+	if err := IssueOtp(connPool, phoneNum, OtpPurposePasswordReset); err != nil {
+		t.Fatal(err)
+	}
+
+	// once OtpResendAfter passed, a new code replaces the pending one and its attempts
+	if err := VerifyOtp(connPool, phoneNum, OtpPurposeSignup, wrongOtpCode(first)); err != ErrOtpInvalid {
+		t.Fatal(err)
+	}
+	_, err := connPool.Exec(context.Background(),
+		"UPDATE PUBLIC.phone_otps SET created_at = $2 WHERE phone_number = $1 AND purpose = $3",
+		phoneNum, time.Now().Add(-OtpResendAfter-time.Second), OtpPurposeSignup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != nil {
+		t.Fatalf("resend after OtpResendAfter: %v", err)
+	}
+	if attempts := otpAttempts(t, connPool, phoneNum); attempts != 0 {
+		t.Fatalf("attempts = %d after a resend, want 0", attempts)
+	}
+	second := sender.lastCode(t)
+	if first != second {
+		if err = VerifyOtp(connPool, phoneNum, OtpPurposeSignup, first); err != ErrOtpInvalid {
+			t.Fatalf("replaced code: %v, want ErrOtpInvalid", err)
+		}
+	}
+	if err = VerifyOtp(connPool, phoneNum, OtpPurposeSignup, second); err != nil {
+		t.Fatalf("new code refused: %v", err)
+	}
+}
+
+func TestOtpUnsentCodeReleased(t *testing.T) {
+	connPool := testConnPool(t)
+	sender := useCapturingSmsSender(t)
+	phoneNum := testOtpPhoneNum(t, connPool)
+
+	sender.err = errors.New("gateway down")
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != sender.err {
+		t.Fatalf("IssueOtp: %v, want the sender's error", err)
+	}
+	// the code never arrived, so requesting another isn't held back by the cooldown
+	sender.err = nil
+	if err := IssueOtp(connPool, phoneNum, OtpPurposeSignup); err != nil {
+		t.Fatalf("retry after a failed send: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package qaimservices
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Outbox
+Emails are queued in public.mail_outbox and delivered by DeliverOutbox, so a failing
+mail server delays emails instead of losing them or taking the server down.
+A failed send is retried with exponential backoff, after OutboxMaxAttempts the email is
+marked failed and left in the table for inspection
+*/
+
+const (
+	OutboxMaxAttempts = 8
+	OutboxBatchSize   = 20
+	outboxBaseBackoff = time.Minute
+	outboxMaxBackoff  = time.Hour * 6
+)
+
+// outboxBackoff is the wait before the next attempt, after attempts failed sends
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
+
+// QueueEmail stores msg in the outbox and starts delivering it in the background
+func QueueEmail(connPool *pgxpool.Pool, to []string, subject string, msg []byte) error {
+	_, err := connPool.Exec(context.Background(), `
+		INSERT INTO PUBLIC.mail_outbox (sender, recipients, subject, message)
+		VALUES ($1, $2, $3, $4)
+	`, mailSender(), to, subject, msg)
+	if err != nil {
+		return err
+	}
+	go DeliverOutbox(connPool)
+	return nil
+}
+
+/*
+DeliverOutbox sends up to OutboxBatchSize due emails, one transaction per email
+rows are locked while they are sent, so concurrent workers never send the same email twice
+*/
+func DeliverOutbox(connPool *pgxpool.Pool) {
+	if mailer == nil {
+		fmt.Println("outbox: no mailer configured")
+		return
+	}
+	for i := 0; i < OutboxBatchSize; i++ {
+		delivered, err := deliverNextEmail(connPool)
+		if err != nil {
+			fmt.Println("outbox: error delivering email", err)
+			return
+		}
+		if !delivered {
+			return
+		}
+	}
+}
+
+// deliverNextEmail attempts the oldest due email, returning false when none is due
+func deliverNextEmail(connPool *pgxpool.Pool) (bool, error) {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.TODO())
+
+	var id int64
+	var attempts int
+	var sender, subject string
+	var recipients []string
+	var msg []byte
+	err = tx.QueryRow(context.TODO(), `
+		SELECT id, sender, recipients, subject, message, attempts
+		FROM PUBLIC.mail_outbox
+		WHERE sent_at IS NULL AND failed_at IS NULL AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`).Scan(&id, &sender, &recipients, &subject, &msg, &attempts)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	sendErr := mailer.Send(sender, recipients, msg)
+	if sendErr == nil {
+		_, err = tx.Exec(context.TODO(),
+			"UPDATE PUBLIC.mail_outbox SET sent_at = NOW(), attempts = attempts + 1, last_error = NULL WHERE id = $1", id)
+	} else {
+		attempts++
+		fmt.Printf("outbox: sending email %d (%s) failed, attempt %d: %v\n", id, subject, attempts, sendErr)
+		if attempts >= OutboxMaxAttempts {
+			_, err = tx.Exec(context.TODO(), `
+				UPDATE PUBLIC.mail_outbox
+				SET attempts = $2, last_error = $3, failed_at = NOW()
+				WHERE id = $1
+			`, id, attempts, sendErr.Error())
+		} else {
+			_, err = tx.Exec(context.TODO(), `
+				UPDATE PUBLIC.mail_outbox
+				SET attempts = $2, last_error = $3, next_attempt_at = $4
+				WHERE id = $1
+			`, id, attempts, sendErr.Error(), time.Now().Add(outboxBackoff(attempts)))
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit(context.TODO())
+}
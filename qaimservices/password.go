@@ -0,0 +1,126 @@
+package qaimservices
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+/*
+# Password Policy
+New passwords (signup, reset and change) must pass CheckPasswordPolicy:
+  - 8 to 100 printable characters, any of them, see ValidatePassword
+  - a zxcvbn score of at least MinPasswordScore, the user's own details count as guessable
+  - not on the list of breached passwords
+
+The breached list is kept in the k-anonymity layout of the pwned passwords api, sha1 hashes
+grouped by their first 5 hex characters. A list is bundled, BREACHED_PASSWORDS_FILE replaces it with
+a larger one, e.g. a pwned passwords download, one "HASH" or "HASH:COUNT" per line
+*/
+
+const (
+	// zxcvbn scores run from 0 (too guessable) to 4 (very unguessable)
+	MinPasswordScore = 3
+	breachPrefixLen  = 5
+)
+
+var (
+	ErrPasswordFormat   = errors.New("must be 8 to 100 printable characters")
+	ErrPasswordWeak     = errors.New("is too easy to guess, use a longer password or a few uncommon words")
+	ErrPasswordBreached = errors.New("appeared in a data breach, choose another password")
+)
+
+//go:embed passwords/breached_sha1.txt
+var bundledBreachedPasswords string
+
+// breachedRanges maps the first 5 hex characters of a sha1 to the rest of the breached hashes starting with them
+var breachedRanges map[string][]string
+
+// parseBreachedPasswords reads a sha1 list into ranges, lines starting with # are comments
+func parseBreachedPasswords(reader io.Reader) (map[string][]string, error) {
+	ranges := map[string][]string{}
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("line %d is not a sha1 hash", line)
+		}
+		prefix := hash[:breachPrefixLen]
+		ranges[prefix] = append(ranges[prefix], hash[breachPrefixLen:])
+	}
+	return ranges, scanner.Err()
+}
+
+// LoadBreachedPasswords reads BREACHED_PASSWORDS_FILE, keeping the bundled list when it isn't set
+func LoadBreachedPasswords() error {
+	path := os.Getenv("BREACHED_PASSWORDS_FILE")
+	if path == "" {
+		ranges, err := parseBreachedPasswords(strings.NewReader(bundledBreachedPasswords))
+		if err != nil {
+			return fmt.Errorf("bundled breached passwords: %w", err)
+		}
+		breachedRanges = ranges
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("BREACHED_PASSWORDS_FILE: %w", err)
+	}
+	defer file.Close()
+	ranges, err := parseBreachedPasswords(file)
+	if err != nil {
+		return fmt.Errorf("BREACHED_PASSWORDS_FILE: %w", err)
+	}
+	breachedRanges = ranges
+	return nil
+}
+
+// PasswordBreached looks the password up by the prefix of its sha1, then compares the rest
+func PasswordBreached(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	for _, suffix := range breachedRanges[hash[:breachPrefixLen]] {
+		if suffix == hash[breachPrefixLen:] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+CheckPasswordPolicy reports why a new password can't be used, nil when it can
+@param userInputs the user's own details (name, phone number, ...), a password built from them is weak
+*/
+func CheckPasswordPolicy(password string, userInputs ...string) error {
+	if !ValidatePassword(password) {
+		return ErrPasswordFormat
+	}
+	if PasswordBreached(password) {
+		return ErrPasswordBreached
+	}
+	inputs := []string{"qaim"}
+	for _, input := range userInputs {
+		if input != "" {
+			inputs = append(inputs, strings.ToLower(input))
+		}
+	}
+	if zxcvbn.PasswordStrength(password, inputs).Score < MinPasswordScore {
+		return ErrPasswordWeak
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package qaimservices
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useBundledBreachedPasswords loads the bundled list for the test, restoring the previous ranges after it
+func useBundledBreachedPasswords(t *testing.T) {
+	t.Helper()
+	previous := breachedRanges
+	t.Cleanup(func() { breachedRanges = previous })
+	t.Setenv("BREACHED_PASSWORDS_FILE", "")
+	if err := LoadBreachedPasswords(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseBreachedPasswords(t *testing.T) {
+	list := "# comment\n\n" +
+		"5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8:3861493\n" +
+		"5BAA6AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA\n" +
+		"  B0399D2029F64D445BD131FFAA399A42D2F8E7DC  \n"
+	ranges, err := parseBreachedPasswords(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || len(ranges["5BAA6"]) != 2 || len(ranges["B0399"]) != 1 {
+		t.Fatalf("ranges %v, want 2 hashes under 5BAA6 and 1 under B0399", ranges)
+	}
+
+	for _, bad := range []string{
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8A",
+		"ZBAA61E4C9B93F3F0682250B6CF8331B7EE68FD8",
+		"password",
+	} {
+		if _, err := parseBreachedPasswords(strings.NewReader("# header\n" + bad + "\n")); err == nil {
+			t.Errorf("line %q parsed as a sha1", bad)
+		}
+	}
+}
+
+func TestLoadBreachedPasswordsFile(t *testing.T) {
+	previous := breachedRanges
+	t.Cleanup(func() { breachedRanges = previous })
+	// a list with a single hash standing in for a deployment's own download
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+	err := os.WriteFile(path, []byte("C54F1A4E6C2C2D7D4E4B7B1B3E0C8F6D2E1B9A10:1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BREACHED_PASSWORDS_FILE", path)
+	if err = LoadBreachedPasswords(); err != nil {
+		t.Fatal(err)
+	}
+	if PasswordBreached("password") {
+		t.Error("the configured file didn't replace the bundled list")
+	}
+
+	t.Setenv("BREACHED_PASSWORDS_FILE", filepath.Join(t.TempDir(), "missing.txt"))
+	if err = LoadBreachedPasswords(); err == nil {
+		t.Error("a missing BREACHED_PASSWORDS_FILE loaded")
+	}
+}
+
+func TestPasswordBreached(t *testing.T) {
+	useBundledBreachedPasswords(t)
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"qwertyuiop", true},
+		// the list is exact, case and additions make another hash
+		{"PASSWORD", false},
+		{"correct.horse*battery'staple>", false},
+	}
+	for _, tt := range tests {
+		if got := PasswordBreached(tt.password); got != tt.want {
+			t.Errorf("PasswordBreached(%q) = %v, want %v", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	useBundledBreachedPasswords(t)
+	userInputs := []string{"Ayesha", "Siddiqui", "03001234567", "3520112345671"}
+	tests := []struct {
+		name     string
+		password string
+		want     error
+	}{
+		{"breached", "qwertyuiop", ErrPasswordBreached},
+		{"breached before weak", "password", ErrPasswordBreached},
+		{"the user's name and number", "Ayesha03001234567", ErrPasswordWeak},
+		{"the user's names", "siddiquiayesha", ErrPasswordWeak},
+		{"the user's national id", "3520112345671", ErrPasswordWeak},
+		{"the app's name", "qaimqaimqaim", ErrPasswordWeak},
+		{"short", "x.*'>9a", ErrPasswordFormat},
+		{"too long", strings.Repeat("a", 101), ErrPasswordFormat},
+		{"control character", "correct\nhorse battery", ErrPasswordFormat},
+		{"invalid utf8", "correct horse \xff battery", ErrPasswordFormat},
+		// characters the old ValidatePassword refused are fine now
+		{"punctuation", "correct.horse*battery'staple>", nil},
+		{"quotes and brackets", `"Kettle"<in>the\mango.grove*`, nil},
+		{"spaces and unicode", "چائے اور پکوڑے barish mein", nil},
+	}
+	for _, tt := range tests {
+		if got := CheckPasswordPolicy(tt.password, userInputs...); got != tt.want {
+			t.Errorf("%s: CheckPasswordPolicy(%q) = %v, want %v", tt.name, tt.password, got, tt.want)
+		}
+	}
+}
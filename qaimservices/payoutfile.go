@@ -0,0 +1,319 @@
+package qaimservices
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	qs "qaimbe/qaimstructs"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+# Payout Files
+Payout batches are exported in the bank's bulk transfer layout, configured with
+PAYOUT_FILE_LAYOUT, a json document such as
+
+	{"Format": "fixed", "AmountFormat": "minor", "DebitAccount": "PK36SCBL0000001123456702", "Fields": [
+		{"Name": "literal", "Value": "T", "Width": 1}, {"Name": "reference", "Width": 16},
+		{"Name": "iban", "Width": 24}, {"Name": "name", "Width": 35}, {"Name": "amount", "Width": 15}]}
+
+Format is csv (the default) or fixed. Fields are literal, reference, iban, name, national_id,
+amount, date and debit_account. AmountFormat writes amounts as whole rupees (units), with two
+decimals (decimal) or in paisa (minor).
+Fixed width amounts are zero padded on the left and text is space padded on the right, a value
+that doesn't fit its width fails the export, only names are cut to fit.
+
+The bank's response is read as a csv with a header row, ResponseColumns names the columns
+holding our reference, the transfer's status, the bank's reference and a failure reason.
+A transfer succeeded when its status is one of SuccessStatuses, every other status failed it
+*/
+
+const (
+	PayoutFormatCsv   = "csv"
+	PayoutFormatFixed = "fixed"
+)
+
+type payoutField struct {
+	Name  string
+	Width int
+	// the text of literal fields
+	Value string
+}
+
+type payoutResponseColumns struct {
+	Reference     string
+	Status        string
+	BankReference string
+	Reason        string
+}
+
+type payoutLayout struct {
+	Format       string
+	Delimiter    string
+	Header       bool
+	CRLF         bool
+	AmountFormat string
+	DateFormat   string
+	DebitAccount string
+	Fields       []payoutField
+
+	ResponseColumns payoutResponseColumns
+	SuccessStatuses []string
+}
+
+// payoutResult is one transfer of the bank's response file
+type payoutResult struct {
+	Reference     string
+	Succeeded     bool
+	BankReference string
+	Reason        string
+}
+
+var payoutFieldNames = map[string]bool{
+	"literal": true, "reference": true, "iban": true, "name": true,
+	"national_id": true, "amount": true, "date": true, "debit_account": true,
+}
+
+var payoutFileLayout = defaultPayoutLayout()
+
+func defaultPayoutLayout() payoutLayout {
+	return payoutLayout{
+		Format:       PayoutFormatCsv,
+		Delimiter:    ",",
+		Header:       true,
+		AmountFormat: "units",
+		DateFormat:   "2006-01-02",
+		Fields:       []payoutField{{Name: "reference"}, {Name: "iban"}, {Name: "name"}, {Name: "amount"}},
+		ResponseColumns: payoutResponseColumns{
+			Reference: "reference", Status: "status", BankReference: "bank_reference", Reason: "reason",
+		},
+		SuccessStatuses: []string{"success", "succeeded", "paid", "processed"},
+	}
+}
+
+// LoadPayoutLayout reads the bank's bulk transfer layout, keeping the csv default when none is set
+func LoadPayoutLayout() error {
+	cfg := os.Getenv("PAYOUT_FILE_LAYOUT")
+	if cfg == "" {
+		return nil
+	}
+	layout, err := parsePayoutLayout([]byte(cfg))
+	if err != nil {
+		return fmt.Errorf("PAYOUT_FILE_LAYOUT: %w", err)
+	}
+	payoutFileLayout = layout
+	return nil
+}
+
+// parsePayoutLayout reads a layout over the defaults, so a config only names what differs
+func parsePayoutLayout(data []byte) (payoutLayout, error) {
+	layout := defaultPayoutLayout()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&layout); err != nil {
+		return layout, err
+	}
+	switch layout.Format {
+	case PayoutFormatCsv:
+		if utf8.RuneCountInString(layout.Delimiter) != 1 {
+			return layout, errors.New("the csv delimiter must be a single character")
+		}
+	case PayoutFormatFixed:
+	default:
+		return layout, fmt.Errorf("unknown format %q", layout.Format)
+	}
+	switch layout.AmountFormat {
+	case "units", "decimal", "minor":
+	default:
+		return layout, fmt.Errorf("unknown amount format %q", layout.AmountFormat)
+	}
+	if len(layout.Fields) == 0 {
+		return layout, errors.New("the layout has no fields")
+	}
+	for _, field := range layout.Fields {
+		if !payoutFieldNames[field.Name] {
+			return layout, fmt.Errorf("unknown field %q", field.Name)
+		}
+		if layout.Format == PayoutFormatFixed && field.Width <= 0 {
+			return layout, fmt.Errorf("field %q needs a width in a fixed width layout", field.Name)
+		}
+	}
+	if layout.ResponseColumns.Reference == "" || layout.ResponseColumns.Status == "" {
+		return layout, errors.New("the response needs reference and status columns")
+	}
+	if len(layout.SuccessStatuses) == 0 {
+		return layout, errors.New("no success statuses")
+	}
+	return layout, nil
+}
+
+func (layout payoutLayout) formatAmount(amount int64) string {
+	switch layout.AmountFormat {
+	case "decimal":
+		return strconv.FormatInt(amount, 10) + ".00"
+	case "minor":
+		return strconv.FormatInt(amount*100, 10)
+	}
+	return strconv.FormatInt(amount, 10)
+}
+
+func (layout payoutLayout) fieldValue(field payoutField, item qs.PayoutItem, date time.Time) string {
+	switch field.Name {
+	case "literal":
+		return field.Value
+	case "reference":
+		return item.Reference
+	case "iban":
+		return item.Iban
+	case "name":
+		return item.Name
+	case "national_id":
+		return item.NationalId
+	case "amount":
+		return layout.formatAmount(item.Amount)
+	case "date":
+		return date.Format(layout.DateFormat)
+	case "debit_account":
+		return layout.DebitAccount
+	}
+	return ""
+}
+
+// fixedWidth pads value to width, failing when it doesn't fit
+func fixedWidth(field payoutField, value string) (string, error) {
+	length := utf8.RuneCountInString(value)
+	if length > field.Width {
+		if field.Name != "name" {
+			return "", fmt.Errorf("%s %q is longer than %d characters", field.Name, value, field.Width)
+		}
+		value, length = string([]rune(value)[:field.Width]), field.Width
+	}
+	if field.Name == "amount" {
+		return strings.Repeat("0", field.Width-length) + value, nil
+	}
+	return value + strings.Repeat(" ", field.Width-length), nil
+}
+
+func renderPayoutFile(layout payoutLayout, batch qs.PayoutBatch, date time.Time) ([]byte, error) {
+	var out bytes.Buffer
+	if layout.Format == PayoutFormatFixed {
+		newline := "\n"
+		if layout.CRLF {
+			newline = "\r\n"
+		}
+		for _, item := range batch.Items {
+			for _, field := range layout.Fields {
+				value, err := fixedWidth(field, layout.fieldValue(field, item, date))
+				if err != nil {
+					return nil, fmt.Errorf("transfer %s: %w", item.Reference, err)
+				}
+				out.WriteString(value)
+			}
+			out.WriteString(newline)
+		}
+		return out.Bytes(), nil
+	}
+
+	writer := csv.NewWriter(&out)
+	writer.Comma, _ = utf8.DecodeRuneInString(layout.Delimiter)
+	writer.UseCRLF = layout.CRLF
+	if layout.Header {
+		header := make([]string, len(layout.Fields))
+		for i, field := range layout.Fields {
+			header[i] = field.Name
+		}
+		writer.Write(header)
+	}
+	for _, item := range batch.Items {
+		record := make([]string, len(layout.Fields))
+		for i, field := range layout.Fields {
+			record[i] = layout.fieldValue(field, item, date)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return out.Bytes(), writer.Error()
+}
+
+// RenderPayoutFile exports the batch's transfers in the configured bank layout
+func RenderPayoutFile(batch qs.PayoutBatch) ([]byte, error) {
+	return renderPayoutFile(payoutFileLayout, batch, time.Now())
+}
+
+// PayoutFileName is the name the batch's bank file is downloaded as
+func PayoutFileName(batch qs.PayoutBatch) string {
+	if payoutFileLayout.Format == PayoutFormatFixed {
+		return fmt.Sprintf("payout-batch-%d.txt", batch.Id)
+	}
+	return fmt.Sprintf("payout-batch-%d.csv", batch.Id)
+}
+
+func parsePayoutResponse(layout payoutLayout, data []byte) ([]payoutResult, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma, _ = utf8.DecodeRuneInString(layout.Delimiter)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("the response file has no header row")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	column := func(name string) int {
+		if name == "" {
+			return -1
+		}
+		if i, ok := columns[strings.ToLower(name)]; ok {
+			return i
+		}
+		return -1
+	}
+	refCol, statusCol := column(layout.ResponseColumns.Reference), column(layout.ResponseColumns.Status)
+	bankRefCol, reasonCol := column(layout.ResponseColumns.BankReference), column(layout.ResponseColumns.Reason)
+	if refCol < 0 || statusCol < 0 {
+		return nil, fmt.Errorf("the response file needs %q and %q columns",
+			layout.ResponseColumns.Reference, layout.ResponseColumns.Status)
+	}
+	cell := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var results []payoutResult
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		result := payoutResult{Reference: cell(record, refCol), BankReference: cell(record, bankRefCol), Reason: cell(record, reasonCol)}
+		if result.Reference == "" {
+			continue
+		}
+		status := cell(record, statusCol)
+		for _, success := range layout.SuccessStatuses {
+			if strings.EqualFold(status, success) {
+				result.Succeeded = true
+			}
+		}
+		if !result.Succeeded && result.Reason == "" {
+			result.Reason = "transfer failed with status " + status
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
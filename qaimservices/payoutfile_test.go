@@ -0,0 +1,172 @@
+package qaimservices
+
+import (
+	qs "qaimbe/qaimstructs"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPayoutBatch() qs.PayoutBatch {
+	return qs.PayoutBatch{Id: 3, Items: []qs.PayoutItem{
+		{Reference: "QP3T1", Iban: "PK36SCBL0000001123456702", Name: "Ayesha Khan", NationalId: "3520112345671", Amount: 2500},
+		{Reference: "QP3T2", Iban: "PK24MEZN0001230101234567", Name: "Muhammad Abdullah Siddiqui Qureshi", NationalId: "4210198765432", Amount: 75},
+	}}
+}
+
+func TestParsePayoutLayout(t *testing.T) {
+	layout, err := parsePayoutLayout([]byte(`{"Format": "fixed", "AmountFormat": "minor",
+		"Fields": [{"Name": "literal", "Value": "T", "Width": 1}, {"Name": "amount", "Width": 10}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what the config doesn't name keeps its default
+	if layout.Format != PayoutFormatFixed || layout.Delimiter != "," || layout.ResponseColumns.Status != "status" {
+		t.Fatalf("layout %+v didn't keep the defaults", layout)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"not json", `fixed`},
+		{"unknown key", `{"Fromat": "fixed"}`},
+		{"unknown format", `{"Format": "xml"}`},
+		{"long delimiter", `{"Delimiter": ";;"}`},
+		{"empty delimiter", `{"Delimiter": ""}`},
+		{"unknown amount format", `{"AmountFormat": "lakh"}`},
+		{"no fields", `{"Fields": []}`},
+		{"unknown field", `{"Fields": [{"Name": "password"}]}`},
+		{"fixed without width", `{"Format": "fixed", "Fields": [{"Name": "iban"}]}`},
+		{"no status column", `{"ResponseColumns": {"Status": ""}}`},
+		{"no success statuses", `{"SuccessStatuses": []}`},
+	}
+	for _, tt := range tests {
+		if _, err := parsePayoutLayout([]byte(tt.config)); err == nil {
+			t.Errorf("%s: layout accepted", tt.name)
+		}
+	}
+}
+
+func TestPayoutAmountFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		amount int64
+		want   string
+	}{
+		{"units", 2500, "2500"},
+		{"decimal", 2500, "2500.00"},
+		{"minor", 2500, "250000"},
+		{"minor", 0, "0"},
+		{"", 75, "75"},
+	}
+	for _, tt := range tests {
+		if got := (payoutLayout{AmountFormat: tt.format}).formatAmount(tt.amount); got != tt.want {
+			t.Errorf("%s of %d = %q, want %q", tt.format, tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestFixedWidth(t *testing.T) {
+	tests := []struct {
+		field payoutField
+		value string
+		want  string
+		ok    bool
+	}{
+		{payoutField{Name: "reference", Width: 8}, "QP3T1", "QP3T1   ", true},
+		{payoutField{Name: "amount", Width: 8}, "2500", "00002500", true},
+		{payoutField{Name: "amount", Width: 4}, "2500", "2500", true},
+		// only names are cut to fit, anything else failing the export beats paying the wrong account
+		{payoutField{Name: "amount", Width: 3}, "2500", "", false},
+		{payoutField{Name: "iban", Width: 10}, "PK36SCBL0000001123456702", "", false},
+		{payoutField{Name: "literal", Width: 1}, "TX", "", false},
+		{payoutField{Name: "name", Width: 10}, "Muhammad Abdullah", "Muhammad A", true},
+		// widths count characters, not bytes
+		{payoutField{Name: "name", Width: 4}, "Zoë Ali", "Zoë ", true},
+		{payoutField{Name: "name", Width: 6}, "Zoë", "Zoë   ", true},
+	}
+	for _, tt := range tests {
+		got, err := fixedWidth(tt.field, tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("fixedWidth(%s/%d, %q) = %q, %v, want %q, ok %v", tt.field.Name, tt.field.Width, tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRenderPayoutFile(t *testing.T) {
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	fixed, err := parsePayoutLayout([]byte(`{"Format": "fixed", "AmountFormat": "minor", "CRLF": true, "DateFormat": "020106",
+		"Fields": [{"Name": "literal", "Value": "T", "Width": 1}, {"Name": "reference", "Width": 6},
+		{"Name": "name", "Width": 12}, {"Name": "amount", "Width": 9}, {"Name": "date", "Width": 6}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvLayout, err := parsePayoutLayout([]byte(`{"Delimiter": ";", "AmountFormat": "decimal",
+		"Fields": [{"Name": "reference"}, {"Name": "iban"}, {"Name": "name"}, {"Name": "amount"}, {"Name": "debit_account"}],
+		"DebitAccount": "PK00QAIM"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		layout payoutLayout
+		want   string
+	}{
+		{"fixed", fixed, "TQP3T1 Ayesha Khan 000250000010324\r\n" + "TQP3T2 Muhammad Abd000007500010324\r\n"},
+		{"csv", csvLayout, "reference;iban;name;amount;debit_account\n" +
+			"QP3T1;PK36SCBL0000001123456702;Ayesha Khan;2500.00;PK00QAIM\n" +
+			"QP3T2;PK24MEZN0001230101234567;Muhammad Abdullah Siddiqui Qureshi;75.00;PK00QAIM\n"},
+	}
+	for _, tt := range tests {
+		out, err := renderPayoutFile(tt.layout, testPayoutBatch(), date)
+		if err != nil || string(out) != tt.want {
+			t.Errorf("%s: rendered %q, %v, want %q", tt.name, out, err, tt.want)
+		}
+	}
+
+	// a reference too long for its field fails the whole export
+	fixed.Fields[1].Width = 4
+	if _, err = renderPayoutFile(fixed, testPayoutBatch(), date); err == nil {
+		t.Error("fixed width overflow was rendered")
+	}
+}
+
+func TestParsePayoutResponse(t *testing.T) {
+	layout := defaultPayoutLayout()
+	// a BOM and mixed case headers, as spreadsheets save them
+	response := "\ufeffReference, STATUS ,Bank_Reference,Reason\n" +
+		"QP3T1,Success,BNK-991,\n" +
+		"QP3T2,PROCESSED,,\n" +
+		"QP3T3,Rejected,,account closed\n" +
+		"QP3T4,pending\n" +
+		",success,BNK-000,\n"
+	results, err := parsePayoutResponse(layout, []byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []payoutResult{
+		{Reference: "QP3T1", Succeeded: true, BankReference: "BNK-991"},
+		{Reference: "QP3T2", Succeeded: true},
+		{Reference: "QP3T3", Reason: "account closed"},
+		{Reference: "QP3T4", Reason: "transfer failed with status pending"},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("results %+v, want %+v", results, want)
+	}
+
+	bad := []struct {
+		name     string
+		response string
+	}{
+		{"empty", ""},
+		{"no status column", "reference,bank_reference\nQP3T1,BNK-991\n"},
+		{"no reference column", "ref,status\nQP3T1,success\n"},
+		{"broken quoting", "reference,status\n\"QP3T1,success\n"},
+	}
+	for _, tt := range bad {
+		if _, err := parsePayoutResponse(layout, []byte(tt.response)); err == nil {
+			t.Errorf("%s: response accepted", tt.name)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package qaimservices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	qs "qaimbe/qaimstructs"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Payout Batches
+Approved withdraw requests are grouped into a draft batch, every transfer gets a reference
+the bank echoes back in its response. Finance downloads the batch's file, uploads it to the
+bank and marks the batch submitted. The bank's response file is then uploaded to reconcile the
+batch: succeeded transfers pay out their withdraw request, failed ones reject and refund it.
+Once every transfer is settled the batch is reconciled.
+A draft batch can be discarded, its requests go back to waiting for a batch
+*/
+
+const (
+	PayoutDraft      = "draft"
+	PayoutSubmitted  = "submitted"
+	PayoutReconciled = "reconciled"
+
+	PayoutItemPending = "pending"
+	PayoutItemPaid    = "paid"
+	PayoutItemFailed  = "failed"
+
+	PayoutBatchMaxItems   = 5000
+	PayoutBatchesPageLen  = 100
+	MaxPayoutResponseSize = 5 * 1024 * 1024
+)
+
+var (
+	ErrNoPayouts          = errors.New("there are no approved withdraw requests to pay out")
+	ErrPayoutsMissingIban = errors.New("the approved withdraw requests can't be paid out, their users have no iban")
+	ErrPayoutBatchStatus  = errors.New("payout batch isn't in the right status")
+	ErrPayoutResponse     = errors.New("invalid bank response file")
+)
+
+// dbQuerier is what a pool and a transaction have in common
+type dbQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+const payoutBatchColumns = `
+	id, status, item_count, total_amount, created_by, created_at, COALESCE(submitted_by, ''), submitted_at, reconciled_at
+`
+
+func scanPayoutBatch(row pgx.Row) (qs.PayoutBatch, error) {
+	var batch qs.PayoutBatch
+	err := row.Scan(&batch.Id, &batch.Status, &batch.ItemCount, &batch.TotalAmount, &batch.CreatedBy, &batch.CreatedAt,
+		&batch.SubmittedBy, &batch.SubmittedAt, &batch.ReconciledAt)
+	return batch, err
+}
+
+func getPayoutItems(db dbQuerier, batchId int64) ([]qs.PayoutItem, error) {
+	items := []qs.PayoutItem{}
+	rows, err := db.Query(context.TODO(), `
+		SELECT reference, request_id, user_id, iban, name, national_id, amount, status,
+			COALESCE(bank_reference, ''), failure_reason, settled_at
+		FROM PUBLIC.payout_batch_items
+		WHERE batch_id = $1
+		ORDER BY seq
+	`, batchId)
+	if err != nil {
+		return items, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item qs.PayoutItem
+		err = rows.Scan(&item.Reference, &item.RequestId, &item.UserId, &item.Iban, &item.Name, &item.NationalId,
+			&item.Amount, &item.Status, &item.BankReference, &item.FailureReason, &item.SettledAt)
+		if err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// GetPayoutBatch returns a batch with its transfers, pgx.ErrNoRows when there is none
+func GetPayoutBatch(connPool *pgxpool.Pool, batchId int64) (qs.PayoutBatch, error) {
+	batch, err := scanPayoutBatch(connPool.QueryRow(context.Background(),
+		"SELECT "+payoutBatchColumns+" FROM PUBLIC.payout_batches WHERE id = $1", batchId))
+	if err != nil {
+		return batch, err
+	}
+	batch.Items, err = getPayoutItems(connPool, batchId)
+	return batch, err
+}
+
+// LockPayoutBatch is GetPayoutBatch for update
+func LockPayoutBatch(tx pgx.Tx, batchId int64) (qs.PayoutBatch, error) {
+	batch, err := scanPayoutBatch(tx.QueryRow(context.TODO(),
+		"SELECT "+payoutBatchColumns+" FROM PUBLIC.payout_batches WHERE id = $1 FOR UPDATE", batchId))
+	if err != nil {
+		return batch, err
+	}
+	batch.Items, err = getPayoutItems(tx, batchId)
+	return batch, err
+}
+
+// ListPayoutBatches returns the latest batches without their transfers, newest first
+func ListPayoutBatches(connPool *pgxpool.Pool) ([]qs.PayoutBatch, error) {
+	batches := []qs.PayoutBatch{}
+	rows, err := connPool.Query(context.Background(),
+		"SELECT "+payoutBatchColumns+" FROM PUBLIC.payout_batches ORDER BY id DESC LIMIT $1", PayoutBatchesPageLen)
+	if err != nil {
+		return batches, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		batch, err := scanPayoutBatch(rows)
+		if err != nil {
+			return batches, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
+
+/*
+CreatePayoutBatch draws up a draft batch of the approved withdraw requests that aren't part of one yet,
+oldest first. Requests of users without an iban are left out and listed in the batch's SkippedRequests.
+Returns ErrNoPayouts when there is nothing to pay out, ErrPayoutsMissingIban when every request was skipped
+*/
+func CreatePayoutBatch(tx pgx.Tx, r *http.Request) (qs.PayoutBatch, error) {
+	batch, err := scanPayoutBatch(tx.QueryRow(context.TODO(), `
+		INSERT INTO PUBLIC.payout_batches (created_by)
+		VALUES ($1)
+		RETURNING `+payoutBatchColumns, RequestActor(r)))
+	if err != nil {
+		return batch, err
+	}
+	// the reference only uses letters and digits, bank formats rarely allow more
+	_, err = tx.Exec(context.TODO(), `
+		WITH eligible AS (
+			SELECT wdraw.request_id, wdraw.user_id, wdraw.amount, wdraw.request_date,
+				u.iban, u.first_name || ' ' || u.last_name AS name, u.national_id
+			FROM PUBLIC.user_withdraw_requests AS wdraw
+			JOIN PUBLIC.user AS u
+			ON u.uuid = wdraw.user_id
+			WHERE wdraw.status = $2 AND COALESCE(u.iban, '') <> '' AND NOT EXISTS (
+				SELECT 1 FROM PUBLIC.payout_batch_items AS item WHERE item.request_id = wdraw.request_id
+			)
+			ORDER BY wdraw.request_date
+			LIMIT $3
+			FOR UPDATE OF wdraw
+		), numbered AS (
+			SELECT e.*, ROW_NUMBER() OVER (ORDER BY e.request_date) AS seq
+			FROM eligible AS e
+		)
+		INSERT INTO PUBLIC.payout_batch_items (batch_id, seq, reference, request_id, user_id, iban, name, national_id, amount)
+		SELECT $1, n.seq, 'QP' || $1::TEXT || 'T' || n.seq::TEXT, n.request_id, n.user_id, n.iban, n.name, n.national_id, n.amount
+		FROM numbered AS n
+	`, batch.Id, WithdrawApproved, PayoutBatchMaxItems)
+	if err != nil {
+		return batch, err
+	}
+	err = tx.QueryRow(context.TODO(), `
+		SELECT COALESCE(ARRAY_AGG(wdraw.request_id::TEXT ORDER BY wdraw.request_date), '{}')
+		FROM PUBLIC.user_withdraw_requests AS wdraw
+		JOIN PUBLIC.user AS u
+		ON u.uuid = wdraw.user_id
+		WHERE wdraw.status = $1 AND COALESCE(u.iban, '') = '' AND NOT EXISTS (
+			SELECT 1 FROM PUBLIC.payout_batch_items AS item WHERE item.request_id = wdraw.request_id
+		)
+	`, WithdrawApproved).Scan(&batch.SkippedRequests)
+	if err != nil {
+		return batch, err
+	}
+	err = tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.payout_batches AS batch
+		SET item_count = totals.item_count, total_amount = totals.total_amount
+		FROM (
+			SELECT COUNT(*) AS item_count, COALESCE(SUM(amount), 0) AS total_amount
+			FROM PUBLIC.payout_batch_items
+			WHERE batch_id = $1
+		) AS totals
+		WHERE batch.id = $1
+		RETURNING batch.item_count, batch.total_amount
+	`, batch.Id).Scan(&batch.ItemCount, &batch.TotalAmount)
+	if err != nil {
+		return batch, err
+	}
+	if batch.ItemCount == 0 && len(batch.SkippedRequests) > 0 {
+		return batch, ErrPayoutsMissingIban
+	}
+	if batch.ItemCount == 0 {
+		return batch, ErrNoPayouts
+	}
+	batch.Items, err = getPayoutItems(tx, batch.Id)
+	if err != nil {
+		return batch, err
+	}
+	after := map[string]any{"ItemCount": batch.ItemCount, "TotalAmount": batch.TotalAmount}
+	if len(batch.SkippedRequests) > 0 {
+		after["SkippedRequests"] = batch.SkippedRequests
+	}
+	err = AuditTx(tx, r, qs.AuditEvent{
+		Action: "payout.create", TargetType: "payout_batch", TargetId: strconv.FormatInt(batch.Id, 10),
+		After: after,
+	})
+	return batch, err
+}
+
+// SubmitPayoutBatch records a locked draft batch as sent to the bank
+func SubmitPayoutBatch(tx pgx.Tx, r *http.Request, batch *qs.PayoutBatch) error {
+	if batch.Status != PayoutDraft {
+		return ErrPayoutBatchStatus
+	}
+	err := tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.payout_batches
+		SET status = $2, submitted_by = $3, submitted_at = NOW()
+		WHERE id = $1
+		RETURNING status, submitted_by, submitted_at
+	`, batch.Id, PayoutSubmitted, RequestActor(r)).Scan(&batch.Status, &batch.SubmittedBy, &batch.SubmittedAt)
+	if err != nil {
+		return err
+	}
+	return AuditTx(tx, r, qs.AuditEvent{
+		Action: "payout.submit", TargetType: "payout_batch", TargetId: strconv.FormatInt(batch.Id, 10),
+		Before: map[string]any{"Status": PayoutDraft},
+		After:  map[string]any{"Status": batch.Status, "ItemCount": batch.ItemCount, "TotalAmount": batch.TotalAmount},
+	})
+}
+
+// DiscardPayoutBatch deletes a locked draft batch, its requests can be batched again
+func DiscardPayoutBatch(tx pgx.Tx, r *http.Request, batch qs.PayoutBatch) error {
+	if batch.Status != PayoutDraft {
+		return ErrPayoutBatchStatus
+	}
+	_, err := tx.Exec(context.TODO(), "DELETE FROM PUBLIC.payout_batches WHERE id = $1", batch.Id)
+	if err != nil {
+		return err
+	}
+	return AuditTx(tx, r, qs.AuditEvent{
+		Action: "payout.discard", TargetType: "payout_batch", TargetId: strconv.FormatInt(batch.Id, 10),
+		Before: map[string]any{"Status": batch.Status, "ItemCount": batch.ItemCount, "TotalAmount": batch.TotalAmount},
+	})
+}
+
+// PendingPayoutBatch returns the batch a withdraw request is waiting to be paid out in, 0 when it isn't batched
+func PendingPayoutBatch(tx pgx.Tx, requestId string) (int64, error) {
+	var batchId int64
+	err := tx.QueryRow(context.TODO(),
+		"SELECT batch_id FROM PUBLIC.payout_batch_items WHERE request_id = $1 AND status = $2",
+		requestId, PayoutItemPending).Scan(&batchId)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	return batchId, err
+}
+
+/*
+ReconcilePayoutBatch settles a locked submitted batch's transfers from the bank's response file.
+Transfers the response doesn't mention stay pending for a later response,
+the batch is reconciled once none are left
+*/
+func ReconcilePayoutBatch(tx pgx.Tx, r *http.Request, batch *qs.PayoutBatch, response []byte) (qs.PayoutReconcileResult, error) {
+	result := qs.PayoutReconcileResult{Unmatched: []string{}}
+	if batch.Status != PayoutSubmitted {
+		return result, ErrPayoutBatchStatus
+	}
+	transfers, err := parsePayoutResponse(payoutFileLayout, response)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", ErrPayoutResponse, err)
+	}
+	items := map[string]*qs.PayoutItem{}
+	for i := range batch.Items {
+		items[batch.Items[i].Reference] = &batch.Items[i]
+	}
+	batchId := strconv.FormatInt(batch.Id, 10)
+
+	for _, transfer := range transfers {
+		item, ok := items[transfer.Reference]
+		if !ok {
+			result.Unmatched = append(result.Unmatched, transfer.Reference)
+			continue
+		}
+		if item.Status != PayoutItemPending {
+			result.AlreadySettled++
+			continue
+		}
+		req, err := LockWithdrawRequest(tx, item.RequestId)
+		if err != nil {
+			return result, err
+		}
+		extra := map[string]any{"PayoutBatchId": batch.Id, "PayoutReference": item.Reference}
+		if transfer.Succeeded {
+			bankReference := transfer.BankReference
+			if bankReference == "" {
+				bankReference = item.Reference
+			}
+			err = ReviewWithdrawal(tx, r, &req, WithdrawPaid, bankReference, "", extra)
+			item.Status, item.BankReference = PayoutItemPaid, bankReference
+			result.Paid++
+		} else {
+			err = ReviewWithdrawal(tx, r, &req, WithdrawRejected, "", transfer.Reason, extra)
+			item.Status, item.FailureReason = PayoutItemFailed, transfer.Reason
+			result.Failed++
+		}
+		if err != nil {
+			return result, err
+		}
+		err = tx.QueryRow(context.TODO(), `
+			UPDATE PUBLIC.payout_batch_items
+			SET status = $3, bank_reference = NULLIF($4, ''), failure_reason = $5, settled_at = NOW()
+			WHERE batch_id = $1 AND reference = $2
+			RETURNING settled_at
+		`, batch.Id, item.Reference, item.Status, item.BankReference, item.FailureReason).Scan(&item.SettledAt)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	settled := true
+	for _, item := range batch.Items {
+		if item.Status == PayoutItemPending {
+			settled = false
+		}
+	}
+	if settled {
+		err = tx.QueryRow(context.TODO(), `
+			UPDATE PUBLIC.payout_batches
+			SET status = $2, reconciled_at = NOW()
+			WHERE id = $1
+			RETURNING status, reconciled_at
+		`, batch.Id, PayoutReconciled).Scan(&batch.Status, &batch.ReconciledAt)
+		if err != nil {
+			return result, err
+		}
+	}
+	err = AuditTx(tx, r, qs.AuditEvent{
+		Action: "payout.reconcile", TargetType: "payout_batch", TargetId: batchId,
+		Before: map[string]any{"Status": PayoutSubmitted},
+		After: map[string]any{"Status": batch.Status, "Paid": result.Paid, "Failed": result.Failed,
+			"AlreadySettled": result.AlreadySettled, "Unmatched": result.Unmatched},
+	})
+	result.Batch = *batch
+	return result, err
+}
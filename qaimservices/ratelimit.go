@@ -0,0 +1,242 @@
+package qaimservices
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Rate Limits
+Requests take a token from buckets kept in postgres, so the limits hold across replicas:
+  - every request, from its client ip (IpRateLimit)
+  - every authorized request, from its subject (SubjectRateLimit)
+  - login attempts, from their client ip (LoginIpRateLimit) and their account (LoginAccountRateLimit)
+
+A bucket holds Burst tokens and refills all of them over Per. An empty bucket answers 429
+with Retry-After set to when its next token is due.
+
+Failed logins lock the account progressively, once it failed LoginLockoutThreshold times in a row
+it is locked for LoginLockoutBase, doubling with every further failure up to LoginLockoutMax.
+A successful login, or LoginFailureWindow without failures, clears the count.
+Unknown accounts are counted too, so a lockout doesn't tell whether an account exists
+*/
+
+type RateLimit struct {
+	Name  string
+	Burst int
+	Per   time.Duration
+}
+
+var (
+	IpRateLimit           = RateLimit{Name: "ip", Burst: 300, Per: time.Minute}
+	SubjectRateLimit      = RateLimit{Name: "subject", Burst: 120, Per: time.Minute}
+	LoginIpRateLimit      = RateLimit{Name: "login-ip", Burst: 20, Per: time.Minute * 10}
+	LoginAccountRateLimit = RateLimit{Name: "login-account", Burst: 10, Per: time.Hour}
+)
+
+const (
+	LoginLockoutThreshold = 5
+	LoginLockoutBase      = time.Minute
+	LoginLockoutMax       = time.Hour * 24
+	LoginFailureWindow    = time.Hour * 24
+)
+
+// ClientIp is the address the request came from, the server faces clients directly
+func ClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LoginAccount names the account a login attempt is for, kind tells users and admins apart
+func LoginAccount(kind string, login string) string {
+	return kind + ":" + login
+}
+
+/*
+TakeRateLimitToken takes a token from the key's bucket of limit
+@return how long until the bucket has a token again, zero when the token was taken
+*/
+func TakeRateLimitToken(connPool *pgxpool.Pool, limit RateLimit, key string) (time.Duration, error) {
+	bucket := limit.Name + ":" + key
+	burst := float64(limit.Burst)
+	perSecond := burst / limit.Per.Seconds()
+	_, err := connPool.Exec(context.Background(), `
+		INSERT INTO PUBLIC.rate_limit_buckets (bucket, tokens) VALUES ($1, $2)
+		ON CONFLICT (bucket) DO NOTHING
+	`, bucket, burst)
+	if err != nil {
+		return 0, err
+	}
+	// the row lock of the update serializes concurrent requests on the bucket
+	var tokens float64
+	err = connPool.QueryRow(context.Background(), `
+		UPDATE PUBLIC.rate_limit_buckets
+		SET tokens = LEAST($2::float8, tokens + EXTRACT(EPOCH FROM NOW() - updated_at)::float8 * $3::float8) - 1, updated_at = NOW()
+		WHERE bucket = $1 AND LEAST($2::float8, tokens + EXTRACT(EPOCH FROM NOW() - updated_at)::float8 * $3::float8) >= 1
+		RETURNING tokens
+	`, bucket, burst, perSecond).Scan(&tokens)
+	if err == nil {
+		return 0, nil
+	}
+	if err != pgx.ErrNoRows {
+		return 0, err
+	}
+	err = connPool.QueryRow(context.Background(), `
+		SELECT LEAST($2::float8, tokens + EXTRACT(EPOCH FROM NOW() - updated_at)::float8 * $3::float8)
+		FROM PUBLIC.rate_limit_buckets WHERE bucket = $1
+	`, bucket, burst, perSecond).Scan(&tokens)
+	if err != nil {
+		return 0, err
+	}
+	wait := time.Duration((1 - tokens) / perSecond * float64(time.Second))
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait, nil
+}
+
+// ServeRateLimited answers 429, telling the client to retry after wait
+func ServeRateLimited(w http.ResponseWriter, r *http.Request, code string, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	ServeErrorCode(w, r, http.StatusTooManyRequests, code, message)
+}
+
+// limitRequests takes a token of limit for every request, keyed by key, an empty key isn't limited
+func limitRequests(limit RateLimit, key func(r *http.Request) string) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+			k := key(r)
+			if k == "" {
+				next(w, r, connPool)
+				return
+			}
+			wait, err := TakeRateLimitToken(connPool, limit, k)
+			if err != nil {
+				// an unreachable bucket shouldn't take the api down with it
+				fmt.Println("error taking rate limit token", limit.Name, err)
+			} else if wait > 0 {
+				ServeRateLimited(w, r, ErrCodeRateLimited, wait, "too many requests, slow down")
+				return
+			}
+			next(w, r, connPool)
+		}
+	}
+}
+
+// LimitRequestsByIp limits every request by its client ip
+var LimitRequestsByIp = limitRequests(IpRateLimit, ClientIp)
+
+// LimitRequestsBySubject limits authorized requests by their caller, it runs after Authorize
+var LimitRequestsBySubject = limitRequests(SubjectRateLimit, func(r *http.Request) string {
+	if actor := RequestActor(r); actor != "anonymous" {
+		return actor
+	}
+	return ""
+})
+
+// LimitLoginsByIp limits login attempts by their client ip
+var LimitLoginsByIp = limitRequests(LoginIpRateLimit, ClientIp)
+
+/*
+AllowLoginAttempt answers 429 when the account is locked out or tried too often
+@return false when the attempt was answered and must stop
+*/
+func AllowLoginAttempt(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool, account string) bool {
+	var lockedUntil *time.Time
+	err := connPool.QueryRow(context.Background(), `
+		SELECT locked_until FROM PUBLIC.login_failures WHERE account = $1 AND locked_until > NOW()
+	`, account).Scan(&lockedUntil)
+	if err != nil && err != pgx.ErrNoRows {
+		fmt.Println("error checking login lockout", err)
+		ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return false
+	}
+	if lockedUntil != nil {
+		ServeRateLimited(w, r, ErrCodeAccountLocked, time.Until(*lockedUntil),
+			"too many failed logins, the account is locked for now")
+		return false
+	}
+	wait, err := TakeRateLimitToken(connPool, LoginAccountRateLimit, account)
+	if err != nil {
+		fmt.Println("error taking rate limit token", LoginAccountRateLimit.Name, err)
+		ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return false
+	}
+	if wait > 0 {
+		ServeRateLimited(w, r, ErrCodeRateLimited, wait, "too many login attempts, try again later")
+		return false
+	}
+	return true
+}
+
+// loginLockout is how long an account is locked after its consecutive failures
+func loginLockout(failures int) time.Duration {
+	if failures < LoginLockoutThreshold {
+		return 0
+	}
+	lockout := LoginLockoutBase
+	for i := LoginLockoutThreshold; i < failures && lockout < LoginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > LoginLockoutMax {
+		lockout = LoginLockoutMax
+	}
+	return lockout
+}
+
+// RecordLoginFailure counts a failed login of the account, locking it once it failed too often
+func RecordLoginFailure(connPool *pgxpool.Pool, account string) {
+	var failures int
+	err := connPool.QueryRow(context.Background(), `
+		INSERT INTO PUBLIC.login_failures (account, failures, last_failure_at) VALUES ($1, 1, NOW())
+		ON CONFLICT (account) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure_at < $2 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure_at = NOW()
+		RETURNING failures
+	`, account, time.Now().Add(-LoginFailureWindow)).Scan(&failures)
+	if err == nil {
+		if lockout := loginLockout(failures); lockout > 0 {
+			_, err = connPool.Exec(context.Background(),
+				"UPDATE PUBLIC.login_failures SET locked_until = $2 WHERE account = $1", account, time.Now().Add(lockout))
+		}
+	}
+	if err != nil {
+		fmt.Println("error recording login failure", err)
+	}
+}
+
+// ClearLoginFailures forgets the failed logins of an account after it logged in
+func ClearLoginFailures(connPool *pgxpool.Pool, account string) {
+	_, err := connPool.Exec(context.Background(), "DELETE FROM PUBLIC.login_failures WHERE account = $1", account)
+	if err != nil {
+		fmt.Println("error clearing login failures", err)
+	}
+}
+
+// PurgeRateLimits removes full buckets and failures that no longer count
+func PurgeRateLimits(connPool *pgxpool.Pool) {
+	// every bucket refills within a day
+	_, err := connPool.Exec(context.Background(),
+		"DELETE FROM PUBLIC.rate_limit_buckets WHERE updated_at < $1", time.Now().Add(-time.Hour*24))
+	if err == nil {
+		_, err = connPool.Exec(context.Background(), `
+			DELETE FROM PUBLIC.login_failures
+			WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < NOW())
+		`, time.Now().Add(-LoginFailureWindow))
+	}
+	if err != nil {
+		fmt.Println("error purging rate limits", err)
+		EmailErrorLog("PurgeRateLimits: Error purging rate limits", err.Error())
+	}
+}
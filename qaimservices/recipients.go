@@ -0,0 +1,93 @@
+package qaimservices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+Recipients of the MailReporting, MailLogging and MailUserNotifier lists are stored in
+public.notification_recipients and managed through /admin/notifications/recipients.
+If the table can't be read, e.g. the db is down while reporting an error, the comma
+separated MAIL_RECIPIENTS_REPORTING, MAIL_RECIPIENTS_LOGGING and MAIL_RECIPIENTS_NOTIFIER
+environment variables are used instead
+*/
+
+// * Reports, reporting list recipients can subscribe to a subset of them
+const (
+	ReportTbillHolding  = "tbill-holdings"
+	ReportTbillPurchase = "tbill-purchases"
+	ReportFundsWithdraw = "withdraw-requests"
+	ReportTbillMaturity = "tbill-maturity"
+	ReportTokenMaturity = "tbill-token-maturity"
+)
+
+// mailListReports holds the reports each list sends, lists without reports take no subscriptions
+var mailListReports = map[string][]string{
+	MailReporting:    {ReportTbillHolding, ReportTbillPurchase, ReportFundsWithdraw, ReportTbillMaturity, ReportTokenMaturity},
+	MailLogging:      {},
+	MailUserNotifier: {},
+}
+
+func ValidateMailList(list string) bool {
+	_, ok := mailListReports[list]
+	return ok
+}
+
+// ValidateMailReports checks every report is one the list sends
+func ValidateMailReports(list string, reports []string) bool {
+	for _, report := range reports {
+		found := false
+		for _, listReport := range mailListReports[list] {
+			if report == listReport {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+MailRecipients returns the addresses on list that receive report
+@param report empty for lists that don't send separate reports
+*/
+func MailRecipients(connPool *pgxpool.Pool, list string, report string) []string {
+	var recipients []string
+	err := errors.New("no db connection")
+	if connPool != nil {
+		err = connPool.QueryRow(context.Background(), `
+			SELECT COALESCE(ARRAY_AGG(email ORDER BY id), '{}')
+			FROM PUBLIC.notification_recipients
+			WHERE list = $1 AND ($2 = '' OR CARDINALITY(reports) = 0 OR $2 = ANY(reports))
+		`, list, report).Scan(&recipients)
+	}
+	if err == nil {
+		// addresses stored before ValidateEmail was fixed may not be valid
+		valid := recipients[:0]
+		for _, email := range recipients {
+			if ValidateEmail(email) {
+				valid = append(valid, email)
+			} else {
+				fmt.Println("skipping invalid mail recipient", email)
+			}
+		}
+		return valid
+	}
+	fmt.Println("error fetching mail recipients, falling back to environment", err)
+	recipients = []string{}
+	for _, email := range strings.Split(os.Getenv("MAIL_RECIPIENTS_"+strings.ToUpper(list)), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			recipients = append(recipients, email)
+		}
+	}
+	return recipients
+}
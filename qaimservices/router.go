@@ -0,0 +1,320 @@
+package qaimservices
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Router
+Routes are declared in a table instead of a switch on the path:
+
+	router := NewRouter("/user/", connPool)
+	router.Use(RecoverPanics, LogRequests)
+	router.Handle(http.MethodPost, "tbill/{tokenId}/sell", postTbillSell, USER)
+
+  - patterns are matched segment by segment, "{name}" segments capture a path parameter
+    that the handler reads with PathParam, literal segments win over parameters
+  - a path that matches no pattern answers 404, a path that matches with another
+    method answers 405 with an Allow header
+  - every route runs the router middleware (outermost first), then Authorize with the
+    route's roles, then the router's authorized middleware, then the route's own
+    middleware, then the handler
+*/
+
+// RequestHandler is the signature every route handler implements
+type RequestHandler func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool)
+
+// Middleware wraps a handler, returning a handler that runs before and/or after it
+type Middleware func(next RequestHandler) RequestHandler
+
+type Route struct {
+	Method     string
+	Pattern    string
+	segments   []string
+	handler    RequestHandler
+	roles      []Role
+	middleware []Middleware
+	// reachable without a second factor by roles that must use one, see RequireMfa
+	mfaOptional bool
+	// its responses are never stored for replay, see IdempotentRequests
+	notIdempotent bool
+}
+
+type Router struct {
+	prefix     string
+	connPool   *pgxpool.Pool
+	routes     []*Route
+	middleware []Middleware
+	// runs after Authorize, so it can read the caller's claims
+	authorizedMiddleware []Middleware
+}
+
+type claimsCtxKey struct{}
+type pathParamsCtxKey struct{}
+type routePatternCtxKey struct{}
+type mfaOptionalCtxKey struct{}
+type notIdempotentCtxKey struct{}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isParamSegment(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+// NewRouter creates a router serving every path under prefix
+func NewRouter(prefix string, connPool *pgxpool.Pool) *Router {
+	return &Router{prefix: prefix, connPool: connPool}
+}
+
+// Use appends middleware that runs for every route of the router
+func (router *Router) Use(middleware ...Middleware) {
+	router.middleware = append(router.middleware, middleware...)
+}
+
+// UseAuthorized appends middleware that runs for every route of the router, after the caller is authorized
+func (router *Router) UseAuthorized(middleware ...Middleware) {
+	router.authorizedMiddleware = append(router.authorizedMiddleware, middleware...)
+}
+
+/*
+Handle registers fn for method requests on pattern, relative to the router prefix
+@param roles the caller's role must imply one of these, NONE makes the endpoint public
+*/
+func (router *Router) Handle(method string, pattern string, fn RequestHandler, roles ...Role) *Route {
+	route := &Route{
+		Method:   method,
+		Pattern:  pattern,
+		segments: splitPath(pattern),
+		handler:  fn,
+		roles:    roles,
+	}
+	router.routes = append(router.routes, route)
+	return route
+}
+
+// Use appends middleware that runs for this route only, after the caller is authorized
+func (route *Route) Use(middleware ...Middleware) *Route {
+	route.middleware = append(route.middleware, middleware...)
+	return route
+}
+
+// MfaOptional lets callers that must use a second factor reach the route without one, so they can enrol it
+func (route *Route) MfaOptional() *Route {
+	route.mfaOptional = true
+	return route
+}
+
+// NotIdempotent keeps the route's responses out of the Idempotency-Key store, for responses that carry secrets
+func (route *Route) NotIdempotent() *Route {
+	route.notIdempotent = true
+	return route
+}
+
+// match returns the captured path parameters when segments fit the route's pattern
+func (route *Route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range route.segments {
+		if isParamSegment(segment) {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// moreSpecific reports whether route a should win over route b, the first literal segment decides
+func moreSpecific(a *Route, b *Route) bool {
+	for i := range a.segments {
+		aParam, bParam := isParamSegment(a.segments[i]), isParamSegment(b.segments[i])
+		if aParam != bParam {
+			return !aParam
+		}
+	}
+	return false
+}
+
+func (router *Router) chain(route *Route) RequestHandler {
+	handler := route.handler
+	for i := len(route.middleware) - 1; i >= 0; i-- {
+		handler = route.middleware[i](handler)
+	}
+	for i := len(router.authorizedMiddleware) - 1; i >= 0; i-- {
+		handler = router.authorizedMiddleware[i](handler)
+	}
+	handler = Authorize(route.roles...)(handler)
+	for i := len(router.middleware) - 1; i >= 0; i-- {
+		handler = router.middleware[i](handler)
+	}
+	return handler
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, router.prefix) {
+		ServeError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	segments := splitPath(r.URL.Path[len(router.prefix):])
+
+	var matched *Route
+	var matchedParams map[string]string
+	allowed := []string{}
+	for _, route := range router.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.Method != r.Method {
+			// a literal and a parameter route can both match with the same method
+			if !containsString(allowed, route.Method) {
+				allowed = append(allowed, route.Method)
+			}
+			continue
+		}
+		if matched == nil || moreSpecific(route, matched) {
+			matched, matchedParams = route, params
+		}
+	}
+	if matched == nil {
+		if len(allowed) == 0 {
+			ServeError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			return
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		ServeError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	ctx := context.WithValue(r.Context(), pathParamsCtxKey{}, matchedParams)
+	ctx = context.WithValue(ctx, routePatternCtxKey{}, matched.Pattern)
+	ctx = context.WithValue(ctx, mfaOptionalCtxKey{}, matched.mfaOptional)
+	r = r.WithContext(context.WithValue(ctx, notIdempotentCtxKey{}, matched.notIdempotent))
+	router.chain(matched)(w, r, router.connPool)
+}
+
+// PathParam returns the value captured by the "{name}" segment of the matched route
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsCtxKey{}).(map[string]string)
+	return params[name]
+}
+
+// RoutePattern returns the pattern of the route the request matched, e.g. "tbill/{tokenId}/sell"
+func RoutePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(routePatternCtxKey{}).(string)
+	return pattern
+}
+
+// RequestClaims returns the verified token claims Authorize attached to the request
+func RequestClaims(r *http.Request) (JwtPayload, bool) {
+	claims, ok := r.Context().Value(claimsCtxKey{}).(JwtPayload)
+	return claims, ok
+}
+
+/*
+Authorize only lets callers whose role implies one of allowedRoles through
+NONE makes the endpoint public, the ADMIN_API_KEY header acts as a SUPERUSER
+*/
+func Authorize(allowedRoles ...Role) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+			// user role (and hence jwt token ) not required
+			// ! Only for Admin login, User login, User Signup endpoints
+			if RoleAllowed(NONE, allowedRoles) {
+				next(w, r, connPool)
+				return
+			}
+			// superuser api key, SUPERUSER implies ADMIN so it also opens admin endpoints
+			apiKey := r.Header.Get("apiKey")
+			if apiKey != "" && apiKey == os.Getenv("ADMIN_API_KEY") && RoleAllowed(SUPERUSER, allowedRoles) {
+				claims := JwtPayload{Aud: SUPERUSER}
+				next(w, r.WithContext(context.WithValue(r.Context(), claimsCtxKey{}, claims)), connPool)
+				return
+			}
+			// verify jwt token, role and if token is expired
+			claims, ok := ParseJwtToken(r.Header.Get("Token"))
+			if ok && RoleAllowed(claims.Aud, allowedRoles) {
+				next(w, r.WithContext(context.WithValue(r.Context(), claimsCtxKey{}, claims)), connPool)
+				return
+			}
+			ServeError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		}
+	}
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// LogRequests prints the method, path, status and duration of every request
+func LogRequests(next RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r, connPool)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		fmt.Printf("%s %s %s %d %s\n", RequestId(r), r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// RecoverPanics turns a panicking handler into a 500 response and an error report
+func RecoverPanics(next RequestHandler) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		defer func() {
+			if err := recover(); err != nil {
+				stack := string(debug.Stack())
+				fmt.Println("panic serving", r.URL.Path, err, "\n", stack)
+				ServeError(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+				go EmailErrorLog(fmt.Sprintf("Panic: %s %s", r.Method, r.URL.Path), fmt.Sprintf("%v\n%s", err, stack))
+			}
+		}()
+		next(w, r, connPool)
+	}
+}
@@ -0,0 +1,127 @@
+package qaimservices
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// answer writes name as the body, so a test can tell which route served the request
+func answer(name string) RequestHandler {
+	return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+		w.Write([]byte(name + " " + PathParam(r, "id")))
+	}
+}
+
+func serveTest(router *Router, method string, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRouterMatching(t *testing.T) {
+	router := NewRouter("/user/", nil)
+	// the parameter route is registered first, the literal one must still win
+	router.Handle(http.MethodGet, "tbill/{id}", answer("param"), NONE)
+	router.Handle(http.MethodGet, "tbill/latest", answer("literal"), NONE)
+	router.Handle(http.MethodPut, "tbill/{id}/sell", answer("sell"), NONE)
+	router.Handle(http.MethodPost, "tbill/{id}/sell", answer("sell"), NONE)
+	router.Handle(http.MethodDelete, "tbill/{id}/sell", answer("sell"), NONE)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{http.MethodGet, "/user/tbill/latest", http.StatusOK, "literal ", ""},
+		{http.MethodGet, "/user/tbill/42", http.StatusOK, "param 42", ""},
+		{http.MethodPost, "/user/tbill/42/sell", http.StatusOK, "sell 42", ""},
+		{http.MethodGet, "/user/tbill/42/sell", http.StatusMethodNotAllowed, "", "DELETE, POST, PUT"},
+		{http.MethodPost, "/user/tbill/latest", http.StatusMethodNotAllowed, "", "GET"},
+		{http.MethodGet, "/user/tbill//sell", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/user/tbill", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/user/unknown/42", http.StatusNotFound, "", ""},
+		{http.MethodGet, "/admin/tbill/42", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		rec := serveTest(router, tt.method, tt.path, nil)
+		if rec.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+			continue
+		}
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s %s: body %q, want %q", tt.method, tt.path, rec.Body.String(), tt.body)
+		}
+		if allow := rec.Header().Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+}
+
+func TestMoreSpecific(t *testing.T) {
+	route := func(pattern string) *Route { return &Route{Pattern: pattern, segments: splitPath(pattern)} }
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"tbill/latest", "tbill/{id}", true},
+		{"tbill/{id}", "tbill/latest", false},
+		{"{kind}/latest", "tbill/{id}", false},
+		{"tbill/{id}", "{kind}/latest", true},
+		{"tbill/{id}", "tbill/{other}", false},
+	}
+	for _, tt := range tests {
+		if got := moreSpecific(route(tt.a), route(tt.b)); got != tt.want {
+			t.Errorf("moreSpecific(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// TestRouterChainOrder checks router middleware runs before Authorize, then authorized middleware, then the route's own
+func TestRouterChainOrder(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "test-key")
+	var calls []string
+	record := func(name string) Middleware {
+		return func(next RequestHandler) RequestHandler {
+			return func(w http.ResponseWriter, r *http.Request, connPool *pgxpool.Pool) {
+				_, authorized := RequestClaims(r)
+				if authorized {
+					name += "+claims"
+				}
+				calls = append(calls, name)
+				next(w, r, connPool)
+			}
+		}
+	}
+	router := NewRouter("/admin/", nil)
+	router.Use(record("pre1"), record("pre2"))
+	router.UseAuthorized(record("auth1"), record("auth2"))
+	router.Handle(http.MethodGet, "users", answer("users"), ADMIN).Use(record("route"))
+
+	rec := serveTest(router, http.MethodGet, "/admin/users", http.Header{"Apikey": {"test-key"}})
+	want := []string{"pre1", "pre2", "auth1+claims", "auth2+claims", "route+claims"}
+	if rec.Code != http.StatusOK || !reflect.DeepEqual(calls, want) {
+		t.Fatalf("status %d, calls %v, want 200 and %v", rec.Code, calls, want)
+	}
+
+	// unauthorized callers stop at Authorize
+	calls = nil
+	rec = serveTest(router, http.MethodGet, "/admin/users", http.Header{"Apikey": {"wrong"}})
+	want = []string{"pre1", "pre2"}
+	if rec.Code != http.StatusUnauthorized || !reflect.DeepEqual(calls, want) {
+		t.Fatalf("status %d, calls %v, want 401 and %v", rec.Code, calls, want)
+	}
+	if strings.Contains(rec.Body.String(), "users") {
+		t.Fatal("handler ran for an unauthorized caller")
+	}
+}
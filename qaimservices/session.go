@@ -0,0 +1,261 @@
+package qaimservices
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	qs "qaimbe/qaimstructs"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Sessions
+Login creates a session and hands out a short lived access token (jwt) and
+an opaque refresh token. Refresh tokens rotate, every refresh consumes the
+presented token and returns a new pair. Presenting an already used refresh
+token means it was stolen, so the whole session is revoked.
+
+Revoking a session revokes every access token issued for it, VerifyJwtToken
+rejects tokens whose jti is revoked or unknown.
+*/
+
+const (
+	AccessTokenTtl  = time.Minute * 30
+	RefreshTokenTtl = time.Hour * 24 * 30
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected, session revoked")
+)
+
+func hashRefreshToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return b64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueSessionTokens creates a new access and refresh token pair for an existing session
+func issueSessionTokens(tx pgx.Tx, sessionId string, subject string, role Role, amr []string) (qs.AuthTokens, error) {
+	var tokens qs.AuthTokens
+	accessToken, err := CreateJwtToken(subject, role, amr)
+	if err != nil {
+		return tokens, err
+	}
+	_, err = tx.Exec(context.TODO(), `
+		INSERT INTO PUBLIC.access_tokens (jti, session_id, subject, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`, accessToken.Payload.Jti, sessionId, subject, time.Unix(accessToken.Payload.Exp, 0))
+	if err != nil {
+		return tokens, err
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return tokens, err
+	}
+	refreshExpiry := time.Now().Add(RefreshTokenTtl)
+	_, err = tx.Exec(context.TODO(), `
+		INSERT INTO PUBLIC.refresh_tokens (token_hash, session_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hashRefreshToken(refreshToken), sessionId, refreshExpiry)
+	if err != nil {
+		return tokens, err
+	}
+
+	tokens.UserId = subject
+	tokens.AccessToken = accessToken.Token
+	tokens.AccessExpiresAt = time.Unix(accessToken.Payload.Exp, 0).UTC()
+	tokens.RefreshToken = refreshToken
+	tokens.RefreshExpiresAt = refreshExpiry.UTC()
+	tokens.Amr = amr
+	return tokens, nil
+}
+
+/*
+CreateSession starts a new login session for subject, returning its first token pair
+@param amr how the subject authenticated, every token of the session carries it
+*/
+func CreateSession(connPool *pgxpool.Pool, subject string, role Role, amr []string) (qs.AuthTokens, error) {
+	var tokens qs.AuthTokens
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return tokens, err
+	}
+	defer tx.Rollback(context.TODO())
+
+	var sessionId string
+	err = tx.QueryRow(context.TODO(), `
+		INSERT INTO PUBLIC.auth_sessions (subject, role, amr)
+		VALUES ($1, $2, $3)
+		RETURNING session_id
+	`, subject, int(role), amr).Scan(&sessionId)
+	if err != nil {
+		return tokens, err
+	}
+	tokens, err = issueSessionTokens(tx, sessionId, subject, role, amr)
+	if err != nil {
+		return tokens, err
+	}
+	return tokens, tx.Commit(context.TODO())
+}
+
+// RefreshSession consumes a refresh token and returns a new token pair for its session
+func RefreshSession(connPool *pgxpool.Pool, refreshToken string) (qs.AuthTokens, error) {
+	var tokens qs.AuthTokens
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return tokens, err
+	}
+	defer tx.Rollback(context.TODO())
+
+	var sessionId, subject string
+	var role int
+	var amr []string
+	var expired, used, revoked bool
+	err = tx.QueryRow(context.TODO(), `
+		SELECT s.session_id, s.subject, s.role, s.amr,
+		rt.expires_at <= NOW(), rt.used_at IS NOT NULL, s.revoked_at IS NOT NULL
+		FROM PUBLIC.refresh_tokens AS rt
+		INNER JOIN PUBLIC.auth_sessions AS s
+		ON s.session_id = rt.session_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE
+	`, hashRefreshToken(refreshToken)).Scan(&sessionId, &subject, &role, &amr, &expired, &used, &revoked)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return tokens, ErrInvalidRefreshToken
+		}
+		return tokens, err
+	}
+	if used {
+		err = revokeSessions(tx, "session_id = $1", sessionId)
+		if err != nil {
+			return tokens, err
+		}
+		err = tx.Commit(context.TODO())
+		if err != nil {
+			return tokens, err
+		}
+		return tokens, ErrRefreshTokenReused
+	}
+	if expired || revoked {
+		return tokens, ErrInvalidRefreshToken
+	}
+
+	_, err = tx.Exec(context.TODO(),
+		"UPDATE PUBLIC.refresh_tokens SET used_at = NOW() WHERE token_hash = $1", hashRefreshToken(refreshToken))
+	if err != nil {
+		return tokens, err
+	}
+	tokens, err = issueSessionTokens(tx, sessionId, subject, Role(role), amr)
+	if err != nil {
+		return tokens, err
+	}
+	return tokens, tx.Commit(context.TODO())
+}
+
+/*
+revokeSessions marks the sessions matching the where clause, and every access token
+issued for them, as revoked
+*/
+func revokeSessions(tx pgx.Tx, where string, arg string) error {
+	_, err := tx.Exec(context.TODO(), `
+		WITH revoked AS (
+			UPDATE PUBLIC.auth_sessions
+			SET revoked_at = NOW()
+			WHERE revoked_at IS NULL AND `+where+`
+			RETURNING session_id
+		)
+		UPDATE PUBLIC.access_tokens AS at
+		SET revoked_at = NOW()
+		FROM revoked
+		WHERE at.session_id = revoked.session_id AND at.revoked_at IS NULL
+	`, arg)
+	return err
+}
+
+// RevokeSessionOfJti revokes the session an access token belongs to, used on logout
+func RevokeSessionOfJti(connPool *pgxpool.Pool, jti string) error {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
+	err = revokeSessions(tx, "session_id = (SELECT session_id FROM PUBLIC.access_tokens WHERE jti = $1)", jti)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.TODO())
+}
+
+// RevokeSubjectSessions revokes every session of a user or admin, logging them out everywhere
+func RevokeSubjectSessions(connPool *pgxpool.Pool, subject string) error {
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.TODO())
+	err = revokeSessions(tx, "subject = $1", subject)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.TODO())
+}
+
+/*
+IsJtiRevoked checks the jti of a verified token against the revocation list,
+tokens that were never recorded are treated as revoked
+*/
+func IsJtiRevoked(jti string) bool {
+	if jti == "" || !ValidateUuid(jti) || GlobalState == nil {
+		return true
+	}
+	var revoked bool
+	err := GlobalState.ConnPool.QueryRow(context.Background(), `
+		SELECT revoked_at IS NOT NULL
+		FROM PUBLIC.access_tokens
+		WHERE jti = $1
+	`, jti).Scan(&revoked)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			fmt.Println("error checking token revocation", err)
+		}
+		return true
+	}
+	return revoked
+}
+
+// PurgeExpiredSessions removes tokens and sessions that can no longer be used
+func PurgeExpiredSessions(connPool *pgxpool.Pool) {
+	purgeQueries := []string{
+		"DELETE FROM PUBLIC.access_tokens WHERE expires_at < NOW() - INTERVAL '1 day'",
+		"DELETE FROM PUBLIC.refresh_tokens WHERE expires_at < NOW() - INTERVAL '1 day'",
+		`DELETE FROM PUBLIC.auth_sessions AS s
+		WHERE s.created_at < NOW() - INTERVAL '1 day' AND NOT EXISTS (
+			SELECT 1 FROM PUBLIC.refresh_tokens AS rt WHERE rt.session_id = s.session_id
+		)`,
+	}
+	for _, query := range purgeQueries {
+		_, err := connPool.Exec(context.Background(), query)
+		if err != nil {
+			fmt.Println("error purging expired sessions", err)
+			EmailErrorLog("PurgeExpiredSessions: Error purging sessions", err.Error())
+			return
+		}
+	}
+}
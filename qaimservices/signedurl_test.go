@@ -0,0 +1,82 @@
+package qaimservices
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// useFileUrlSecret signs urls with secret for the test, restoring the previous secret after it
+func useFileUrlSecret(t *testing.T, secret string) {
+	t.Helper()
+	previous := fileUrlSecret
+	t.Cleanup(func() { fileUrlSecret = previous })
+	t.Setenv("FILE_URL_SECRET", secret)
+	err := LoadFileUrlSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signedQuery(t *testing.T, accessId int64, key string, expires time.Time) url.Values {
+	t.Helper()
+	signed, err := url.Parse(SignFileUrl("https://api.qaim.finance", accessId, key, expires))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Path != SignedFileUrlPath {
+		t.Fatalf("signed url path %q, want %q", signed.Path, SignedFileUrlPath)
+	}
+	return signed.Query()
+}
+
+func TestVerifyFileUrl(t *testing.T) {
+	useFileUrlSecret(t, "secret-one")
+	valid := signedQuery(t, 7, "kyc/user-a/front", time.Now().Add(KycUrlTtl))
+
+	accessId, key, ok := VerifyFileUrl(valid)
+	if !ok || accessId != 7 || key != "kyc/user-a/front" {
+		t.Fatalf("VerifyFileUrl = %d, %q, %v, want 7, kyc/user-a/front, true", accessId, key, ok)
+	}
+
+	tamper := func(name string, value string) url.Values {
+		query := url.Values{}
+		for k, v := range valid {
+			query[k] = append([]string{}, v...)
+		}
+		query.Set(name, value)
+		return query
+	}
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"another object key", tamper("key", "kyc/user-b/front")},
+		{"another access id", tamper("access", "8")},
+		{"extended expiry", tamper("exp", "99999999999")},
+		{"forged signature", tamper("sig", "AAAA")},
+		{"missing signature", tamper("sig", "")},
+		{"non numeric access id", tamper("access", "seven")},
+		{"expired", signedQuery(t, 7, "kyc/user-a/front", time.Now().Add(-time.Second))},
+	}
+	for _, tt := range tests {
+		if _, _, ok := VerifyFileUrl(tt.query); ok {
+			t.Errorf("%s: url verified", tt.name)
+		}
+	}
+
+	// urls signed before the secret changed stop working
+	useFileUrlSecret(t, "secret-two")
+	if _, _, ok := VerifyFileUrl(valid); ok {
+		t.Error("url signed with the old secret verified")
+	}
+}
+
+func TestVerifyFileUrlWithoutSecret(t *testing.T) {
+	useFileUrlSecret(t, "secret-one")
+	query := signedQuery(t, 7, "kyc/user-a/front", time.Now().Add(KycUrlTtl))
+	fileUrlSecret = nil
+	if _, _, ok := VerifyFileUrl(query); ok {
+		t.Fatal("url verified without a secret loaded")
+	}
+}
@@ -0,0 +1,126 @@
+package qaimservices
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+# SMS
+Text messages are sent through the SmsSender configured by SMS_BACKEND:
+  - http: posts { "to", "from", "text" } as json to SMS_GATEWAY_URL, with SMS_GATEWAY_TOKEN as a
+    bearer token and SMS_SENDER_ID as the sender, any 2xx answer means the gateway accepted it
+  - log: messages are printed to stdout, for development. It prints one time codes, so it
+    can't be used in production
+
+When SMS_BACKEND is not set production uses the http backend and every other environment logs.
+Numbers are handed to the sender in E.164 (+923001234567)
+*/
+
+const (
+	SmsBackendHttp = "http"
+	SmsBackendLog  = "log"
+)
+
+// SmsSender delivers a text message to a phone number
+type SmsSender interface {
+	Send(to string, message string) error
+}
+
+var smsSender SmsSender = &LogSmsSender{}
+
+// SetSmsSender replaces the sender used to deliver text messages
+func SetSmsSender(s SmsSender) {
+	smsSender = s
+}
+
+// LoadSmsSender configures the sms sender from the environment
+func LoadSmsSender(env string) error {
+	backend := os.Getenv("SMS_BACKEND")
+	if backend == "" {
+		backend = SmsBackendLog
+		if env == EnvProd {
+			backend = SmsBackendHttp
+		}
+	}
+	switch backend {
+	case SmsBackendHttp:
+		s := &HttpSmsSender{
+			Url:      os.Getenv("SMS_GATEWAY_URL"),
+			Token:    os.Getenv("SMS_GATEWAY_TOKEN"),
+			SenderId: envOr("SMS_SENDER_ID", "Qaim"),
+			Client:   &http.Client{Timeout: 15 * time.Second},
+		}
+		if s.Url == "" {
+			return errors.New("SMS_GATEWAY_URL is required by the http sms backend")
+		}
+		smsSender = s
+	case SmsBackendLog:
+		if env == EnvProd {
+			return errors.New("SMS_BACKEND: the log backend prints one time codes, it can't be used in production")
+		}
+		smsSender = &LogSmsSender{}
+	default:
+		return fmt.Errorf("SMS_BACKEND: unsupported backend %q", backend)
+	}
+	return nil
+}
+
+// E164PhoneNum turns a local number accepted by ValidatePhoneNum (03001234567) into +923001234567
+func E164PhoneNum(phoneNum string) string {
+	return "+92" + strings.TrimPrefix(phoneNum, "0")
+}
+
+// SendSms texts message to a number accepted by ValidatePhoneNum
+func SendSms(phoneNum string, message string) error {
+	return smsSender.Send(E164PhoneNum(phoneNum), message)
+}
+
+// ****************
+type HttpSmsSender struct {
+	Url      string
+	Token    string
+	SenderId string
+	Client   *http.Client
+}
+
+func (s *HttpSmsSender) Send(to string, message string) error {
+	body, err := json.Marshal(map[string]string{"to": to, "from": s.SenderId, "text": message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentJson)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("sms gateway answered %d: %s", res.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// ****************
+// LogSmsSender prints every message instead of sending it
+type LogSmsSender struct{}
+
+func (s *LogSmsSender) Send(to string, message string) error {
+	fmt.Printf("sms to %s: %s\n", to, message)
+	return nil
+}
@@ -0,0 +1,235 @@
+package qaimservices
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	qs "qaimbe/qaimstructs"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# User Listings
+The admin user listings are keyset paginated: a page is ordered by the sort column with
+the uuid as tie breaker, and the cursor carries the (value, uuid) of the page's last row,
+so the next page starts right after it no matter how many users signed up in between.
+A cursor is only valid for the sort it was issued with
+*/
+
+const (
+	UserListDefaultPageLen = 50
+	UserListMaxPageSize    = 200
+
+	UserSortCreatedAt  = "created_at"
+	UserSortBalance    = "balance"
+	UserSortLastName   = "last_name"
+	UserSortFirstName  = "first_name"
+	UserSortNationalId = "national_id"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursorIdRgx only accepts canonical uuids, ValidateUuid lets through strings postgres can't cast
+var cursorIdRgx = regexp.MustCompile(`^(?i)[0-9A-F]{8}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{4}-[0-9A-F]{12}$`)
+
+// userSortCasts maps the sortable columns to the type their cursor value is cast to
+var userSortCasts = map[string]string{
+	UserSortCreatedAt:  "TIMESTAMPTZ",
+	UserSortBalance:    "BIGINT",
+	UserSortLastName:   "TEXT",
+	UserSortFirstName:  "TEXT",
+	UserSortNationalId: "TEXT",
+}
+
+type userCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	Id    string `json:"id"`
+	// Value parsed for the sort column, set by decodeUserCursor
+	sortValue any
+}
+
+func ValidateUserSort(sort string) bool {
+	_, ok := userSortCasts[sort]
+	return ok
+}
+
+func encodeUserCursor(cursor userCursor) string {
+	data, _ := json.Marshal(cursor)
+	return b64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeUserCursor(str string) (userCursor, error) {
+	var cursor userCursor
+	data, err := b64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil || !ValidateUserSort(cursor.Sort) || !cursorIdRgx.MatchString(cursor.Id) {
+		return cursor, ErrInvalidCursor
+	}
+	// a tampered value must not reach postgres, where it fails the cast
+	switch userSortCasts[cursor.Sort] {
+	case "BIGINT":
+		cursor.sortValue, err = strconv.ParseInt(cursor.Value, 10, 64)
+	case "TIMESTAMPTZ":
+		cursor.sortValue, err = time.Parse(time.RFC3339Nano, cursor.Value)
+	default:
+		cursor.sortValue = cursor.Value
+		if !utf8.ValidString(cursor.Value) || strings.ContainsRune(cursor.Value, 0) {
+			err = ErrInvalidCursor
+		}
+	}
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+func userSortValue(u qs.UserGet, sort string) string {
+	switch sort {
+	case UserSortBalance:
+		return strconv.FormatInt(u.Balance, 10)
+	case UserSortLastName:
+		return u.LastName
+	case UserSortFirstName:
+		return u.FirstName
+	case UserSortNationalId:
+		return u.NationalId
+	}
+	return u.CreatedAt.Format(time.RFC3339Nano)
+}
+
+// likePattern escapes the LIKE wildcards in str and wraps it for a partial match
+func likePattern(str string) string {
+	str = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(str)
+	return "%" + str + "%"
+}
+
+/*
+ListUsers returns a page of users matching filter
+Returns ErrInvalidCursor when the cursor is malformed or was issued for another sort
+*/
+func ListUsers(connPool *pgxpool.Pool, filter qs.UserListFilter) (qs.UserPage, error) {
+	var page qs.UserPage
+	if filter.Sort == "" {
+		filter.Sort = UserSortCreatedAt
+	}
+	cast, ok := userSortCasts[filter.Sort]
+	if !ok {
+		return page, fmt.Errorf("unsupported sort %q", filter.Sort)
+	}
+	if filter.Limit <= 0 || filter.Limit > UserListMaxPageSize {
+		filter.Limit = UserListDefaultPageLen
+	}
+
+	var conds []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if filter.Verified != nil {
+		conds = append(conds, "verified = "+arg(*filter.Verified))
+	}
+	if filter.MinBalance != nil {
+		conds = append(conds, "balance >= "+arg(*filter.MinBalance))
+	}
+	if filter.MaxBalance != nil {
+		conds = append(conds, "balance <= "+arg(*filter.MaxBalance))
+	}
+	if filter.SignedUpAfter != nil {
+		conds = append(conds, "created_at >= "+arg(*filter.SignedUpAfter))
+	}
+	if filter.SignedUpBefore != nil {
+		conds = append(conds, "created_at < "+arg(*filter.SignedUpBefore))
+	}
+	if filter.PendingWithdrawal != nil {
+		if *filter.PendingWithdrawal {
+			conds = append(conds, "withdraw_request_id IS NOT NULL")
+		} else {
+			conds = append(conds, "withdraw_request_id IS NULL")
+		}
+	}
+	if filter.KycStatus != "" {
+		conds = append(conds, "kyc_status = "+arg(filter.KycStatus))
+	}
+	if filter.Search != "" {
+		pattern := arg(likePattern(filter.Search))
+		conds = append(conds, fmt.Sprintf(
+			"(first_name || ' ' || last_name ILIKE %[1]s OR phone_number ILIKE %[1]s OR national_id ILIKE %[1]s)", pattern))
+	}
+	if filter.Cursor != "" {
+		cursor, err := decodeUserCursor(filter.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if cursor.Sort != filter.Sort || cursor.Desc != filter.Descending {
+			return page, ErrInvalidCursor
+		}
+		op := ">"
+		if filter.Descending {
+			op = "<"
+		}
+		conds = append(conds, fmt.Sprintf("(%s, uuid) %s (%s::%s, %s::UUID)",
+			filter.Sort, op, arg(cursor.sortValue), cast, arg(cursor.Id)))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	order := "ASC"
+	if filter.Descending {
+		order = "DESC"
+	}
+	// one extra row tells whether there is a next page
+	query := fmt.Sprintf(`
+		SELECT uuid, national_id, first_name, last_name, id_front, id_back, phone_number, iban, balance, verified,
+			kyc_status, created_at, withdraw_request_id IS NOT NULL
+		FROM PUBLIC.user
+		%s
+		ORDER BY %s %s, uuid %s
+		LIMIT %s
+	`, where, filter.Sort, order, order, arg(filter.Limit+1))
+
+	rows, err := connPool.Query(context.Background(), query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	page.Users = make([]qs.UserGet, 0, filter.Limit)
+	for rows.Next() {
+		var u qs.UserGet
+		err = rows.Scan(&u.Uuid, &u.NationalId, &u.FirstName, &u.LastName, &u.IdFront, &u.IdBack, &u.PhoneNum, &u.Iban,
+			&u.Balance, &u.Verified, &u.KycStatus, &u.CreatedAt, &u.PendingWithdrawal)
+		if err != nil {
+			return page, err
+		}
+		page.Users = append(page.Users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return page, err
+	}
+	if len(page.Users) > filter.Limit {
+		page.Users = page.Users[:filter.Limit]
+		last := page.Users[filter.Limit-1]
+		page.NextCursor = encodeUserCursor(userCursor{
+			Sort:  filter.Sort,
+			Desc:  filter.Descending,
+			Value: userSortValue(last, filter.Sort),
+			Id:    last.Uuid,
+		})
+	}
+	return page, nil
+}
@@ -0,0 +1,61 @@
+package qaimservices
+
+import (
+	b64 "encoding/base64"
+	"testing"
+	"time"
+)
+
+const testCursorId = "0b6f4a1e-2a4c-4c1e-9f3a-6c1d2e3f4a5b"
+
+func TestDecodeUserCursor(t *testing.T) {
+	createdAt := time.Date(2024, 3, 1, 10, 30, 0, 123456000, time.UTC)
+	tests := []struct {
+		name   string
+		cursor string
+		value  any
+	}{
+		{"balance", encodeUserCursor(userCursor{Sort: UserSortBalance, Value: "-1500", Id: testCursorId}), int64(-1500)},
+		{"created at", encodeUserCursor(userCursor{Sort: UserSortCreatedAt, Value: createdAt.Format(time.RFC3339Nano), Id: testCursorId}), createdAt},
+		{"last name", encodeUserCursor(userCursor{Sort: UserSortLastName, Value: "O'Brien", Id: testCursorId}), "O'Brien"},
+	}
+	for _, tt := range tests {
+		cursor, err := decodeUserCursor(tt.cursor)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if created, ok := tt.value.(time.Time); ok {
+			if parsed, _ := cursor.sortValue.(time.Time); !parsed.Equal(created) {
+				t.Errorf("%s: value %v, want %v", tt.name, cursor.sortValue, created)
+			}
+		} else if cursor.sortValue != tt.value {
+			t.Errorf("%s: value %#v, want %#v", tt.name, cursor.sortValue, tt.value)
+		}
+	}
+}
+
+func TestDecodeUserCursorTampered(t *testing.T) {
+	raw := func(json string) string { return b64.RawURLEncoding.EncodeToString([]byte(json)) }
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"not json", raw("balance,abc")},
+		{"unknown sort", raw(`{"s":"password_hash","v":"x","id":"` + testCursorId + `"}`)},
+		{"balance not a number", raw(`{"s":"balance","v":"abc","id":"` + testCursorId + `"}`)},
+		{"balance overflow", raw(`{"s":"balance","v":"99999999999999999999","id":"` + testCursorId + `"}`)},
+		{"created at not a time", raw(`{"s":"created_at","v":"yesterday","id":"` + testCursorId + `"}`)},
+		{"created at without zone", raw(`{"s":"created_at","v":"2024-03-01 10:30:00","id":"` + testCursorId + `"}`)},
+		{"name with a nul byte", raw(`{"s":"last_name","v":"a\u0000b","id":"` + testCursorId + `"}`)},
+		{"missing id", raw(`{"s":"balance","v":"10"}`)},
+		{"id not a uuid", raw(`{"s":"balance","v":"10","id":"zzz"}`)},
+		{"id too short", raw(`{"s":"balance","v":"10","id":"0b6f4a1e-2a4c-4c1e-9f3a"}`)},
+	}
+	for _, tt := range tests {
+		if _, err := decodeUserCursor(tt.cursor); err != ErrInvalidCursor {
+			t.Errorf("%s: err %v, want ErrInvalidCursor", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package qaimservices
+
+import (
+	"context"
+	qs "qaimbe/qaimstructs"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const UserNotificationsPageLen = 50
+
+// NotifyUser adds an in app notification for the user, inside tx so it is only sent if the change commits
+func NotifyUser(tx pgx.Tx, userId string, kind string, message string) error {
+	_, err := tx.Exec(context.TODO(), `
+		INSERT INTO PUBLIC.user_notifications (user_id, kind, message)
+		VALUES ($1, $2, $3)
+	`, userId, kind, message)
+	return err
+}
+
+// GetUserNotifications returns the user's latest notifications, newest first
+func GetUserNotifications(connPool *pgxpool.Pool, userId string) ([]qs.UserNotification, error) {
+	notifications := []qs.UserNotification{}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT id, kind, message, created_at, read_at
+		FROM PUBLIC.user_notifications
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, userId, UserNotificationsPageLen)
+	if err != nil {
+		return notifications, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n qs.UserNotification
+		err = rows.Scan(&n.Id, &n.Kind, &n.Message, &n.CreatedAt, &n.ReadAt)
+		if err != nil {
+			return notifications, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// MarkUserNotificationsRead marks every notification of the user up to and including upTo as read
+func MarkUserNotificationsRead(connPool *pgxpool.Pool, userId string, upTo int64) error {
+	_, err := connPool.Exec(context.Background(), `
+		UPDATE PUBLIC.user_notifications
+		SET read_at = NOW()
+		WHERE user_id = $1 AND id <= $2 AND read_at IS NULL
+	`, userId, upTo)
+	return err
+}
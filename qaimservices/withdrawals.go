@@ -0,0 +1,239 @@
+package qaimservices
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	qs "qaimbe/qaimstructs"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+/*
+# Withdrawals
+A withdraw request deducts the amount from the user's wallet into withdrawals_payable, then:
+
+	requested -> approved | rejected | cancelled (by the user)
+	approved -> paid (with the bank transfer's reference) | rejected (the transfer failed)
+
+Paid, rejected and cancelled are final. Paying out moves the amount from withdrawals_payable
+to bank_cash, rejecting or cancelling refunds it to the user's wallet.
+The user can only have one open (requested or approved) request at a time
+*/
+
+const (
+	WithdrawRequested = "requested"
+	WithdrawApproved  = "approved"
+	WithdrawPaid      = "paid"
+	WithdrawRejected  = "rejected"
+	WithdrawCancelled = "cancelled"
+)
+
+var WithdrawOpenStatuses = []string{WithdrawRequested, WithdrawApproved}
+
+var withdrawTransitions = map[string][]string{
+	WithdrawRequested: {WithdrawApproved, WithdrawRejected, WithdrawCancelled},
+	WithdrawApproved:  {WithdrawPaid, WithdrawRejected},
+}
+
+var ErrWithdrawTransition = errors.New("withdraw request can't move to this status")
+
+// withdrawUserMessages are the in app notifications sent on entering each status, formatted with the amount
+var withdrawUserMessages = map[string]string{
+	WithdrawRequested: "Your withdrawal of %s was requested",
+	WithdrawApproved:  "Your withdrawal of %s was approved and will be transferred shortly",
+	WithdrawPaid:      "Your withdrawal of %s was transferred to your bank account",
+	WithdrawRejected:  "Your withdrawal of %s was rejected and refunded to your wallet",
+	WithdrawCancelled: "Your withdrawal of %s was cancelled and refunded to your wallet",
+}
+
+func ValidateWithdrawStatus(status string) bool {
+	_, ok := withdrawUserMessages[status]
+	return ok
+}
+
+func WithdrawTransitionAllowed(from string, to string) bool {
+	for _, allowed := range withdrawTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+withdrawTransfer is the ledger movement of a request entering status to,
+false when entering it moves no money. A transfer crediting the wallet is a refund
+*/
+func withdrawTransfer(req qs.UserBalanceWdrawRequest, to string) (qs.LedgerTransfer, bool) {
+	switch to {
+	case WithdrawPaid:
+		return qs.LedgerTransfer{
+			UserId: req.UserId, DebitAccount: LedgerWithdrawalsPayable, CreditAccount: LedgerBankCash,
+			Amount: req.Amount, Source: LedgerSrcWithdrawalPayout, SourceId: req.RequestId,
+		}, true
+	case WithdrawRejected, WithdrawCancelled:
+		return qs.LedgerTransfer{
+			UserId: req.UserId, DebitAccount: LedgerWithdrawalsPayable, CreditAccount: LedgerUserWallet,
+			Amount: req.Amount, Source: LedgerSrcWithdrawalRefund, SourceId: req.RequestId,
+		}, true
+	}
+	return qs.LedgerTransfer{}, false
+}
+
+const withdrawRequestColumns = `
+	wdraw.request_id, wdraw.user_id, wdraw.amount, wdraw.request_date, COALESCE(u.iban, ''), wdraw.status,
+	COALESCE(wdraw.bank_reference, ''), COALESCE(wdraw.reviewer_id, ''), wdraw.reason,
+	wdraw.approved_at, wdraw.paid_at, wdraw.rejected_at, wdraw.cancelled_at
+`
+
+func scanWithdrawRequest(row pgx.Row) (qs.UserBalanceWdrawRequest, error) {
+	var req qs.UserBalanceWdrawRequest
+	err := row.Scan(&req.RequestId, &req.UserId, &req.Amount, &req.RequestDate, &req.Iban, &req.Status,
+		&req.BankReference, &req.ReviewerId, &req.Reason, &req.ApprovedAt, &req.PaidAt, &req.RejectedAt, &req.CancelledAt)
+	return req, err
+}
+
+// LockWithdrawRequest fetches a withdraw request for update, pgx.ErrNoRows when there is none
+func LockWithdrawRequest(tx pgx.Tx, requestId string) (qs.UserBalanceWdrawRequest, error) {
+	return scanWithdrawRequest(tx.QueryRow(context.TODO(), `
+		SELECT `+withdrawRequestColumns+`
+		FROM PUBLIC.user_withdraw_requests AS wdraw
+		LEFT JOIN PUBLIC.user AS u
+		ON u.uuid = wdraw.user_id
+		WHERE wdraw.request_id = $1
+		FOR UPDATE OF wdraw
+	`, requestId))
+}
+
+/*
+ListWithdrawRequests returns withdraw requests in any of statuses, oldest first
+@param nationalId only the requests of this verified user, every user when empty
+*/
+func ListWithdrawRequests(connPool *pgxpool.Pool, statuses []string, nationalId string) ([]qs.UserBalanceWdrawRequest, error) {
+	requests := []qs.UserBalanceWdrawRequest{}
+	rows, err := connPool.Query(context.Background(), `
+		SELECT `+withdrawRequestColumns+`
+		FROM PUBLIC.user_withdraw_requests AS wdraw
+		LEFT JOIN PUBLIC.user AS u
+		ON u.uuid = wdraw.user_id
+		WHERE wdraw.status = ANY($1) AND ($2 = '' OR (u.national_id = $2 AND u.verified = TRUE))
+		ORDER BY wdraw.request_date
+	`, statuses, nationalId)
+	if err != nil {
+		return requests, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		req, err := scanWithdrawRequest(rows)
+		if err != nil {
+			return requests, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+/*
+TransitionWithdrawal moves a request locked with LockWithdrawRequest to status inside tx, updating req.
+Rejecting or cancelling refunds the user, paying out clears the way for their next request.
+@param reviewerId empty for the user cancelling
+@param bankReference the reference of the bank transfer, required when paying out
+Returns ErrWithdrawTransition when the move isn't allowed
+*/
+func TransitionWithdrawal(tx pgx.Tx, req *qs.UserBalanceWdrawRequest, to string, reviewerId string, bankReference string, reason string) error {
+	if !WithdrawTransitionAllowed(req.Status, to) {
+		return ErrWithdrawTransition
+	}
+	if to == WithdrawPaid && bankReference == "" {
+		return errors.New("paying out a withdraw request requires a bank reference")
+	}
+	err := tx.QueryRow(context.TODO(), `
+		UPDATE PUBLIC.user_withdraw_requests
+		SET status = $2,
+			reviewer_id = COALESCE(NULLIF($3, ''), reviewer_id),
+			bank_reference = COALESCE(NULLIF($4, ''), bank_reference),
+			reason = $5,
+			approved_at = CASE WHEN $2 = 'approved' THEN NOW() ELSE approved_at END,
+			paid_at = CASE WHEN $2 = 'paid' THEN NOW() ELSE paid_at END,
+			rejected_at = CASE WHEN $2 = 'rejected' THEN NOW() ELSE rejected_at END,
+			cancelled_at = CASE WHEN $2 = 'cancelled' THEN NOW() ELSE cancelled_at END
+		WHERE request_id = $1
+		RETURNING status, COALESCE(bank_reference, ''), COALESCE(reviewer_id, ''), reason,
+			approved_at, paid_at, rejected_at, cancelled_at
+	`, req.RequestId, to, reviewerId, bankReference, reason).Scan(&req.Status, &req.BankReference, &req.ReviewerId,
+		&req.Reason, &req.ApprovedAt, &req.PaidAt, &req.RejectedAt, &req.CancelledAt)
+	if err != nil {
+		return err
+	}
+
+	switch to {
+	case WithdrawPaid:
+		_, err = tx.Exec(context.TODO(),
+			"UPDATE PUBLIC.user SET withdraw_request_id = NULL WHERE uuid = $1 AND withdraw_request_id = $2",
+			req.UserId, req.RequestId)
+		if err == nil {
+			transfer, _ := withdrawTransfer(*req, to)
+			err = PostLedgerTransfer(tx, transfer)
+		}
+	case WithdrawRejected, WithdrawCancelled:
+		_, err = tx.Exec(context.TODO(), `
+			UPDATE PUBLIC.user
+			SET balance = balance + $3,
+				withdraw_request_id = CASE WHEN withdraw_request_id = $2 THEN NULL ELSE withdraw_request_id END
+			WHERE uuid = $1
+		`, req.UserId, req.RequestId, req.Amount)
+		if err == nil {
+			transfer, _ := withdrawTransfer(*req, to)
+			err = PostLedgerTransfer(tx, transfer)
+		}
+		if err == nil {
+			// an approval still waiting on the request has nothing left to approve
+			_, err = tx.Exec(context.TODO(), `
+				UPDATE PUBLIC.pending_operations
+				SET status = $3, reason = $4, decided_at = NOW()
+				WHERE kind = $1 AND target_id = $2 AND status = $5
+			`, OpWithdrawApprove, req.RequestId, OpStatusRejected, "withdraw request was "+to, OpStatusPending)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf(withdrawUserMessages[to], FormatPkr(req.Amount))
+	if to == WithdrawPaid {
+		message += ", reference " + bankReference
+	}
+	if reason != "" {
+		message += ": " + reason
+	}
+	return NotifyUser(tx, req.UserId, "withdraw_"+to, message)
+}
+
+/*
+ReviewWithdrawal transitions a locked withdraw request as the request's actor and audits it inside tx
+@param auditExtra fields added to the audit entry, such as the approval or payout batch that applied the change
+*/
+func ReviewWithdrawal(tx pgx.Tx, r *http.Request, req *qs.UserBalanceWdrawRequest, to string, bankReference string, reason string,
+	auditExtra map[string]any) error {
+	reviewerId := ""
+	if to != WithdrawCancelled {
+		reviewerId = RequestActor(r)
+	}
+	before := map[string]any{"Status": req.Status, "UserId": req.UserId, "Amount": req.Amount}
+	err := TransitionWithdrawal(tx, req, to, reviewerId, bankReference, reason)
+	if err != nil {
+		return err
+	}
+	after := map[string]any{"Status": req.Status, "UserId": req.UserId, "Amount": req.Amount,
+		"BankReference": req.BankReference, "Reason": req.Reason}
+	for key, value := range auditExtra {
+		after[key] = value
+	}
+	return AuditTx(tx, r, qs.AuditEvent{
+		Action: "withdraw." + to, TargetType: "withdraw_request", TargetId: req.RequestId,
+		Before: before, After: after,
+	})
+}
@@ -0,0 +1,195 @@
+package qaimservices
+
+import (
+	"context"
+	qs "qaimbe/qaimstructs"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestWithdrawTransitions(t *testing.T) {
+	statuses := []string{WithdrawRequested, WithdrawApproved, WithdrawPaid, WithdrawRejected, WithdrawCancelled, "unknown"}
+	allowed := map[[2]string]bool{
+		{WithdrawRequested, WithdrawApproved}:  true,
+		{WithdrawRequested, WithdrawRejected}:  true,
+		{WithdrawRequested, WithdrawCancelled}: true,
+		{WithdrawApproved, WithdrawPaid}:       true,
+		// the bank transfer failed
+		{WithdrawApproved, WithdrawRejected}: true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]string{from, to}]
+			if got := WithdrawTransitionAllowed(from, to); got != want {
+				t.Errorf("WithdrawTransitionAllowed(%s, %s) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestWithdrawTransfer(t *testing.T) {
+	req := qs.UserBalanceWdrawRequest{RequestId: "request", UserId: "user", Amount: 2500}
+	tests := []struct {
+		to     string
+		moves  bool
+		credit string
+		source string
+	}{
+		{WithdrawApproved, false, "", ""},
+		{WithdrawPaid, true, LedgerBankCash, LedgerSrcWithdrawalPayout},
+		// rejecting and cancelling refund the wallet
+		{WithdrawRejected, true, LedgerUserWallet, LedgerSrcWithdrawalRefund},
+		{WithdrawCancelled, true, LedgerUserWallet, LedgerSrcWithdrawalRefund},
+	}
+	for _, tt := range tests {
+		transfer, moves := withdrawTransfer(req, tt.to)
+		if moves != tt.moves {
+			t.Errorf("%s: moves money %v, want %v", tt.to, moves, tt.moves)
+			continue
+		}
+		if !moves {
+			continue
+		}
+		want := qs.LedgerTransfer{UserId: "user", DebitAccount: LedgerWithdrawalsPayable, CreditAccount: tt.credit,
+			Amount: 2500, Source: tt.source, SourceId: "request"}
+		if transfer != want {
+			t.Errorf("%s: transfer %+v, want %+v", tt.to, transfer, want)
+		}
+	}
+}
+
+func TestTransitionWithdrawalRefused(t *testing.T) {
+	tests := []struct {
+		from, to string
+	}{
+		{WithdrawRequested, WithdrawPaid},
+		{WithdrawPaid, WithdrawRejected},
+		{WithdrawCancelled, WithdrawApproved},
+		{WithdrawRejected, WithdrawRequested},
+	}
+	for _, tt := range tests {
+		// refused before the transaction is touched
+		req := qs.UserBalanceWdrawRequest{Status: tt.from}
+		if err := TransitionWithdrawal(nil, &req, tt.to, "reviewer", "REF-1", ""); err != ErrWithdrawTransition {
+			t.Errorf("%s -> %s: err %v, want ErrWithdrawTransition", tt.from, tt.to, err)
+		}
+		if req.Status != tt.from {
+			t.Errorf("%s -> %s: status changed to %s", tt.from, tt.to, req.Status)
+		}
+	}
+	req := qs.UserBalanceWdrawRequest{Status: WithdrawApproved}
+	if err := TransitionWithdrawal(nil, &req, WithdrawPaid, "reviewer", "", ""); err == nil {
+		t.Error("paid out without a bank reference")
+	}
+}
+
+// createTestWithdrawal deposits into the user's wallet, then requests a withdrawal of amount the way the user route does
+func createTestWithdrawal(t *testing.T, connPool *pgxpool.Pool, userId string, deposit int64, amount int64) string {
+	t.Helper()
+	t.Cleanup(func() {
+		ctx := context.Background()
+		connPool.Exec(ctx, "DELETE FROM PUBLIC.user_notifications WHERE user_id = $1", userId)
+		connPool.Exec(ctx, "DELETE FROM PUBLIC.user_withdraw_requests WHERE user_id = $1", userId)
+	})
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(context.TODO())
+	var requestId string
+	_, err = tx.Exec(context.TODO(), "UPDATE PUBLIC.user SET balance = balance + $2 WHERE uuid = $1", userId, deposit)
+	if err == nil {
+		err = PostLedgerTransfer(tx, qs.LedgerTransfer{
+			UserId: userId, DebitAccount: LedgerBankCash, CreditAccount: LedgerUserWallet, Amount: deposit, Source: LedgerSrcDeposit,
+		})
+	}
+	if err == nil {
+		err = tx.QueryRow(context.TODO(),
+			"INSERT INTO PUBLIC.user_withdraw_requests (user_id, amount) VALUES ($1, $2) RETURNING request_id",
+			userId, amount).Scan(&requestId)
+	}
+	if err == nil {
+		_, err = tx.Exec(context.TODO(),
+			"UPDATE PUBLIC.user SET balance = balance - $2, withdraw_request_id = $3 WHERE uuid = $1", userId, amount, requestId)
+	}
+	if err == nil {
+		err = PostLedgerTransfer(tx, qs.LedgerTransfer{
+			UserId: userId, DebitAccount: LedgerUserWallet, CreditAccount: LedgerWithdrawalsPayable,
+			Amount: amount, Source: LedgerSrcWithdrawal, SourceId: requestId,
+		})
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return requestId
+}
+
+// transitionTestWithdrawal moves the request to status in its own transaction
+func transitionTestWithdrawal(t *testing.T, connPool *pgxpool.Pool, requestId string, to string, bankReference string) {
+	t.Helper()
+	tx, err := connPool.BeginTx(context.Background(), pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(context.TODO())
+	req, err := LockWithdrawRequest(tx, requestId)
+	if err == nil {
+		err = TransitionWithdrawal(tx, &req, to, "", bankReference, "")
+	}
+	if err == nil {
+		err = tx.Commit(context.TODO())
+	}
+	if err != nil {
+		t.Fatalf("moving withdraw request to %s: %v", to, err)
+	}
+}
+
+func testUserBalance(t *testing.T, connPool *pgxpool.Pool, userId string) (int64, bool) {
+	t.Helper()
+	var balance int64
+	var open bool
+	err := connPool.QueryRow(context.Background(),
+		"SELECT balance, withdraw_request_id IS NOT NULL FROM PUBLIC.user WHERE uuid = $1", userId).Scan(&balance, &open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mustFindLedgerMismatches(t, connPool) {
+		if m.UserId == userId {
+			t.Fatalf("balance drifted from the ledger: %+v", m)
+		}
+	}
+	return balance, open
+}
+
+func TestTransitionWithdrawalRefund(t *testing.T) {
+	connPool := testConnPool(t)
+	userId := createTestUser(t, connPool, 0)
+	requestId := createTestWithdrawal(t, connPool, userId, 1000, 400)
+	if balance, open := testUserBalance(t, connPool, userId); balance != 600 || !open {
+		t.Fatalf("after requesting: balance %d, open request %v, want 600 and true", balance, open)
+	}
+
+	transitionTestWithdrawal(t, connPool, requestId, WithdrawApproved, "")
+	// the bank transfer failed, the amount returns to the wallet
+	transitionTestWithdrawal(t, connPool, requestId, WithdrawRejected, "")
+	if balance, open := testUserBalance(t, connPool, userId); balance != 1000 || open {
+		t.Fatalf("after rejecting: balance %d, open request %v, want 1000 and false", balance, open)
+	}
+}
+
+func TestTransitionWithdrawalPaid(t *testing.T) {
+	connPool := testConnPool(t)
+	userId := createTestUser(t, connPool, 0)
+	requestId := createTestWithdrawal(t, connPool, userId, 1000, 400)
+
+	transitionTestWithdrawal(t, connPool, requestId, WithdrawApproved, "")
+	transitionTestWithdrawal(t, connPool, requestId, WithdrawPaid, "REF-"+randomHex(t, 6))
+	if balance, open := testUserBalance(t, connPool, userId); balance != 600 || open {
+		t.Fatalf("after paying out: balance %d, open request %v, want 600 and false", balance, open)
+	}
+}
@@ -1,6 +1,7 @@
 package qaimstructs
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -22,6 +23,8 @@ type Admin struct {
 	Username string `json:"userName"`
 	PhoneNum string `json:"phoneNumber"`
 	Password string `json:"password"`
+	// totp or recovery code, required at login once a second factor is enrolled
+	Otp string `json:"otp,omitempty"`
 }
 
 type AdminAuth struct {
@@ -39,6 +42,7 @@ type User struct {
 	IdFront    string
 	IdBack     string
 	Password   string
+	Otp        string `json:",omitempty"`
 }
 
 type UserAuth struct {
@@ -58,6 +62,33 @@ type UserGet struct {
 	IdFront    string
 	IdBack     string
 	Verified   bool
+	KycStatus  string
+	CreatedAt  time.Time
+	// the user has a requested or approved withdraw request
+	PendingWithdrawal bool
+}
+
+// UserListFilter narrows and orders the admin user listings, nil filters are not applied
+type UserListFilter struct {
+	Verified          *bool
+	MinBalance        *int64
+	MaxBalance        *int64
+	SignedUpAfter     *time.Time
+	SignedUpBefore    *time.Time
+	PendingWithdrawal *bool
+	KycStatus         string
+	// partial match on the name, phone number or national id
+	Search     string
+	Sort       string
+	Descending bool
+	Cursor     string
+	Limit      int
+}
+
+type UserPage struct {
+	Users []UserGet
+	// empty on the last page
+	NextCursor string
 }
 
 type UserUpdate struct {
@@ -73,11 +104,63 @@ type UserBalanceWithdrawArgs struct {
 }
 
 type UserBalanceWdrawRequest struct {
-	Amount      int64
-	RequestId   string
-	UserId      string
-	RequestDate time.Time
-	Iban        string
+	Amount        int64
+	RequestId     string
+	UserId        string
+	RequestDate   time.Time
+	Iban          string
+	Status        string
+	BankReference string
+	ReviewerId    string
+	Reason        string
+	ApprovedAt    *time.Time
+	PaidAt        *time.Time
+	RejectedAt    *time.Time
+	CancelledAt   *time.Time
+}
+
+type PayoutBatch struct {
+	Id           int64
+	Status       string
+	ItemCount    int
+	TotalAmount  int64
+	CreatedBy    string
+	CreatedAt    time.Time
+	SubmittedBy  string
+	SubmittedAt  *time.Time
+	ReconciledAt *time.Time
+	Items        []PayoutItem
+	// approved requests left out of a new batch because their user has no iban
+	SkippedRequests []string `json:",omitempty"`
+}
+
+type PayoutItem struct {
+	Reference     string
+	RequestId     string
+	UserId        string
+	Iban          string
+	Name          string
+	NationalId    string
+	Amount        int64
+	Status        string
+	BankReference string
+	FailureReason string
+	SettledAt     *time.Time
+}
+
+type PayoutReconcileResult struct {
+	Batch          PayoutBatch
+	Paid           int
+	Failed         int
+	AlreadySettled int
+	// references in the bank's response that aren't part of the batch
+	Unmatched []string
+}
+
+type WithdrawReviewArgs struct {
+	Status        string
+	BankReference string
+	Reason        string
 }
 
 type TbillBond struct {
@@ -118,6 +201,31 @@ type TbillInterestRate struct {
 	Date         string
 }
 
+type LedgerTransfer struct {
+	UserId        string
+	DebitAccount  string
+	CreditAccount string
+	Amount        int64
+	Source        string
+	SourceId      string
+}
+
+type LedgerEntry struct {
+	Id            int64
+	TransactionId string
+	Account       string
+	Debit         int64
+	Credit        int64
+	Source        string
+	SourceId      string
+	CreatedAt     time.Time
+}
+
+type LedgerEntryPage struct {
+	Entries    []LedgerEntry
+	NextBefore int64
+}
+
 type CsvWdrawRequest struct {
 	SerialNumber int8
 	Date         time.Time
@@ -125,6 +233,7 @@ type CsvWdrawRequest struct {
 	NationalId   string
 	Iban         string
 	Amount       int64
+	Status       string
 }
 
 type CsvTbillHolding struct {
@@ -146,24 +255,286 @@ type CsvTbillPurchase struct {
 	Amount         int64
 }
 
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+type ReportTotal struct {
+	Label string
+	Value string
+}
+
+// ReportSummary is rendered into the body of a report email
+type ReportSummary struct {
+	Title       string
+	Environment string
+	GeneratedAt time.Time
+	RowCount    int
+	Totals      []ReportTotal
+	Attachment  string
+}
+
+type KycReview struct {
+	Id         int64
+	FromStatus string
+	ToStatus   string
+	// empty for transitions made by the user, e.g. resubmitting documents
+	ReviewerId string
+	Reason     string
+	CreatedAt  time.Time
+}
+
+type KycApplication struct {
+	UserId string
+	Status string
+	// reason given with the latest review
+	Reason    string
+	UpdatedAt time.Time
+	Reviews   []KycReview
+}
+
+type KycReviewArgs struct {
+	Status string
+	Reason string
+}
+
+type UserNotification struct {
+	Id        int64
+	Kind      string
+	Message   string
+	CreatedAt time.Time
+	ReadAt    *time.Time
+}
+
+// AuditEvent describes an admin mutation, Before and After are stored as json
+type AuditEvent struct {
+	Action     string
+	TargetType string
+	TargetId   string
+	Before     any
+	After      any
+}
+
+type AuditEntry struct {
+	Id         int64
+	CreatedAt  time.Time
+	Actor      string
+	ActorRole  int
+	Action     string
+	TargetType string
+	TargetId   string
+	Before     json.RawMessage
+	After      json.RawMessage
+	RemoteAddr string
+	RequestId  string
+	PrevHash   string
+	Hash       string
+}
+
+type AuditLogFilter struct {
+	Actor      string
+	Action     string
+	TargetType string
+	TargetId   string
+	From       *time.Time
+	To         *time.Time
+	// only entries with an id lower than Before, 0 for the first page
+	Before int64
+	Limit  int
+}
+
+type AuditLogPage struct {
+	Entries    []AuditEntry
+	NextBefore int64
+}
+
+type AuditChainStatus struct {
+	Valid          bool
+	EntriesChecked int64
+	// id of the first entry whose hash doesn't match, 0 when the chain is valid
+	BrokenAt int64
+}
+
+type PendingOperation struct {
+	Id        int64
+	Kind      string
+	TargetId  string
+	Amount    int64
+	Payload   json.RawMessage
+	Status    string
+	MakerId   string
+	CheckerId string
+	Reason    string
+	CreatedAt time.Time
+	DecidedAt *time.Time
+}
+
+type ApprovalThreshold struct {
+	Kind      string
+	MinAmount int64
+	UpdatedAt time.Time
+	UpdatedBy string
+}
+
+type ApprovalDecisionArgs struct {
+	Reason string
+}
+
+type ApprovalThresholdArgs struct {
+	MinAmount int64
+}
+
+type NotificationRecipient struct {
+	Id        int64
+	Email     string
+	List      string
+	Reports   []string
+	CreatedAt time.Time
+}
+
+type NotificationRecipientArgs struct {
+	Email   string
+	List    string
+	Reports []string
+}
+
+type SignedUrl struct {
+	Url       string
+	ExpiresAt time.Time
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+type AuthTokens struct {
+	UserId           string
+	AccessToken      string
+	AccessExpiresAt  time.Time
+	RefreshToken     string
+	RefreshExpiresAt time.Time
+	// how the session was authenticated, pwd and otp once a second factor was given
+	Amr []string
+}
+
+type TotpEnrolment struct {
+	Secret     string
+	OtpauthUri string
+	// png data uri of the otpauth uri
+	QrCode string
+}
+
+type TotpCodeArgs struct {
+	Code string
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string
+}
+
+type OtpRequestArgs struct {
+	PhoneNum string
+}
+
+type PasswordResetArgs struct {
+	PhoneNum string
+	Code     string
+	Password string
+}
+
+type PasswordChangeArgs struct {
+	CurrentPassword string
+	NewPassword     string
+}
+
+type RefreshTokenArgs struct {
+	RefreshToken string
+}
+
+// JSON Web Key, only the fields needed for RSA and Ed25519 public keys
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+type ErrorBody struct {
+	Code      string
+	Message   string
+	RequestId string
+	Fields    []FieldError `json:",omitempty"`
+}
+
+// every failed request is answered with this envelope
+type ErrorEnvelope struct {
+	Error ErrorBody
+}
+
+type MessageResponse struct {
+	Message string
+}
+
+type BalanceResponse struct {
+	Balance int64
+}
+
+type CopyCountResponse struct {
+	RowsCopied int64
+}
+
 type ApplicationState struct {
 	ConnPool   *pgxpool.Pool
 	AwsSess    *session.Session
 	CronRunner *cron.Cron
-	MailList   *map[string][]string
 	EnvType    string
 }
 
 type JsonEncodeSupported interface {
 	string | int64 |
-		[]UserGet | UserGet |
+		[]UserGet | UserGet | UserPage |
 		UserBalanceWdrawRequest | []UserBalanceWdrawRequest |
-		DbTbillEntry | []DbTbillEntry
+		DbTbillEntry | []DbTbillEntry |
+		LedgerEntryPage |
+		Jwks | AuthTokens |
+		ErrorEnvelope | MessageResponse | BalanceResponse | CopyCountResponse |
+		TbillInterestRate | []TbillToken |
+		NotificationRecipient | []NotificationRecipient |
+		SignedUrl |
+		KycApplication | []UserNotification |
+		AuditLogPage | AuditChainStatus |
+		PendingOperation | []PendingOperation | ApprovalThreshold | []ApprovalThreshold |
+		PayoutBatch | []PayoutBatch | PayoutReconcileResult |
+		TotpEnrolment | RecoveryCodes
 }
 
 type JsonDecodeSupported interface {
 	string | []string |
 		Admin | TbillInterestRate | []TbillBond |
 		UserUpdate |
-		UserBalanceWithdrawArgs
+		UserBalanceWithdrawArgs |
+		RefreshTokenArgs |
+		NotificationRecipientArgs |
+		KycReviewArgs |
+		ApprovalDecisionArgs | ApprovalThresholdArgs |
+		WithdrawReviewArgs |
+		TotpCodeArgs | OtpRequestArgs | PasswordResetArgs | PasswordChangeArgs
 }